@@ -2,13 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	keptn "github.com/keptn/go-utils/pkg/lib/keptn"
 	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+	"github.com/keptn/go-utils/pkg/lib/v0_2_0/fake"
+
+	"github.com/keptn-sandbox/monaco-service/pkg/common"
 )
 
 /**
@@ -29,7 +39,7 @@ func initializeTestObjects(eventFileName string) (*keptnv2.Keptn, *cloudevents.E
 
 	// Add a Fake EventSender to KeptnOptions
 	var keptnOptions = keptn.KeptnOpts{
-		// 	EventSender: &fake.EventSender{},
+		EventSender: &fake.EventSender{},
 	}
 	keptnOptions.UseLocalFileSystem = true
 	myKeptn, err := keptnv2.NewKeptn(incomingEvent, keptnOptions)
@@ -46,7 +56,7 @@ func TestHandleMonacoTriggeredEvent(t *testing.T) {
 		return
 	}
 
-	specificEvent := &MonacoStartedEventData{}
+	specificEvent := &MonacoTriggeredEventData{}
 	err = incomingEvent.DataAs(specificEvent)
 	if err != nil {
 		t.Errorf("Error getting keptn event data")
@@ -57,3 +67,713 @@ func TestHandleMonacoTriggeredEvent(t *testing.T) {
 		t.Errorf("Error: " + err.Error())
 	}
 }
+
+// Tests HandleConfigureMonitoringTriggeredEvent
+// Without Dynatrace credentials available we expect a started and a finished event
+func TestHandleConfigureMonitoringTriggeredEvent(t *testing.T) {
+	myKeptn, incomingEvent, err := initializeTestObjects("test-events/configure-monitoring.triggered.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	specificEvent := &keptnv2.ConfigureMonitoringTriggeredEventData{}
+	err = incomingEvent.DataAs(specificEvent)
+	if err != nil {
+		t.Errorf("Error getting keptn event data")
+	}
+
+	err = HandleConfigureMonitoringTriggeredEvent(myKeptn, *incomingEvent, specificEvent)
+	if err != nil {
+		t.Errorf("Error: " + err.Error())
+	}
+
+	eventSender := myKeptn.EventSender.(*fake.EventSender)
+	err = eventSender.AssertSentEventTypes([]string{
+		keptnv2.GetStartedEventType(keptnv2.ConfigureMonitoringTaskName),
+		keptnv2.GetFinishedEventType(keptnv2.ConfigureMonitoringTaskName),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Tests that HandleConfigureMonitoringTriggeredEvent ignores other monitoring types
+func TestHandleConfigureMonitoringTriggeredEventOtherType(t *testing.T) {
+	myKeptn, incomingEvent, err := initializeTestObjects("test-events/configure-monitoring.triggered.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	specificEvent := &keptnv2.ConfigureMonitoringTriggeredEventData{}
+	err = incomingEvent.DataAs(specificEvent)
+	if err != nil {
+		t.Errorf("Error getting keptn event data")
+	}
+	specificEvent.ConfigureMonitoring.Type = "prometheus"
+
+	err = HandleConfigureMonitoringTriggeredEvent(myKeptn, *incomingEvent, specificEvent)
+	if err != nil {
+		t.Errorf("Error: " + err.Error())
+	}
+
+	eventSender := myKeptn.EventSender.(*fake.EventSender)
+	err = eventSender.AssertSentEventTypes([]string{})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Tests that dry run and apply failures of monaco produce distinct messages including the monaco output
+func TestMonacoRunErrorMessage(t *testing.T) {
+	output := "2021-06-01 INFO Deploying config\n2021-06-01 ERROR Failed to upload auto-tag keptn_stage"
+
+	dryRunErr := &monacoRunError{DryRun: true, Output: output, Err: errors.New("exit status 1")}
+	if !strings.HasPrefix(dryRunErr.Error(), "Monaco dry run rejected the configuration") {
+		t.Errorf("Unexpected dry run message: %s", dryRunErr.Error())
+	}
+
+	applyErr := &monacoRunError{DryRun: false, Output: output, Err: errors.New("exit status 1")}
+	if !strings.HasPrefix(applyErr.Error(), "Monaco failed while applying the configuration") {
+		t.Errorf("Unexpected apply message: %s", applyErr.Error())
+	}
+	if !strings.Contains(applyErr.Error(), "Failed to upload auto-tag keptn_stage") || strings.Contains(applyErr.Error(), "Deploying config") {
+		t.Errorf("Expected only the monaco error lines in message: %s", applyErr.Error())
+	}
+}
+
+/**
+ * fakeDeployer fails for the tenants in failingTenants, rejects the credentials of invalidTenants and records the projects it was called with and the restored tenants
+ */
+type fakeDeployer struct {
+	failingTenants map[string]bool
+	invalidTenants map[string]bool
+	calls          []string
+	restored       []string
+}
+
+func (deployer *fakeDeployer) Deploy(dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, projects string, verbose bool, dryrun bool) (*common.MonacoDeploymentReport, string, error) {
+	deployer.calls = append(deployer.calls, fmt.Sprintf("%s:%s:%v", dtCredentials.Tenant, projects, dryrun))
+	if deployer.failingTenants[dtCredentials.Tenant] {
+		return &common.MonacoDeploymentReport{}, "ERROR deployment failed", errors.New("exit status 1")
+	}
+	return &common.MonacoDeploymentReport{}, "", nil
+}
+
+func (deployer *fakeDeployer) Plan(dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, projects string, removed []*common.MonacoDeleteEntry) (*common.MonacoPlan, error) {
+	deployer.calls = append(deployer.calls, fmt.Sprintf("%s:%s:plan", dtCredentials.Tenant, projects))
+	return &common.MonacoPlan{Configs: []*common.MonacoConfigDiff{{ConfigType: "auto-tag", ConfigName: "tagging", Action: common.MonacoDiffActionAdded}}}, nil
+}
+
+func (deployer *fakeDeployer) Snapshot(dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, projects string) (*common.MonacoSnapshot, error) {
+	return &common.MonacoSnapshot{Tenant: dtCredentials.Tenant}, nil
+}
+
+func (deployer *fakeDeployer) Restore(dtCredentials *common.DTCredentials, snapshot *common.MonacoSnapshot) (*common.MonacoDeploymentReport, error) {
+	deployer.restored = append(deployer.restored, snapshot.Tenant)
+	return &common.MonacoDeploymentReport{}, nil
+}
+
+func (deployer *fakeDeployer) Validate(dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, projects string, write bool) error {
+	if deployer.invalidTenants[dtCredentials.Tenant] {
+		return errors.New("The API token is missing the scopes: WriteConfig (auto-tag)")
+	}
+	return nil
+}
+
+func (deployer *fakeDeployer) Delete(dtCredentials *common.DTCredentials, entries []*common.MonacoDeleteEntry, dryrun bool) (*common.MonacoDeploymentReport, error) {
+	report := &common.MonacoDeploymentReport{Configs: []*common.MonacoConfigResult{}}
+	for _, entry := range entries {
+		report.Configs = append(report.Configs, &common.MonacoConfigResult{ConfigType: entry.ConfigType, ConfigName: entry.Name, Action: common.MonacoActionDeleted})
+	}
+	return report, nil
+}
+
+// sets the env variables and returns a function that restores their previous values
+func setTestEnv(env map[string]string) func() {
+	previous := map[string]*string{}
+	for key, value := range env {
+		previous[key] = nil
+		if previousValue, ok := os.LookupEnv(key); ok {
+			previous[key] = &previousValue
+		}
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, value := range previous {
+			if value == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *value)
+			}
+		}
+	}
+}
+
+/**
+ * Prepares a test of deployToTenants: in RunLocalTest mode every tenant uses the credentials of DT_TENANT and DT_API_TOKEN.
+ * Returns the tenants of monaco.conf.yaml and a function that restores the env variables and RunLocalTest and removes the snapshots of the test
+ */
+func setupTestTenants(t *testing.T, tenantURL string, monacoConfigFile *common.MonacoConfigFile, dtCreds string, keptnEvent *common.BaseKeptnEvent) ([]common.MonacoTenant, func()) {
+	restoreEnv := setTestEnv(map[string]string{"DT_TENANT": tenantURL, "DT_API_TOKEN": "token"})
+	runLocalTest := common.RunLocalTest
+	common.RunLocalTest = true
+	restore := func() {
+		common.RunLocalTest = runLocalTest
+		restoreEnv()
+		os.RemoveAll(common.MonacoSnapshotFolder)
+	}
+
+	tenants, err := getMonacoTenants(monacoConfigFile, dtCreds, keptnEvent)
+	if err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	return tenants, restore
+}
+
+// Tests deploying to several tenants with and without continueOnFailure
+func TestDeployToTenants(t *testing.T) {
+	runtimeConfig := MonacoRuntimeConfig{DryRun: false}
+
+	keptnEvent := &common.BaseKeptnEvent{Project: "sockshop", Stage: "production"}
+	monacoConfigFile := &common.MonacoConfigFile{
+		Projects: []string{"sockshop"},
+		Tenants:  []common.MonacoTenant{{Name: "dynatrace-primary"}, {Name: "dynatrace-dr", Projects: []string{"infrastructure"}}},
+	}
+	tenants, restore := setupTestTenants(t, "primary.live.dynatrace.com", monacoConfigFile, "", keptnEvent)
+	defer restore()
+
+	deployer := &fakeDeployer{failingTenants: map[string]bool{"https://primary.live.dynatrace.com": true}}
+	results, err := deployToTenants(deployer, monacoConfigFile, runtimeConfig, tenants, keptnEvent)
+	if err == nil {
+		t.Errorf("Expected an error as the primary tenant failed")
+	}
+	if len(deployer.calls) != 1 || results[0].Result != keptnv2.ResultFailed || results[1].Result != "" {
+		t.Errorf("Expected second tenant to be skipped, got calls %v", deployer.calls)
+	}
+
+	monacoConfigFile.ContinueOnFailure = true
+	deployer = &fakeDeployer{failingTenants: map[string]bool{"https://primary.live.dynatrace.com": true}}
+	results, err = deployToTenants(deployer, monacoConfigFile, runtimeConfig, tenants, keptnEvent)
+	if err == nil || !strings.Contains(err.Error(), "Monaco failed for 2 of 2 tenants") {
+		t.Errorf("Expected aggregated error, got %v", err)
+	}
+	if len(deployer.calls) != 2 || deployer.calls[1] != "https://primary.live.dynatrace.com:infrastructure:false" {
+		t.Errorf("Expected second tenant to be deployed with its own projects, got calls %v", deployer.calls)
+	}
+}
+
+// Tests that two services of a stage share the tracked configs of the tenant but only prune their own configs
+func TestPruneMonacoConfigsServices(t *testing.T) {
+	runLocal := common.RunLocal
+	common.RunLocal = true
+	defer func() { common.RunLocal = runLocal }()
+	defer os.RemoveAll("monaco-test")
+	defer os.RemoveAll(common.MonacoStateFolder)
+	os.MkdirAll(common.MonacoStateFolder, 0755)
+
+	enabled := true
+	monacoConfigFile := &common.MonacoConfigFile{AutoPrune: &enabled}
+	dtCredentials := &common.DTCredentials{Tenant: "https://abc12345.live.dynatrace.com", ApiToken: "token"}
+
+	run := func(service string, tags ...string) *common.MonacoDeploymentReport {
+		keptnEvent := &common.BaseKeptnEvent{Context: "prune-test", Project: "sockshop", Stage: "dev", Service: service}
+		os.RemoveAll("monaco-test")
+		files := map[string]string{"monaco/auto-tag/tagging.json": `{"name": "{{ .name }}"}`}
+		yaml := "config:\n"
+		for _, tag := range tags {
+			yaml += fmt.Sprintf("  - %s: \"tagging.json\"\n", tag)
+		}
+		for _, tag := range tags {
+			yaml += fmt.Sprintf("%s:\n  - name: \"%s\"\n", tag, tag)
+		}
+		files["monaco/auto-tag/tagging.yaml"] = yaml
+		for fileName, content := range files {
+			path := filepath.Join(common.GetMonacoProjectsFolder(keptnEvent), fileName)
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		report := &common.MonacoDeploymentReport{Configs: []*common.MonacoConfigResult{}}
+		if _, err := pruneMonacoConfigs(&fakeDeployer{}, monacoConfigFile, dtCredentials, keptnEvent, "dynatrace", "", report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	run("carts", "carts", "shop")
+	run("orders", "orders", "shop")
+
+	// orders no longer deploys the shared tag, carts still does
+	report := run("orders", "orders")
+	if len(report.Configs) != 0 {
+		t.Errorf("Expected no configs to be deleted as carts still deploys the shared tag, got %+v", report.Configs)
+	}
+
+	// carts no longer deploys its own tag
+	report = run("carts", "shop")
+	if len(report.Configs) != 1 || report.Configs[0].ConfigName != "carts" {
+		t.Errorf("Expected only the tag of carts to be deleted, got %+v", report.Configs)
+	}
+
+	state, _ := common.GetMonacoState(&common.BaseKeptnEvent{Project: "sockshop", Stage: "dev"}, "dynatrace")
+	if state == nil || len(state.Configs) != 2 {
+		t.Fatalf("Expected the tags of both services to stay tracked, got %+v", state)
+	}
+	for _, config := range state.Configs {
+		if config.Service+"/"+config.Name != "orders/orders" && config.Service+"/"+config.Name != "carts/shop" {
+			t.Errorf("Unexpected tracked config %+v", config)
+		}
+	}
+}
+
+// Tests that the secrets of explicit tenants are searched in the credentialNamespaces
+func TestGetTenantCredentials(t *testing.T) {
+	defer setTestEnv(map[string]string{"PROD_DT_TENANT": "prod.live.dynatrace.com", "PROD_DT_API_TOKEN": "token", common.CredentialAllowedNamespacesEnv: "dynatrace"})()
+
+	keptnEvent := &common.BaseKeptnEvent{Project: "sockshop", Stage: "production"}
+	monacoConfigFile := &common.MonacoConfigFile{
+		CredentialNamespaces: []string{"keptn", "dynatrace"},
+		Tenants:              []common.MonacoTenant{{Name: "env://PROD"}, {Name: "dynatrace-dr"}},
+	}
+
+	dtCredentials, err := getTenantCredentials(monacoConfigFile, monacoConfigFile.Tenants[0], keptnEvent)
+	if err != nil || dtCredentials.Tenant != "https://prod.live.dynatrace.com" {
+		t.Errorf("Expected the credentials of the env variables, got %v, %v", dtCredentials, err)
+	}
+
+	_, err = getTenantCredentials(monacoConfigFile, monacoConfigFile.Tenants[1], keptnEvent)
+	searchErr, ok := err.(*common.CredentialSearchError)
+	if !ok || len(searchErr.Failures) != 2 {
+		t.Errorf("Expected the secret to be searched in both namespaces, got %v", err)
+	}
+}
+
+// Tests that a run that waits for the same tenant, project and stage is skipped with a warning if a newer run of the same kind is queued
+func TestDeployToTenantsSuperseded(t *testing.T) {
+	defaultRunQueue := monacoRunQueue
+	monacoRunQueue = common.NewRunQueue(0, common.RunQueuePolicyLatest)
+	defer func() { monacoRunQueue = defaultRunQueue }()
+
+	keptnEvent := &common.BaseKeptnEvent{Project: "sockshop", Stage: "production", Service: "carts", Task: MonacoEvent}
+	monacoConfigFile := &common.MonacoConfigFile{Projects: []string{"sockshop"}}
+	tenants, restore := setupTestTenants(t, "primary.live.dynatrace.com", monacoConfigFile, "dynatrace", keptnEvent)
+	defer restore()
+	key := common.RunQueueKey("https://primary.live.dynatrace.com", keptnEvent.Project, keptnEvent.Stage)
+
+	release, err := monacoRunQueue.Acquire(key, "rollback|carts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployer := &fakeDeployer{}
+	finished := make(chan []*MonacoTenantResult, 1)
+	go func() {
+		results, err := deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{}, tenants, keptnEvent)
+		if err != nil {
+			t.Errorf("Expected no error for a superseded run, got %v", err)
+		}
+		finished <- results
+	}()
+	for deadline := time.Now().Add(5 * time.Second); monacoRunQueue.Stats().Queued == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the run to wait for the key")
+		}
+	}
+
+	// a plan of the service or an apply of another service don't supersede the waiting run, a newer apply of the service does
+	newer := make(chan func(), 3)
+	for _, kind := range []string{"monaco-plan|carts", "monaco|orders", "monaco|carts"} {
+		queued := monacoRunQueue.Stats().Queued
+		go func(kind string) {
+			newerRelease, _ := monacoRunQueue.Acquire(key, kind)
+			newer <- newerRelease
+		}(kind)
+		for deadline := time.Now().Add(5 * time.Second); monacoRunQueue.Stats().Queued == queued && len(finished) == 0; time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the %s run to wait for the key", kind)
+			}
+		}
+		if kind != "monaco|carts" && len(finished) != 0 {
+			t.Fatalf("Expected the %s run not to supersede the waiting run", kind)
+		}
+	}
+
+	select {
+	case results := <-finished:
+		if len(results) != 1 || results[0].Result != keptnv2.ResultWarning || results[0].Message != common.ErrRunSuperseded.Error() || results[0].Tenant != "https://primary.live.dynatrace.com" {
+			t.Errorf("Unexpected result of the superseded run %+v", results)
+		}
+		if getMonacoTenantsResult(results) != keptnv2.ResultWarning {
+			t.Errorf("Expected the task to finish with a warning")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the waiting run to be superseded")
+	}
+	if len(deployer.calls) != 0 {
+		t.Errorf("Expected the superseded run not to deploy, got calls %v", deployer.calls)
+	}
+
+	release()
+	for i := 0; i < 3; i++ {
+		(<-newer)()
+	}
+}
+
+// Tests that plans, dry runs and rollbacks of a service are other kinds of runs than its applies
+func TestGetMonacoRunKind(t *testing.T) {
+	keptnEvent := &common.BaseKeptnEvent{Service: "carts", Task: MonacoEvent}
+	runs := []struct {
+		runtimeConfig MonacoRuntimeConfig
+		kind          string
+	}{
+		{MonacoRuntimeConfig{DryRun: true}, "monaco|carts"},
+		{MonacoRuntimeConfig{Plan: true, DryRun: true}, "monaco-plan|carts"},
+		{MonacoRuntimeConfig{DryRunOnly: true}, "monaco-dry-run|carts"},
+	}
+	for _, run := range runs {
+		if kind := getMonacoRunKind(run.runtimeConfig, keptnEvent); kind != run.kind {
+			t.Errorf("Expected run kind %s for %+v, got %s", run.kind, run.runtimeConfig, kind)
+		}
+	}
+}
+
+// Tests that monaco.conf.yaml overrides the env variables and the event overrides monaco.conf.yaml
+func TestGetMonacoRuntimeConfig(t *testing.T) {
+	enabled := true
+	disabled := false
+
+	runtimeConfig := getMonacoRuntimeConfig(&common.MonacoConfigFile{Verbose: &disabled}, MonacoTriggeredData{})
+	if runtimeConfig.Verbose || !runtimeConfig.DryRun || runtimeConfig.DryRunOnly {
+		t.Errorf("Unexpected runtime config %+v", runtimeConfig)
+	}
+
+	runtimeConfig = getMonacoRuntimeConfig(&common.MonacoConfigFile{DryRun: &disabled}, MonacoTriggeredData{DryRunOnly: &enabled, KeepTempDir: &disabled})
+	if !runtimeConfig.DryRun || !runtimeConfig.DryRunOnly || runtimeConfig.KeepTempDir {
+		t.Errorf("Expected a dry run only, got %+v", runtimeConfig)
+	}
+}
+
+// Tests that a dry run only event validates the configuration on every tenant without applying it
+func TestDeployToTenantsDryRunOnly(t *testing.T) {
+	keptnEvent := &common.BaseKeptnEvent{Project: "sockshop", Stage: "production"}
+	monacoConfigFile := &common.MonacoConfigFile{Projects: []string{"sockshop"}}
+	tenants, restore := setupTestTenants(t, "primary.live.dynatrace.com", monacoConfigFile, "dynatrace", keptnEvent)
+	defer restore()
+
+	deployer := &fakeDeployer{}
+	results, err := deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{DryRun: true, DryRunOnly: true}, tenants, keptnEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deployer.calls) != 1 || deployer.calls[0] != "https://primary.live.dynatrace.com:sockshop:true" {
+		t.Errorf("Expected only a dry run, got calls %v", deployer.calls)
+	}
+	if !strings.Contains(results[0].Message, "nothing was applied") {
+		t.Errorf("Unexpected message %s", results[0].Message)
+	}
+}
+
+// Tests that plan mode only plans and never deploys
+func TestDeployToTenantsPlan(t *testing.T) {
+	keptnEvent := &common.BaseKeptnEvent{Project: "sockshop", Stage: "production"}
+	monacoConfigFile := &common.MonacoConfigFile{Projects: []string{"sockshop"}}
+	tenants, restore := setupTestTenants(t, "primary.live.dynatrace.com", monacoConfigFile, "dynatrace", keptnEvent)
+	defer restore()
+
+	deployer := &fakeDeployer{}
+	results, err := deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{DryRun: true, Plan: true}, tenants, keptnEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deployer.calls) != 1 || deployer.calls[0] != "https://primary.live.dynatrace.com:sockshop:plan" {
+		t.Errorf("Expected only a plan, got calls %v", deployer.calls)
+	}
+	if results[0].Plan == nil || !strings.HasPrefix(results[0].Message, "Monaco plan: 1 configs to add") {
+		t.Errorf("Unexpected result %+v", results[0])
+	}
+}
+
+// Tests that a plan with autoPrune fails instead of showing no removed configs if the tracked configs can't be read
+func TestDeployToTenantsPlanInvalidState(t *testing.T) {
+	keptnEvent := &common.BaseKeptnEvent{Context: "plan-state-test", Project: "sockshop", Stage: "production"}
+	enabled := true
+	monacoConfigFile := &common.MonacoConfigFile{Projects: []string{"monaco"}, AutoPrune: &enabled}
+	tenants, restore := setupTestTenants(t, "primary.live.dynatrace.com", monacoConfigFile, "dynatrace", keptnEvent)
+	defer restore()
+	runLocal := common.RunLocal
+	common.RunLocal = true
+	defer func() { common.RunLocal = runLocal }()
+	defer os.RemoveAll("monaco-test")
+	defer os.RemoveAll(common.MonacoStateFolder)
+
+	files := map[string]string{
+		filepath.Join(common.GetMonacoProjectsFolder(keptnEvent), "monaco/auto-tag/tagging.yaml"): "config:\n  - tagging: \"tagging.json\"\ntagging:\n  - name: \"dev\"\n",
+		filepath.Join(common.GetMonacoProjectsFolder(keptnEvent), "monaco/auto-tag/tagging.json"): `{"name": "{{ .name }}"}`,
+		common.GetMonacoStateResource("dynatrace"):                                                `{"tenant": `,
+	}
+	for path, content := range files {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+	}
+
+	deployer := &fakeDeployer{}
+	results, err := deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{DryRun: true, Plan: true}, tenants, keptnEvent)
+	if err == nil || results[0].Result != keptnv2.ResultFailed || !strings.Contains(results[0].Message, "Failed to plan the removed configs") {
+		t.Errorf("Expected the plan to fail, got %v", err)
+	}
+	if len(deployer.calls) != 0 {
+		t.Errorf("Expected no plan without the removed configs, got calls %v", deployer.calls)
+	}
+}
+
+// Tests HandleMonacoDriftTriggeredEvent
+// Without monaco files and Dynatrace credentials available we expect a started and a finished event
+func TestHandleMonacoDriftTriggeredEvent(t *testing.T) {
+	myKeptn, incomingEvent, err := initializeTestObjects("test-events/monaco-drift.triggered.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	specificEvent := &MonacoDriftTriggeredEventData{}
+	err = incomingEvent.DataAs(specificEvent)
+	if err != nil {
+		t.Errorf("Error getting keptn event data")
+	}
+
+	err = HandleMonacoDriftTriggeredEvent(myKeptn, *incomingEvent, specificEvent)
+	if err != nil {
+		t.Errorf("Error: " + err.Error())
+	}
+
+	eventSender := myKeptn.EventSender.(*fake.EventSender)
+	err = eventSender.AssertSentEventTypes([]string{
+		keptnv2.GetStartedEventType(MonacoDriftEvent),
+		keptnv2.GetFinishedEventType(MonacoDriftEvent),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Tests that the monaco and monaco-drift handlers finish with an error if the event data can't be parsed
+func TestHandleTriggeredEventInvalidData(t *testing.T) {
+	handlers := map[string]func(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event) error{
+		MonacoEvent: func(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event) error {
+			return HandleMonacoTriggeredEvent(myKeptn, incomingEvent, &MonacoTriggeredEventData{})
+		},
+		MonacoDriftEvent: func(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event) error {
+			return HandleMonacoDriftTriggeredEvent(myKeptn, incomingEvent, &MonacoDriftTriggeredEventData{})
+		},
+	}
+	for task, handler := range handlers {
+		myKeptn, incomingEvent, err := initializeTestObjects("test-events/" + task + ".triggered.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		incomingEvent.SetData(cloudevents.ApplicationJSON, []string{"not", "an", "object"})
+
+		err = handler(myKeptn, *incomingEvent)
+		if err != nil {
+			t.Errorf("Error: " + err.Error())
+		}
+
+		eventSender := myKeptn.EventSender.(*fake.EventSender)
+		err = eventSender.AssertSentEventTypes([]string{keptnv2.GetStartedEventType(task), keptnv2.GetFinishedEventType(task)})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		finishedData := &keptnv2.EventData{}
+		eventSender.SentEvents[1].DataAs(finishedData)
+		if finishedData.Status != keptnv2.StatusErrored || !strings.Contains(finishedData.Message, "Error parsing the event data") {
+			t.Errorf("Expected an errored %s.finished event, got %+v", task, finishedData)
+		}
+	}
+}
+
+// Tests that changed and missing configs are reported as drift with the configured result
+func TestEvaluateMonacoDrift(t *testing.T) {
+	tenantResults := []*MonacoTenantResult{{Name: "dynatrace", Plan: &common.MonacoPlan{Configs: []*common.MonacoConfigDiff{
+		{Project: "sockshop", ConfigType: "auto-tag", ConfigName: "tagging", Action: common.MonacoDiffActionUnchanged},
+	}}}}
+
+	result, _, drifted := evaluateMonacoDrift(tenantResults, keptnv2.ResultWarning)
+	if result != keptnv2.ResultPass || drifted != 0 {
+		t.Errorf("Expected no drift, got %s with %d drifted configs", result, drifted)
+	}
+
+	tenantResults[0].Plan.Configs = append(tenantResults[0].Plan.Configs,
+		&common.MonacoConfigDiff{Project: "sockshop", ConfigType: "management-zone", ConfigName: "zone", Action: common.MonacoDiffActionChanged},
+		&common.MonacoConfigDiff{Project: "sockshop", ConfigType: "dashboard", ConfigName: "overview", Action: common.MonacoDiffActionAdded})
+
+	result, message, drifted := evaluateMonacoDrift(tenantResults, keptnv2.ResultWarning)
+	if result != keptnv2.ResultWarning || drifted != 2 || !strings.Contains(message, "sockshop/dashboard/overview is missing") {
+		t.Errorf("Expected drift of 2 configs, got %s: %s", result, message)
+	}
+
+	_, err := getMonacoDriftResult(&common.MonacoConfigFile{DriftResult: "maybe"})
+	if err == nil {
+		t.Errorf("Expected an error for an invalid driftResult")
+	}
+}
+
+// Tests that fields Dynatrace adds to a deployed config, e.g: defaults like enabled, are no drift
+func TestMonacoDriftServerDefaults(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/config/v1/autoTags":
+			w.Write([]byte(`{"values": [{"id": "tag-1", "name": "production"}]}`))
+		case "/api/config/v1/autoTags/tag-1":
+			w.Write([]byte(`{"metadata": {"clusterVersion": "1.220"}, "id": "tag-1", "name": "production", "enabled": true,
+				"rules": [{"key": "stage", "type": "SERVICE", "enabled": true, "valueNormalization": "Leave text as-is", "propagationTypes": [], "conditions": []}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	keptnEvent := &common.BaseKeptnEvent{Context: "drift-defaults-test", Project: "sockshop", Stage: "production"}
+	disabled := false
+	monacoConfigFile := &common.MonacoConfigFile{Projects: []string{"monaco"}, ValidateToken: &disabled}
+	tenants, restore := setupTestTenants(t, server.URL, monacoConfigFile, "dynatrace", keptnEvent)
+	defer restore()
+	defer common.DeleteTempFolderForKeptnContext(keptnEvent)
+	files := map[string]string{
+		"monaco/auto-tag/tagging.yaml": "config:\n  - tagging: \"tagging.json\"\ntagging:\n  - name: \"{{ .Env.KEPTN_STAGE }}\"\n",
+		"monaco/auto-tag/tagging.json": `{"name": "{{ .name }}", "rules": [{"key": "stage", "type": "SERVICE"}]}`,
+	}
+	for file, content := range files {
+		path := filepath.Join(common.GetMonacoProjectsFolder(keptnEvent), file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(content), 0644)
+	}
+
+	deployer := &common.NativeDeployer{HTTPClient: server.Client()}
+
+	tenantResults, err := deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{Plan: true}, tenants, keptnEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, message, drifted := evaluateMonacoDrift(tenantResults, keptnv2.ResultFailed)
+	if result != keptnv2.ResultPass || drifted != 0 {
+		t.Errorf("Expected no drift, got %s: %s", result, message)
+	}
+}
+
+// Tests that the configs are restored if applying fails but not if the dry run fails
+func TestDeployToTenantsRollback(t *testing.T) {
+	keptnEvent := &common.BaseKeptnEvent{Context: "rollback-test", Project: "sockshop", Stage: "production"}
+	monacoConfigFile := &common.MonacoConfigFile{Projects: []string{"sockshop"}}
+	tenants, restore := setupTestTenants(t, "primary.live.dynatrace.com", monacoConfigFile, "dynatrace", keptnEvent)
+	defer restore()
+
+	deployer := &fakeDeployer{failingTenants: map[string]bool{"https://primary.live.dynatrace.com": true}}
+	results, err := deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{}, tenants, keptnEvent)
+	if err == nil || !strings.Contains(err.Error(), "Rolled back to the configuration before the run") {
+		t.Errorf("Expected a rollback, got %v", err)
+	}
+	if len(deployer.restored) != 1 || !results[0].RolledBack {
+		t.Errorf("Expected the snapshot to be restored, got %v", deployer.restored)
+	}
+
+	deployer = &fakeDeployer{failingTenants: map[string]bool{"https://primary.live.dynatrace.com": true}}
+	_, err = deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{DryRun: true}, tenants, keptnEvent)
+	if err == nil || len(deployer.restored) != 0 {
+		t.Errorf("Expected no rollback after a failed dry run, got %v", deployer.restored)
+	}
+
+	disabled := false
+	monacoConfigFile.RollbackOnFailure = &disabled
+	deployer = &fakeDeployer{failingTenants: map[string]bool{"https://primary.live.dynatrace.com": true}}
+	deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{}, tenants, keptnEvent)
+	if len(deployer.restored) != 0 {
+		t.Errorf("Expected no rollback with rollbackOnFailure: false, got %v", deployer.restored)
+	}
+}
+
+// Tests that monaco doesn't run on tenants with invalid credentials unless validateToken is disabled
+func TestDeployToTenantsInvalidCredentials(t *testing.T) {
+	keptnEvent := &common.BaseKeptnEvent{Context: "validate-test", Project: "sockshop", Stage: "production"}
+	monacoConfigFile := &common.MonacoConfigFile{Projects: []string{"sockshop"}}
+	tenants, restore := setupTestTenants(t, "primary.live.dynatrace.com", monacoConfigFile, "dynatrace", keptnEvent)
+	defer restore()
+
+	deployer := &fakeDeployer{invalidTenants: map[string]bool{"https://primary.live.dynatrace.com": true}}
+	results, err := deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{}, tenants, keptnEvent)
+	if err == nil || !strings.Contains(err.Error(), "WriteConfig (auto-tag)") {
+		t.Errorf("Expected the missing scopes in the error, got %v", err)
+	}
+	if len(deployer.calls) != 0 || results[0].Result != keptnv2.ResultFailed {
+		t.Errorf("Expected monaco not to run, got calls %v", deployer.calls)
+	}
+
+	disabled := false
+	monacoConfigFile.ValidateToken = &disabled
+	_, err = deployToTenants(deployer, monacoConfigFile, MonacoRuntimeConfig{}, tenants, keptnEvent)
+	if err != nil || len(deployer.calls) != 1 {
+		t.Errorf("Expected monaco to run with validateToken: false, got %v", err)
+	}
+}
+
+// Tests that downloaded configs are stored on the requested level and the level defaults to the level of the event
+func TestGetMonacoDownloadTarget(t *testing.T) {
+	keptnEvent := &common.BaseKeptnEvent{Project: "sockshop", Stage: "dev", Service: "carts"}
+
+	expected := map[string]string{"": common.KeptnResourceLevelService, "service": common.KeptnResourceLevelService, "stage": common.KeptnResourceLevelStage, "project": common.KeptnResourceLevelProject}
+	for level, expectedLevel := range expected {
+		uploadEvent, err := getMonacoDownloadTarget(keptnEvent, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if getMonacoDownloadLevel(uploadEvent) != expectedLevel {
+			t.Errorf("Expected level %s for %s, got %+v", expectedLevel, level, uploadEvent)
+		}
+	}
+	if keptnEvent.Service != "carts" {
+		t.Errorf("Expected the event to be unchanged")
+	}
+
+	_, err := getMonacoDownloadTarget(&common.BaseKeptnEvent{Project: "sockshop", Stage: "dev"}, "service")
+	if err == nil {
+		t.Errorf("Expected an error for level service without service")
+	}
+	_, err = getMonacoDownloadTarget(keptnEvent, "tenant")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown level")
+	}
+}
+
+// Tests that the output of the deployment task and the image are taken from the monaco.triggered event
+func TestSetDeploymentData(t *testing.T) {
+	eventData := &MonacoTriggeredEventData{}
+	err := json.Unmarshal([]byte(`{
+		"project": "sockshop", "stage": "dev", "service": "carts",
+		"configurationChange": {"values": {"image": "localhost:5000/keptnexamples/carts:0.12.1"}},
+		"deployment": {"deploymentstrategy": "blue_green_service", "deploymentNames": ["canary"],
+			"deploymentURIsLocal": ["http://carts-canary.sockshop-dev:80"], "deploymentURIsPublic": ["http://carts.sockshop-dev.example.com"]}
+	}`), eventData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keptnEvent := &common.BaseKeptnEvent{Project: "sockshop", Stage: "dev", Service: "carts"}
+	setDeploymentData(keptnEvent, eventData.Deployment, eventData.ConfigurationChange)
+
+	if keptnEvent.Deployment != "canary" || keptnEvent.DeploymentStrategy != "blue_green_service" || keptnEvent.DeploymentURIsPublic[0] != "http://carts.sockshop-dev.example.com" {
+		t.Errorf("Unexpected deployment data %+v", keptnEvent)
+	}
+	if keptnEvent.Image != "localhost:5000/keptnexamples/carts:0.12.1" || keptnEvent.Tag != "0.12.1" {
+		t.Errorf("Unexpected image %s and tag %s", keptnEvent.Image, keptnEvent.Tag)
+	}
+
+	keptnEvent = &common.BaseKeptnEvent{}
+	setDeploymentData(keptnEvent, nil, &keptnv2.ConfigurationChange{Values: map[string]interface{}{"image": "localhost:5000/carts"}})
+	if keptnEvent.Tag != "" {
+		t.Errorf("Expected no tag for an image without tag, got %s", keptnEvent.Tag)
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
-	"strconv"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
 	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
@@ -14,6 +15,9 @@ import (
 	"github.com/keptn-sandbox/monaco-service/pkg/common"
 )
 
+// maxMonacoOutputLines is the number of monaco output lines we include in a finished event message
+const maxMonacoOutputLines = 10
+
 /**
 * Here are all the handler functions for the individual event
 * See https://github.com/keptn/spec/blob/0.8.0-alpha/cloudevents.md for details on the payload
@@ -28,20 +32,156 @@ func GenericLogKeptnCloudEventHandler(myKeptn *keptnv2.Keptn, incomingEvent clou
 }
 
 // HandleConfigureMonitoringTriggeredEvent handles configure-monitoring.triggered events
-// TODO: add in your handler code
+// It bootstraps the Dynatrace tenant for the project by running either the project level dynatrace/monaco.zip
+// or the built-in default monaco project (auto-tags & management zones per stage)
 func HandleConfigureMonitoringTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *keptnv2.ConfigureMonitoringTriggeredEventData) error {
 	log.Printf("Handling configure-monitoring.triggered Event: %s", incomingEvent.Context.GetID())
 
-	return nil
+	// we only configure Dynatrace monitoring
+	if data.ConfigureMonitoring.Type != "dynatrace" {
+		log.Printf("Ignoring configure-monitoring.triggered Event for monitoring type '%s'", data.ConfigureMonitoring.Type)
+		return nil
+	}
+
+	startedData := &keptnv2.ConfigureMonitoringStartedEventData{EventData: data.EventData}
+	startedData.Message = "Starting to configure Dynatrace monitoring with monaco"
+	_, err := myKeptn.SendTaskStartedEvent(startedData, ServiceName)
+	if err != nil {
+		return err
+	}
+
+	var shkeptncontext string
+	incomingEvent.Context.ExtensionAs("shkeptncontext", &shkeptncontext)
+
+	keptnEvent := &common.BaseKeptnEvent{}
+	keptnEvent.Project = data.EventData.GetProject()
+	keptnEvent.Stage = data.EventData.GetStage()
+	keptnEvent.Service = data.EventData.GetService()
+	keptnEvent.Labels = data.EventData.GetLabels()
+	keptnEvent.Context = shkeptncontext
+	keptnEvent.Task = keptnv2.ConfigureMonitoringTaskName
+	keptnEvent.RunID = common.NewRunID(incomingEvent.ID())
+
+	monacoConfigFile, dtCreds, err := loadMonacoConfigFile(keptnEvent)
+	var tenants []common.MonacoTenant
+	if err == nil {
+		tenants, err = getMonacoTenants(monacoConfigFile, dtCreds, keptnEvent)
+	}
+	var deployer common.Deployer
+	if err == nil {
+		deployer, err = common.NewDeployer(monacoConfigFile)
+	}
+	if err != nil {
+		finishedData := &keptnv2.ConfigureMonitoringFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: err.Error(),
+			},
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+	runtimeConfig := getMonacoRuntimeConfig(monacoConfigFile, MonacoTriggeredData{})
+
+	// Prepare the folder structure for monaco with either the uploaded monaco.zip or our default project
+	err = prepareConfigureMonitoringFiles(myKeptn, keptnEvent)
+	if err == nil {
+		err = common.PrepareMonacoEnvironmentsFile(keptnEvent, monacoConfigFile)
+	}
+	if err != nil {
+		finishedData := &keptnv2.ConfigureMonitoringFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: fmt.Sprintf("Error preparing monaco files: %s", err.Error()),
+			},
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	// validate and apply the configuration like a monaco task, including the dry run, rollback and the run queue
+	tenantResults, monacoErr := deployToTenants(deployer, monacoConfigFile, runtimeConfig, tenants, keptnEvent)
+	deleteMonacoTempFolder(runtimeConfig, keptnEvent)
+
+	if monacoErr != nil {
+		finishedData := &keptnv2.ConfigureMonitoringFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: fmt.Sprintf("Failed to configure Dynatrace monitoring with monaco: %s", monacoErr.Error()),
+			},
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	configuredTenants := []string{}
+	for _, tenantResult := range tenantResults {
+		configuredTenants = append(configuredTenants, tenantResult.Tenant)
+	}
+	message := fmt.Sprintf("Successfully configured Dynatrace monitoring for project %s on %s", keptnEvent.Project, strings.Join(configuredTenants, ", "))
+	if runtimeConfig.DryRunOnly {
+		message = fmt.Sprintf("Successfully validated the Dynatrace monitoring configuration for project %s, nothing was applied!", keptnEvent.Project)
+	}
+
+	finishedData := &keptnv2.ConfigureMonitoringFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusSucceeded,
+			Result:  getMonacoTenantsResult(tenantResults),
+			Message: message,
+		},
+	}
+	_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+
+	return err
 }
 
-// HandleConfigureMonitoringTriggeredEvent handles configure-monitoring.triggered events
-// TODO: add in your handler code
-func HandleMonacoTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *MonacoStartedEventData) error {
-	fmt.Printf("Handling monaco.triggered Event: %s", incomingEvent.Context.GetID())
+/**
+ * Creates the temp folder for the configure-monitoring run and fills it with the project level dynatrace/monaco.zip.
+ * If no such archive exists we fall back to the default monaco project for all stages of the shipyard
+ */
+func prepareConfigureMonitoringFiles(myKeptn *keptnv2.Keptn, keptnEvent *common.BaseKeptnEvent) error {
+	err := common.CreateBaseFolderIfNotExist()
+	if err != nil {
+		return err
+	}
+	err, _ = common.CreateTempFolderForKeptnContext(keptnEvent)
+	if err != nil {
+		return err
+	}
+
+	_, err = common.DownloadAndExtractMonacoZip(keptnEvent, "dynatrace/monaco.zip")
+	if err == nil {
+		return nil
+	}
+
+	log.Printf("No monaco bundle found for project %s, using default monaco project", keptnEvent.Project)
+
+	stages := []string{}
+	shipyard, err := myKeptn.GetShipyard()
+	if err == nil {
+		for _, stage := range shipyard.Spec.Stages {
+			stages = append(stages, stage.Name)
+		}
+	} else if keptnEvent.Stage != "" {
+		log.Printf("Could not load shipyard for project %s, only configuring stage %s: %v", keptnEvent.Project, keptnEvent.Stage, err)
+		stages = append(stages, keptnEvent.Stage)
+	} else {
+		return fmt.Errorf("Could not load shipyard for project %s: %v", keptnEvent.Project, err)
+	}
+
+	return common.WriteDefaultMonacoProject(keptnEvent, stages)
+}
+
+// HandleMonacoTriggeredEvent handles monaco.triggered events
+// It downloads the monaco projects of the Keptn project, stage and service and applies them to the Dynatrace tenants
+func HandleMonacoTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *MonacoTriggeredEventData) error {
+	log.Printf("Handling monaco.triggered Event: %s", incomingEvent.Context.GetID())
 
 	data.EventData.Message = "Starting to query for Monaco Projects"
-	_, err := myKeptn.SendTaskStartedEvent(data, ServiceName)
+	_, err := myKeptn.SendTaskStartedEvent(&MonacoStartedEventData{EventData: data.EventData}, ServiceName)
 
 	if err != nil {
 		return err
@@ -50,8 +190,7 @@ func HandleMonacoTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevent
 	var shkeptncontext string
 	incomingEvent.Context.ExtensionAs("shkeptncontext", &shkeptncontext)
 
-	fmt.Sprintf("Handling Configuration Changed Event: %s", incomingEvent.Context.GetID())
-	fmt.Sprintf("Processing sh.keptn.event.configuration.change for %s.%s.%s", data.EventData.GetProject(), data.EventData.GetStage(), data.EventData.GetService())
+	log.Printf("Processing sh.keptn.event.monaco.triggered for %s.%s.%s\n", data.EventData.GetProject(), data.EventData.GetStage(), data.EventData.GetService())
 
 	keptnEvent := &common.BaseKeptnEvent{}
 	keptnEvent.Project = data.EventData.GetProject()
@@ -59,41 +198,59 @@ func HandleMonacoTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevent
 	keptnEvent.Service = data.EventData.GetService()
 	keptnEvent.Labels = data.EventData.GetLabels()
 	keptnEvent.Context = shkeptncontext
+	keptnEvent.Task = MonacoEvent
+	keptnEvent.RunID = common.NewRunID(incomingEvent.ID())
+	err = incomingEvent.DataAs(&keptnEvent.Data)
+	if err != nil {
+		finishedData := &keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: fmt.Sprintf("Error parsing the event data: %v", err),
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+	setDeploymentData(keptnEvent, data.Deployment, data.ConfigurationChange)
 
-	monacoConfigFile, _ := common.GetMonacoConfig(keptnEvent)
-	dtCreds := ""
-	if monacoConfigFile != nil {
-		// implementing https://github.com/keptn-contrib/dynatrace-sli-service/issues/90
-		dtCreds = common.ReplaceKeptnPlaceholders(monacoConfigFile.DtCreds, keptnEvent)
-		fmt.Println("Found monaco.conf.yaml with DTCreds: " + dtCreds)
-	} else {
-		fmt.Println("Using default DTCreds: dynatrace as no custom monaco.conf.yaml was found!")
-		monacoConfigFile = &common.MonacoConfigFile{}
-		monacoConfigFile.DtCreds = "dynatrace"
+	monacoConfigFile, dtCreds, err := loadMonacoConfigFile(keptnEvent)
+	var tenants []common.MonacoTenant
+	if err == nil {
+		tenants, err = getMonacoTenants(monacoConfigFile, dtCreds, keptnEvent)
+	}
+	if err != nil {
+		finishedData := &keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: err.Error(),
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
 	}
+	runtimeConfig := getMonacoRuntimeConfig(monacoConfigFile, data.Monaco)
 
 	//
 	// Adding DtCreds as a label so users know which DtCreds was used
 	if data.EventData.Labels == nil {
 		data.EventData.Labels = make(map[string]string)
 	}
-	data.EventData.Labels["DtCreds"] = monacoConfigFile.DtCreds
-
-	dtCredentials, err := getDynatraceCredentials(dtCreds, data.Project)
+	tenantNames := []string{}
+	for _, tenant := range tenants {
+		tenantNames = append(tenantNames, tenant.Name)
+	}
+	data.EventData.Labels["DtCreds"] = strings.Join(tenantNames, ",")
 
+	deployer, err := common.NewDeployer(monacoConfigFile)
 	if err != nil {
-		// fmt.Println("Failed to fetch Dynatrace credentials: " + err.Error())
 		finishedData := &keptnv2.EventData{
 			Status:  keptnv2.StatusErrored,
 			Result:  keptnv2.ResultFailed,
-			Message: fmt.Sprintf("Failed to fetch Dynatrace credentials: %v", err.Error()),
+			Message: err.Error(),
 		}
 		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
 		return err
 	}
 
-	// Prepare the folder structure for monaco (create base + shkeptncontext temp folder, copy files, get monaco.zip, extract and copy to temp)
-	err = common.PrepareFiles(keptnEvent)
+	monacoFiles, err := prepareMonacoFiles(monacoConfigFile, keptnEvent)
 	if err != nil {
 		// fmt.Println(fmt.Sprintf("Error preparing monaco files: %s", err.Error()))
 		finishedData := &keptnv2.EventData{
@@ -105,86 +262,980 @@ func HandleMonacoTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevent
 		return err
 	}
 
-	// generate projects string for monaco
-	monacoProjects := common.GenerateMonacoProjectStringFromMonacoConfig(monacoConfigFile, keptnEvent)
+	// test and apply monaco configuration on every tenant
+	tenantResults, monacoErr := deployToTenants(deployer, monacoConfigFile, runtimeConfig, tenants, keptnEvent)
 
-	// test and apply monaco configuration
-	err = callMonaco(dtCredentials, keptnEvent, monacoProjects)
+	deleteMonacoTempFolder(runtimeConfig, keptnEvent)
 
-	keeptempString := os.Getenv("MONACO_KEEP_TEMP_DIR")
-	if keeptempString == "" {
-		keeptempString = "true"
+	monacoData := MonacoFinishedData{Tenants: tenantResults, Config: monacoConfigFile, Files: monacoFiles, Runtime: &runtimeConfig}
+	if len(tenantResults) == 1 {
+		monacoData.Report = tenantResults[0].Report
+		monacoData.Plan = tenantResults[0].Plan
 	}
-	keeptemp, _ := strconv.ParseBool(keeptempString)
 
-	if keeptemp {
-		fmt.Sprintf("Not deleting temp folder (MONACO_KEEP_TEMP_DIR=true) for %s", keptnEvent.Context)
-	} else {
-		// Clean up: remove temp folder for Context
-		err = common.DeleteTempFolderForKeptnContext(keptnEvent)
-		fmt.Sprintf("Delete temp folder for %s", keptnEvent.Context)
+	if monacoErr != nil {
+		finishedData := &MonacoFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: monacoErr.Error(),
+			},
+			Monaco: monacoData,
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	message := tenantResults[0].Message
+	if len(tenantResults) > 1 {
+		message = fmt.Sprintf("Successfully ran monaco on %d tenants!", len(tenantResults))
+		if runtimeConfig.DryRunOnly {
+			message = fmt.Sprintf("Successfully validated the configuration on %d tenants, nothing was applied!", len(tenantResults))
+		}
+		if runtimeConfig.Plan {
+			message = fmt.Sprintf("Successfully planned the configuration on %d tenants, nothing was applied!", len(tenantResults))
+		}
+		for _, tenantResult := range tenantResults {
+			message += fmt.Sprintf("\n%s: %s", tenantResult.Name, tenantResult.Message)
+		}
+	}
+
+	finishedData := &MonacoFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusSucceeded,
+			Result:  getMonacoTenantsResult(tenantResults),
+			Message: message,
+		},
+		Monaco: monacoData,
+	}
+	_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+
+	return err
+}
+
+/**
+ * HandleMonacoDriftTriggeredEvent handles monaco-drift.triggered events
+ * It compares the configs in Dynatrace with the monaco projects in the Keptn repo without changing anything.
+ * If configs were changed or deleted in Dynatrace the task finishes with driftResult of monaco.conf.yaml (default: fail)
+ */
+func HandleMonacoDriftTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *MonacoDriftTriggeredEventData) error {
+	log.Printf("Handling monaco-drift.triggered Event: %s", incomingEvent.Context.GetID())
+
+	data.EventData.Message = "Starting to compare Dynatrace with the Monaco Projects"
+	_, err := myKeptn.SendTaskStartedEvent(&data.EventData, ServiceName)
+	if err != nil {
+		return err
+	}
+
+	var shkeptncontext string
+	incomingEvent.Context.ExtensionAs("shkeptncontext", &shkeptncontext)
+
+	keptnEvent := &common.BaseKeptnEvent{}
+	keptnEvent.Project = data.EventData.GetProject()
+	keptnEvent.Stage = data.EventData.GetStage()
+	keptnEvent.Service = data.EventData.GetService()
+	keptnEvent.Labels = data.EventData.GetLabels()
+	keptnEvent.Context = shkeptncontext
+	keptnEvent.Task = MonacoDriftEvent
+	keptnEvent.RunID = common.NewRunID(incomingEvent.ID())
+	err = incomingEvent.DataAs(&keptnEvent.Data)
+	if err != nil {
+		finishedData := &keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: fmt.Sprintf("Error parsing the event data: %v", err),
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
 	}
 
-	finishedData := &keptnv2.EventData{
-		Status:  keptnv2.StatusSucceeded,
-		Result:  keptnv2.ResultPass,
-		Message: "Successfully ran monaco!",
+	monacoConfigFile, dtCreds, err := loadMonacoConfigFile(keptnEvent)
+	var tenants []common.MonacoTenant
+	if err == nil {
+		tenants, err = getMonacoTenants(monacoConfigFile, dtCreds, keptnEvent)
+	}
+	var driftResult keptnv2.ResultType
+	if err == nil {
+		driftResult, err = getMonacoDriftResult(monacoConfigFile)
+	}
+	var deployer common.Deployer
+	if err == nil {
+		deployer, err = common.NewDeployer(monacoConfigFile)
+	}
+	if err != nil {
+		finishedData := &keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: err.Error(),
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	monacoFiles, err := prepareMonacoFiles(monacoConfigFile, keptnEvent)
+	if err != nil {
+		finishedData := &keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: fmt.Sprintf("Error preparing monaco files: %s", err.Error()),
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	// a plan tells us which configs differ from Dynatrace
+	runtimeConfig := getMonacoRuntimeConfig(monacoConfigFile, MonacoTriggeredData{})
+	runtimeConfig.Plan = true
+	runtimeConfig.DryRun = true
+	tenantResults, planErr := deployToTenants(deployer, monacoConfigFile, runtimeConfig, tenants, keptnEvent)
+
+	deleteMonacoTempFolder(runtimeConfig, keptnEvent)
+
+	driftData := MonacoDriftFinishedData{Tenants: tenantResults, Files: monacoFiles}
+	if planErr != nil {
+		finishedData := &MonacoDriftFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: planErr.Error(),
+			},
+			MonacoDrift: driftData,
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	result, message, drifted := evaluateMonacoDrift(tenantResults, driftResult)
+	driftData.Drifted = drifted
+
+	finishedData := &MonacoDriftFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusSucceeded,
+			Result:  result,
+			Message: message,
+		},
+		MonacoDrift: driftData,
 	}
 	_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+	return err
+}
 
+/**
+ * HandleMonacoDownloadTriggeredEvent handles monaco-download.triggered events
+ * Exports the configs of a tenant into the monaco project layout and commits them to dynatrace/projects/<name>/ in the Keptn repo
+ */
+func HandleMonacoDownloadTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *MonacoDownloadTriggeredEventData) error {
+	log.Printf("Handling monaco-download.triggered Event: %s", incomingEvent.Context.GetID())
+
+	data.EventData.Message = "Starting to download configs from Dynatrace"
+	_, err := myKeptn.SendTaskStartedEvent(&data.EventData, ServiceName)
+	if err != nil {
+		return err
+	}
+
+	var shkeptncontext string
+	incomingEvent.Context.ExtensionAs("shkeptncontext", &shkeptncontext)
+
+	keptnEvent := &common.BaseKeptnEvent{}
+	keptnEvent.Project = data.EventData.GetProject()
+	keptnEvent.Stage = data.EventData.GetStage()
+	keptnEvent.Service = data.EventData.GetService()
+	keptnEvent.Labels = data.EventData.GetLabels()
+	keptnEvent.Context = shkeptncontext
+	keptnEvent.Task = MonacoDownloadEvent
+	keptnEvent.RunID = common.NewRunID(incomingEvent.ID())
+
+	downloadData := MonacoDownloadFinishedData{Project: data.MonacoDownload.Project, Level: data.MonacoDownload.Level}
+	if downloadData.Project == "" {
+		downloadData.Project = keptnEvent.Project
+	}
+
+	monacoConfigFile, dtCreds, err := loadMonacoConfigFile(keptnEvent)
+	var tenants []common.MonacoTenant
+	if err == nil {
+		tenants, err = getMonacoTenants(monacoConfigFile, dtCreds, keptnEvent)
+	}
+	var uploadEvent *common.BaseKeptnEvent
+	if err == nil {
+		uploadEvent, err = getMonacoDownloadTarget(keptnEvent, downloadData.Level)
+	}
+	var dtCredentials *common.DTCredentials
+	if err == nil {
+		downloadData.Level = getMonacoDownloadLevel(uploadEvent)
+		dtCredentials, err = getMonacoDownloadCredentials(monacoConfigFile, tenants, data.MonacoDownload.Tenant, keptnEvent)
+	}
+	if err == nil && (monacoConfigFile.ValidateToken == nil || *monacoConfigFile.ValidateToken) {
+		configTypes := data.MonacoDownload.ConfigTypes
+		if len(configTypes) == 0 {
+			configTypes = common.MonacoConfigApiOrder
+		}
+		err = common.ValidateDTCredentials(dtCredentials, common.RequiredTokenScopes(configTypes, false), nil)
+	}
+	if err != nil {
+		finishedData := &keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: err.Error(),
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	files, report, downloadErr := common.DownloadMonacoProject(dtCredentials, downloadData.Project, data.MonacoDownload.ConfigTypes, nil)
+	downloadData.Report = report
+
+	// configs that were downloaded are committed even if others failed
+	resources := map[string]string{}
+	for file, content := range files {
+		resources["dynatrace/"+file] = content
+		downloadData.Files = append(downloadData.Files, "dynatrace/"+file)
+	}
+	sort.Strings(downloadData.Files)
+
+	var uploadErr error
+	if len(resources) > 0 {
+		uploadErr = common.UploadKeptnResources(resources, uploadEvent)
+	}
+
+	if uploadErr != nil {
+		downloadErr = fmt.Errorf("Error committing configs to the Keptn repo: %v", uploadErr)
+		downloadData.Files = nil
+	} else if downloadErr != nil {
+		downloadErr = fmt.Errorf("Error downloading configs from Dynatrace: %v", downloadErr)
+	}
+	if downloadErr != nil {
+		finishedData := &MonacoDownloadFinishedEventData{
+			EventData: keptnv2.EventData{
+				Status:  keptnv2.StatusErrored,
+				Result:  keptnv2.ResultFailed,
+				Message: downloadErr.Error(),
+			},
+			MonacoDownload: downloadData,
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	finishedData := &MonacoDownloadFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusSucceeded,
+			Result:  keptnv2.ResultPass,
+			Message: fmt.Sprintf("Downloaded %d configs into dynatrace/projects/%s on %s level", len(report.Configs), downloadData.Project, downloadData.Level),
+		},
+		MonacoDownload: downloadData,
+	}
+	_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+	return err
+}
+
+/**
+ * Returns the event to upload the downloaded files with. The level defaults to the most specific level of the event,
+ * e.g: stage level for an event without service
+ */
+func getMonacoDownloadTarget(keptnEvent *common.BaseKeptnEvent, level string) (*common.BaseKeptnEvent, error) {
+	uploadEvent := *keptnEvent
+
+	switch level {
+	case "":
+	case common.KeptnResourceLevelService:
+		if uploadEvent.Service == "" {
+			return nil, errors.New("Level service requires a service in the event")
+		}
+	case common.KeptnResourceLevelStage:
+		uploadEvent.Service = ""
+	case common.KeptnResourceLevelProject:
+		uploadEvent.Service = ""
+		uploadEvent.Stage = ""
+	default:
+		return nil, fmt.Errorf("Level %s is not supported, use service, stage or project", level)
+	}
+
+	if uploadEvent.Service != "" && uploadEvent.Stage == "" {
+		return nil, errors.New("Level service requires a stage in the event")
+	}
+	return &uploadEvent, nil
+}
+
+// returns the Keptn level the event uploads to
+func getMonacoDownloadLevel(uploadEvent *common.BaseKeptnEvent) string {
+	if uploadEvent.Service != "" {
+		return common.KeptnResourceLevelService
+	}
+	if uploadEvent.Stage != "" {
+		return common.KeptnResourceLevelStage
+	}
+	return common.KeptnResourceLevelProject
+}
+
+// returns the credentials of the tenant with that name, the first tenant if no name is given
+func getMonacoDownloadCredentials(monacoConfigFile *common.MonacoConfigFile, tenants []common.MonacoTenant, tenantName string, keptnEvent *common.BaseKeptnEvent) (*common.DTCredentials, error) {
+	for _, tenant := range tenants {
+		if tenantName != "" && tenant.Name != tenantName {
+			continue
+		}
+		dtCredentials, err := getTenantCredentials(monacoConfigFile, tenant, keptnEvent)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load Dynatrace credentials for tenant %s: %v", tenant.Name, err)
+		}
+		return dtCredentials, nil
+	}
+	return nil, fmt.Errorf("Tenant %s is not defined in monaco.conf.yaml", tenantName)
+}
+
+/**
+ * HandleRollbackTriggeredEvent handles rollback.triggered events
+ * If a monaco run of the same keptn context stored snapshots the configs of every tenant are restored to the state before that run.
+ * Without snapshots the event is ignored as the rollback is meant for another service
+ */
+func HandleRollbackTriggeredEvent(myKeptn *keptnv2.Keptn, incomingEvent cloudevents.Event, data *keptnv2.RollbackTriggeredEventData) error {
+	var shkeptncontext string
+	incomingEvent.Context.ExtensionAs("shkeptncontext", &shkeptncontext)
+
+	keptnEvent := &common.BaseKeptnEvent{}
+	keptnEvent.Project = data.EventData.GetProject()
+	keptnEvent.Stage = data.EventData.GetStage()
+	keptnEvent.Service = data.EventData.GetService()
+	keptnEvent.Labels = data.EventData.GetLabels()
+	keptnEvent.Context = shkeptncontext
+	keptnEvent.Task = keptnv2.RollbackTaskName
+	keptnEvent.RunID = common.NewRunID(incomingEvent.ID())
+
+	monacoConfigFile, dtCreds, err := loadMonacoConfigFile(keptnEvent)
+	var tenants []common.MonacoTenant
+	if err == nil {
+		tenants, err = getMonacoTenants(monacoConfigFile, dtCreds, keptnEvent)
+	}
+	if err != nil {
+		log.Printf("Not able to load the tenants for %s, ignoring rollback: %v\n", keptnEvent.Context, err)
+		return nil
+	}
+
+	snapshots := map[string]*common.MonacoSnapshot{}
+	for _, tenant := range tenants {
+		snapshot, err := common.GetMonacoSnapshot(keptnEvent, tenant.Name)
+		if err != nil {
+			log.Printf("Ignoring snapshot of %s: %v\n", tenant.Name, err)
+			continue
+		}
+		if snapshot != nil {
+			snapshots[tenant.Name] = snapshot
+		}
+	}
+	if len(snapshots) == 0 {
+		log.Printf("No monaco snapshot found for %s, ignoring rollback\n", keptnEvent.Context)
+		return nil
+	}
+
+	data.EventData.Message = "Starting to restore the Dynatrace configuration"
+	_, err = myKeptn.SendTaskStartedEvent(&keptnv2.RollbackStartedEventData{EventData: data.EventData}, ServiceName)
+	if err != nil {
+		return err
+	}
+
+	deployer, err := common.NewDeployer(monacoConfigFile)
+	if err != nil {
+		finishedData := &keptnv2.EventData{
+			Status:  keptnv2.StatusErrored,
+			Result:  keptnv2.ResultFailed,
+			Message: err.Error(),
+		}
+		_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+		return err
+	}
+
+	results := []*MonacoTenantResult{}
+	failures := []string{}
+	for _, tenant := range tenants {
+		snapshot, ok := snapshots[tenant.Name]
+		if !ok {
+			continue
+		}
+		result := &MonacoTenantResult{Name: tenant.Name, Tenant: snapshot.Tenant}
+		results = append(results, result)
+
+		dtCredentials, err := getTenantCredentials(monacoConfigFile, tenant, keptnEvent)
+		if err == nil {
+			err = runInMonacoRunQueue(tenant.Name, dtCredentials, keptnEvent, keptnEvent.Task+"|"+keptnEvent.Service, func() error {
+				var restoreErr error
+				result.Report, restoreErr = deployer.Restore(dtCredentials, snapshot)
+				return restoreErr
+			})
+		}
+		if err == common.ErrRunSuperseded {
+			result.Result = keptnv2.ResultWarning
+			result.Message = err.Error()
+			continue
+		}
+		if err != nil {
+			result.Result = keptnv2.ResultFailed
+			result.Message = fmt.Sprintf("Rollback failed: %v", err)
+			failures = append(failures, tenant.Name+": "+result.Message)
+			continue
+		}
+
+		result.Result = keptnv2.ResultPass
+		result.RolledBack = true
+		result.Message = fmt.Sprintf("Rolled back to the configuration before the run: %d configs restored, %d deleted",
+			result.Report.CountByAction(common.MonacoActionUpdated), result.Report.CountByAction(common.MonacoActionDeleted))
+	}
+
+	finishedData := &MonacoRollbackFinishedEventData{
+		EventData: keptnv2.EventData{
+			Status:  keptnv2.StatusSucceeded,
+			Result:  getMonacoTenantsResult(results),
+			Message: fmt.Sprintf("Successfully rolled back %d tenants", len(results)),
+		},
+		Monaco: MonacoFinishedData{Tenants: results},
+	}
+	if len(results) == 1 {
+		finishedData.Monaco.Report = results[0].Report
+		finishedData.Message = results[0].Message
+	}
+	if len(failures) > 0 {
+		finishedData.Status = keptnv2.StatusErrored
+		finishedData.Result = keptnv2.ResultFailed
+		finishedData.Message = fmt.Sprintf("Rollback failed for %d of %d tenants:\n%s", len(failures), len(results), strings.Join(failures, "\n"))
+	}
+	_, err = myKeptn.SendTaskFinishedEvent(finishedData, ServiceName)
+	return err
+}
+
+// returns the result of a monaco-drift task that detected drift as configured in monaco.conf.yaml
+func getMonacoDriftResult(monacoConfigFile *common.MonacoConfigFile) (keptnv2.ResultType, error) {
+	switch monacoConfigFile.DriftResult {
+	case "", string(keptnv2.ResultFailed):
+		return keptnv2.ResultFailed, nil
+	case string(keptnv2.ResultWarning):
+		return keptnv2.ResultWarning, nil
+	case string(keptnv2.ResultPass):
+		return keptnv2.ResultPass, nil
+	}
+	return "", fmt.Errorf("Invalid driftResult '%s' in %s, use pass, warning or fail", monacoConfigFile.DriftResult, common.MonacoConfigFilename)
+}
+
+/**
+ * Counts the drifted configs of all tenants, i.e: configs that were changed in Dynatrace (changed) or deleted in Dynatrace (added)
+ * Returns pass if nothing drifted, otherwise driftResult and a message listing the drifted configs
+ */
+func evaluateMonacoDrift(tenantResults []*MonacoTenantResult, driftResult keptnv2.ResultType) (keptnv2.ResultType, string, int) {
+	drifted := []string{}
+	for _, tenantResult := range tenantResults {
+		if tenantResult.Plan == nil {
+			continue
+		}
+		for _, config := range tenantResult.Plan.Configs {
+			switch config.Action {
+			case common.MonacoDiffActionChanged:
+				drifted = append(drifted, fmt.Sprintf("%s: %s/%s/%s changed in %d fields", tenantResult.Name, config.Project, config.ConfigType, config.ConfigName, len(config.Changes)))
+			case common.MonacoDiffActionAdded:
+				drifted = append(drifted, fmt.Sprintf("%s: %s/%s/%s is missing", tenantResult.Name, config.Project, config.ConfigType, config.ConfigName))
+			}
+		}
+	}
+
+	if len(drifted) == 0 {
+		return keptnv2.ResultPass, "No drift detected, Dynatrace matches the monaco projects", 0
+	}
+	return driftResult, fmt.Sprintf("Drift detected in %d configs:\n%s", len(drifted), strings.Join(drifted, "\n")), len(drifted)
+}
+
+/**
+ * Loads monaco.conf.yaml for the event and returns it together with the resolved dtCreds secret name.
+ * If no monaco.conf.yaml exists we default to the secret dynatrace
+ */
+func loadMonacoConfigFile(keptnEvent *common.BaseKeptnEvent) (*common.MonacoConfigFile, string, error) {
+	monacoConfigFile, _ := common.GetMonacoConfig(keptnEvent)
+	dtCreds := ""
+	if monacoConfigFile != nil {
+		// implementing https://github.com/keptn-contrib/dynatrace-sli-service/issues/90
+		var err error
+		dtCreds, err = common.RenderKeptnPlaceholders(monacoConfigFile.DtCreds, keptnEvent, common.PlaceholderEscapeNone)
+		if err != nil {
+			return monacoConfigFile, "", fmt.Errorf("Error resolving dtCreds of %s: %v", common.MonacoConfigFilename, err)
+		}
+		log.Println("Found monaco.conf.yaml with DTCreds: " + common.MaskSecrets(dtCreds))
+	} else {
+		log.Println("Using default DTCreds: dynatrace as no custom monaco.conf.yaml was found!")
+		monacoConfigFile = &common.MonacoConfigFile{}
+		monacoConfigFile.DtCreds = "dynatrace"
+	}
+
+	return monacoConfigFile, dtCreds, nil
+}
+
+/**
+ * Returns the runtime configuration for the event. The env variables of the service are overridden by
+ * dryRun and verbose of monaco.conf.yaml which are overridden by the monaco block of the monaco.triggered event
+ */
+func getMonacoRuntimeConfig(monacoConfigFile *common.MonacoConfigFile, overrides MonacoTriggeredData) MonacoRuntimeConfig {
+	runtimeConfig := monacoRuntimeConfig
+
+	if monacoConfigFile.Verbose != nil {
+		runtimeConfig.Verbose = *monacoConfigFile.Verbose
+	}
+	if monacoConfigFile.DryRun != nil {
+		runtimeConfig.DryRun = *monacoConfigFile.DryRun
+	}
+
+	if overrides.Verbose != nil {
+		runtimeConfig.Verbose = *overrides.Verbose
+	}
+	if overrides.DryRun != nil {
+		runtimeConfig.DryRun = *overrides.DryRun
+	}
+	if overrides.DryRunOnly != nil {
+		runtimeConfig.DryRunOnly = *overrides.DryRunOnly
+	}
+	if overrides.Plan != nil {
+		runtimeConfig.Plan = *overrides.Plan
+	}
+	if overrides.KeepTempDir != nil {
+		runtimeConfig.KeepTempDir = *overrides.KeepTempDir
+	}
+
+	// a validation only run is always a dry run
+	if runtimeConfig.DryRunOnly {
+		runtimeConfig.DryRun = true
+	}
+
+	return runtimeConfig
+}
+
+/**
+ * Fills the keptn event with the output of the preceding deployment task and the image of the configuration change.
+ * Deployment is the first deployment name, e.g: direct or canary, the tag is taken from the image, e.g: docker.io/keptnexamples/carts:0.12.1
+ */
+func setDeploymentData(keptnEvent *common.BaseKeptnEvent, deployment *keptnv2.DeploymentFinishedData, configurationChange *keptnv2.ConfigurationChange) {
+	if deployment != nil {
+		keptnEvent.DeploymentStrategy = deployment.DeploymentStrategy
+		keptnEvent.DeploymentURIsLocal = deployment.DeploymentURIsLocal
+		keptnEvent.DeploymentURIsPublic = deployment.DeploymentURIsPublic
+		keptnEvent.DeploymentNames = deployment.DeploymentNames
+		if len(deployment.DeploymentNames) > 0 {
+			keptnEvent.Deployment = deployment.DeploymentNames[0]
+		}
+	}
+
+	if configurationChange != nil {
+		if image, ok := configurationChange.Values["image"].(string); ok {
+			keptnEvent.Image = image
+			if index := strings.LastIndex(image, ":"); index > strings.LastIndex(image, "/") {
+				keptnEvent.Tag = image[index+1:]
+			}
+		}
+	}
+}
+
+// pre-renders the downloaded monaco projects with the Keptn event if enabled in monaco.conf.yaml
+func preRenderMonacoProjects(monacoConfigFile *common.MonacoConfigFile, keptnEvent *common.BaseKeptnEvent) error {
+	if monacoConfigFile.PreRender == nil || !monacoConfigFile.PreRender.Enabled {
+		return nil
+	}
+
+	rendered, err := common.PreRenderMonacoProjects(keptnEvent, monacoConfigFile.PreRender)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pre-rendered %d monaco files: %v\n", len(rendered), rendered)
 	return nil
 }
 
-func getDynatraceCredentials(secretName string, project string) (*common.DTCredentials, error) {
+/**
+ * Returns the tenants to deploy to. Without tenants in monaco.conf.yaml this is the single tenant referenced by dtCreds
+ */
+func getMonacoTenants(monacoConfigFile *common.MonacoConfigFile, dtCreds string, keptnEvent *common.BaseKeptnEvent) ([]common.MonacoTenant, error) {
+	if len(monacoConfigFile.Tenants) == 0 {
+		return []common.MonacoTenant{{Name: dtCreds, Projects: monacoConfigFile.Projects}}, nil
+	}
+
+	tenants := []common.MonacoTenant{}
+	for _, tenant := range monacoConfigFile.Tenants {
+		projects := tenant.Projects
+		if len(projects) == 0 {
+			projects = monacoConfigFile.Projects
+		}
+		name, err := common.RenderKeptnPlaceholders(tenant.Name, keptnEvent, common.PlaceholderEscapeNone)
+		if err != nil {
+			return nil, fmt.Errorf("Error resolving tenant %s of %s: %v", tenant.Name, common.MonacoConfigFilename, err)
+		}
+		tenants = append(tenants, common.MonacoTenant{Name: name, Projects: projects})
+	}
+	return tenants, nil
+}
 
-	secretNames := []string{secretName, fmt.Sprintf("dynatrace-credentials-%s", project), "dynatrace-credentials", "dynatrace"}
+/**
+ * Deploys the prepared monaco projects to every tenant one after the other.
+ * Unless continueOnFailure is set in monaco.conf.yaml the remaining tenants are skipped after the first failure.
+ * Runs of other events for the same tenant, project and stage wait for each other in monacoRunQueue
+ */
+func deployToTenants(deployer common.Deployer, monacoConfigFile *common.MonacoConfigFile, runtimeConfig MonacoRuntimeConfig, tenants []common.MonacoTenant, keptnEvent *common.BaseKeptnEvent) ([]*MonacoTenantResult, error) {
+	results := []*MonacoTenantResult{}
+	failures := []string{}
+	var lastErr error
+
+	for _, tenant := range tenants {
+		result := &MonacoTenantResult{Name: tenant.Name}
+		results = append(results, result)
 
-	for _, secret := range secretNames {
-		if secret == "" {
+		if lastErr != nil && !monacoConfigFile.ContinueOnFailure {
+			result.Message = "Skipped as a previous tenant failed"
 			continue
 		}
 
-		dtCredentials, err := common.GetDTCredentials(secret)
+		dtCredentials, err := getTenantCredentials(monacoConfigFile, tenant, keptnEvent)
+		if err != nil {
+			lastErr = fmt.Errorf("Failed to fetch Dynatrace credentials: %v", err.Error())
+			result.Result = keptnv2.ResultFailed
+			result.Message = lastErr.Error()
+			failures = append(failures, tenant.Name+": "+result.Message)
+			continue
+		}
+		result.Tenant = dtCredentials.Tenant
 
-		/* if err != nil {
-			fmt.Println("Error retrieving secret '%s': %v", secret, err)
-		}*/
+		err = runInMonacoRunQueue(tenant.Name, dtCredentials, keptnEvent, getMonacoRunKind(runtimeConfig, keptnEvent), func() error {
+			return deployToTenant(deployer, monacoConfigFile, runtimeConfig, tenant, dtCredentials, keptnEvent, result)
+		})
+		if err == common.ErrRunSuperseded {
+			result.Result = keptnv2.ResultWarning
+			result.Message = err.Error()
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			failures = append(failures, tenant.Name+": "+result.Message)
+		}
+	}
+
+	if len(tenants) == 1 || lastErr == nil {
+		return results, lastErr
+	}
+	return results, fmt.Errorf("Monaco failed for %d of %d tenants:\n%s", len(failures), len(tenants), strings.Join(failures, "\n"))
+}
+
+/**
+ * Calls run while holding the key of the tenant, project and stage in monacoRunQueue, so that runs of other events don't write
+ * to the same tenant at the same time. Returns common.ErrRunSuperseded without calling run if a newer run of the same kind replaced this one
+ */
+func runInMonacoRunQueue(tenantName string, dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, kind string, run func() error) error {
+	waitStart := time.Now()
+	release, err := monacoRunQueue.Acquire(common.RunQueueKey(dtCredentials.Tenant, keptnEvent.Project, keptnEvent.Stage), kind)
+	if waited := time.Since(waitStart); waited > time.Second {
+		log.Printf("Waited %v for other monaco runs on %s\n", waited.Round(time.Second), tenantName)
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return run()
+}
+
+/**
+ * Runs monaco on a single tenant and fills the result. A failed run sets the result to failed and returns the error.
+ * The caller holds the key of the tenant in monacoRunQueue, which also covers the rollback after a failed apply
+ */
+func deployToTenant(deployer common.Deployer, monacoConfigFile *common.MonacoConfigFile, runtimeConfig MonacoRuntimeConfig, tenant common.MonacoTenant, dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, result *MonacoTenantResult) error {
+	failed := func(err error) error {
+		result.Result = keptnv2.ResultFailed
+		result.Message = err.Error()
+		return err
+	}
+
+	// generate projects string for monaco
+	monacoProjects := common.GenerateMonacoProjectStringFromMonacoConfig(&common.MonacoConfigFile{Projects: tenant.Projects}, keptnEvent)
+
+	// fail before monaco runs if the tenant is not reachable or the token misses scopes, read only runs only need the read scopes
+	if monacoConfigFile.ValidateToken == nil || *monacoConfigFile.ValidateToken {
+		err := deployer.Validate(dtCredentials, keptnEvent, monacoProjects, !runtimeConfig.Plan && !runtimeConfig.DryRunOnly)
+		if err != nil {
+			return failed(fmt.Errorf("Failed to validate Dynatrace credentials: %v", err))
+		}
+	}
+
+	if runtimeConfig.Plan {
+		// configs removed from the monaco projects are only deleted with autoPrune
+		var removed []*common.MonacoDeleteEntry
+		if monacoConfigFile.AutoPrune != nil && *monacoConfigFile.AutoPrune {
+			var err error
+			_, _, removed, err = getMonacoOrphans(monacoConfigFile, dtCredentials, keptnEvent, tenant.Name, monacoProjects)
+			if err != nil {
+				return failed(fmt.Errorf("Failed to plan the removed configs: %v", err))
+			}
+		}
+
+		plan, err := deployer.Plan(dtCredentials, keptnEvent, monacoProjects, removed)
+		result.Plan = plan
+		if err != nil {
+			return failed(fmt.Errorf("Failed to plan the monaco configuration: %v", err))
+		}
+
+		result.Result = keptnv2.ResultPass
+		result.Message = fmt.Sprintf("Monaco plan: %d configs to add, %d to change, %d to remove, %d unchanged. Nothing was applied",
+			plan.CountByAction(common.MonacoDiffActionAdded), plan.CountByAction(common.MonacoDiffActionChanged),
+			plan.CountByAction(common.MonacoDiffActionRemoved), plan.CountByAction(common.MonacoDiffActionUnchanged))
+		return nil
+	}
+
+	// snapshot the configs before applying them so that we can restore them if applying fails
+	var snapshot *common.MonacoSnapshot
+	if !runtimeConfig.DryRunOnly && (monacoConfigFile.RollbackOnFailure == nil || *monacoConfigFile.RollbackOnFailure) {
+		snapshot = takeMonacoSnapshot(deployer, monacoConfigFile, dtCredentials, keptnEvent, tenant.Name, monacoProjects)
+	}
+
+	report, err := callMonaco(deployer, runtimeConfig, dtCredentials, keptnEvent, monacoProjects)
+	result.Report = report
+	if err != nil {
+		if runErr, ok := err.(*monacoRunError); ok && !runErr.DryRun && snapshot != nil {
+			err = fmt.Errorf("%v\n%s", err, restoreMonacoSnapshot(deployer, dtCredentials, snapshot, result))
+		}
+		return failed(err)
+	}
+
+	result.Result = keptnv2.ResultPass
+	if runtimeConfig.DryRunOnly {
+		result.Message = fmt.Sprintf("Successfully validated the configuration with a monaco dry run, nothing was applied! %d configs validated", len(report.Configs))
+		return nil
+	}
+	result.Message = fmt.Sprintf("Successfully ran monaco! %d configs created, %d updated, %d skipped",
+		report.CountByAction(common.MonacoActionCreated), report.CountByAction(common.MonacoActionUpdated), report.CountByAction(common.MonacoActionSkipped))
+
+	pruneMessage, err := pruneMonacoConfigs(deployer, monacoConfigFile, dtCredentials, keptnEvent, tenant.Name, monacoProjects, report)
+	if err != nil {
+		return failed(fmt.Errorf("Monaco succeeded but deleting removed configs failed: %v", err))
+	}
+	if pruneMessage != "" {
+		result.Message += ". " + pruneMessage
+	}
+	return nil
+}
+
+/**
+ * Returns the Dynatrace credentials of a tenant
+ * The default secret names are only searched if no tenants are configured explicitly, the secret of an explicit tenant
+ * is searched in the credentialNamespaces like dtCreds
+ */
+func getTenantCredentials(monacoConfigFile *common.MonacoConfigFile, tenant common.MonacoTenant, keptnEvent *common.BaseKeptnEvent) (*common.DTCredentials, error) {
+	if len(monacoConfigFile.Tenants) == 0 {
+		return getDynatraceCredentials(monacoConfigFile, tenant.Name, keptnEvent)
+	}
+
+	if tenant.Name == "" {
+		return nil, errors.New("no secret name given")
+	}
+	return common.FindDTCredentials([]string{tenant.Name}, common.GetCredentialNamespaces(monacoConfigFile), keptnEvent)
+}
+
+// tenants that were skipped for a newer run of the same stage finish with a warning, otherwise a successful run passes
+func getMonacoTenantsResult(tenantResults []*MonacoTenantResult) keptnv2.ResultType {
+	for _, tenantResult := range tenantResults {
+		if tenantResult.Result == keptnv2.ResultWarning {
+			return keptnv2.ResultWarning
+		}
+	}
+	return keptnv2.ResultPass
+}
+
+/**
+ * Returns the kind of the run in monacoRunQueue, e.g: monaco|carts or monaco-plan|carts. Only runs of the same task, mode and service
+ * replace each other, so a plan, a drift check or another service never skips a waiting apply
+ */
+func getMonacoRunKind(runtimeConfig MonacoRuntimeConfig, keptnEvent *common.BaseKeptnEvent) string {
+	task := keptnEvent.Task
+	if runtimeConfig.Plan {
+		task += "-plan"
+	} else if runtimeConfig.DryRunOnly {
+		task += "-dry-run"
+	}
+	return task + "|" + keptnEvent.Service
+}
+
+/**
+ * Prepares the folder structure for monaco (create base + shkeptncontext temp folder, copy files, get monaco.zip, extract and copy to temp),
+ * pre-renders the projects and writes the environments file. Returns the downloaded files and the level they were taken from
+ */
+func prepareMonacoFiles(monacoConfigFile *common.MonacoConfigFile, keptnEvent *common.BaseKeptnEvent) (map[string]string, error) {
+	monacoFiles, err := common.PrepareFiles(keptnEvent)
+	if err == nil {
+		err = preRenderMonacoProjects(monacoConfigFile, keptnEvent)
+	}
+	if err == nil {
+		err = common.PrepareMonacoEnvironmentsFile(keptnEvent, monacoConfigFile)
+	}
+	return monacoFiles, err
+}
+
+// removes the temp folder of the keptn context unless keepTempDir is set
+func deleteMonacoTempFolder(runtimeConfig MonacoRuntimeConfig, keptnEvent *common.BaseKeptnEvent) {
+	if runtimeConfig.KeepTempDir {
+		log.Printf("Not deleting temp folder (keepTempDir=true) for %s\n", keptnEvent.Context)
+		return
+	}
 
-		if err == nil && dtCredentials != nil {
-			// lets validate if the tenant URL is
-			fmt.Printf("Secret '%s' with credentials found, returning (%s) ...", secret, dtCredentials.Tenant)
-			return dtCredentials, nil
+	err := common.DeleteTempFolderForKeptnContext(keptnEvent)
+	if err != nil {
+		log.Printf("Error deleting temp folder for %s: %v\n", keptnEvent.Context, err)
+	} else {
+		log.Printf("Delete temp folder for %s\n", keptnEvent.Context)
+	}
+}
+
+/**
+ * Tracks the configs deployed to the tenant and deletes configs that a previous run deployed but that were removed from the monaco projects.
+ * Configs are only deleted with autoPrune: true in monaco.conf.yaml, otherwise they stay tracked until they are pruned.
+ * Returns a message about the removed configs
+ */
+func pruneMonacoConfigs(deployer common.Deployer, monacoConfigFile *common.MonacoConfigFile, dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, tenantName string, projects string, report *common.MonacoDeploymentReport) (string, error) {
+	state, previous, orphans, err := getMonacoOrphans(monacoConfigFile, dtCredentials, keptnEvent, tenantName, projects)
+	if err != nil {
+		message := fmt.Sprintf("Configs removed from the monaco projects are not tracked: %v", err)
+		log.Println(message)
+		if monacoConfigFile.AutoPrune != nil && *monacoConfigFile.AutoPrune {
+			return message, nil
 		}
+		return "", nil
+	}
+
+	message := ""
+	var pruneErr error
+	if len(orphans) > 0 && monacoConfigFile.AutoPrune != nil && *monacoConfigFile.AutoPrune {
+		deleteReport, err := deployer.Delete(dtCredentials, orphans, false)
+		report.Configs = append(report.Configs, deleteReport.Configs...)
+		pruneErr = err
+
+		// configs that could not be deleted stay tracked so the next run retries
+		for i, result := range deleteReport.Configs {
+			if result.Action == common.MonacoActionFailed {
+				state.Configs = append(state.Configs, orphans[i])
+			}
+		}
+		message = fmt.Sprintf("%d removed configs deleted", deleteReport.CountByAction(common.MonacoActionDeleted))
+	} else if len(orphans) > 0 {
+		state.Configs = append(state.Configs, orphans...)
+		message = fmt.Sprintf("%d configs were removed from the monaco projects but not deleted, set autoPrune: true in %s to delete them", len(orphans), common.MonacoConfigFilename)
+		log.Println(message)
+	}
+
+	// the configs of other services and projects stay tracked
+	if previous != nil {
+		state = state.Merge(previous, keptnEvent.Service, projects)
+	}
+	if previous == nil || !reflect.DeepEqual(previous, state) {
+		err = common.UploadMonacoState(state, keptnEvent, tenantName)
+		if err != nil {
+			log.Printf("Error storing the configs deployed to %s: %v\n", tenantName, err)
+		}
+	}
+	return message, pruneErr
+}
+
+/**
+ * Returns the configs the monaco projects deploy, the configs previous runs deployed to the tenant and the configs a previous run of the service
+ * deployed that were removed from the monaco projects. Returns an error if the deployed configs can't be tracked, e.g: for monaco v2 projects
+ * or an invalid state
+ */
+func getMonacoOrphans(monacoConfigFile *common.MonacoConfigFile, dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, tenantName string, projects string) (*common.MonacoState, *common.MonacoState, []*common.MonacoDeleteEntry, error) {
+	state, err := common.GetMonacoProjectsState(dtCredentials, keptnEvent, projects, monacoConfigFile.Env)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	return nil, errors.New("Could not find any Dynatrace specific secrets with the following names: " + strings.Join(secretNames, ","))
+	previous, err := common.GetMonacoState(keptnEvent, tenantName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// the configs of a state of another tenant are not on this tenant
+	if previous != nil && strings.TrimSuffix(previous.Tenant, "/") != strings.TrimSuffix(state.Tenant, "/") {
+		previous = nil
+	}
+
+	orphans := []*common.MonacoDeleteEntry{}
+	if previous != nil {
+		orphans = state.Orphans(previous, keptnEvent.Service, projects)
+	}
+	return state, previous, orphans, nil
 }
 
-func callMonaco(dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, projects string) error {
+/**
+ * Takes a snapshot of the configs of the tenant and stores it as Keptn resource
+ * Returns nil if no snapshot could be taken, e.g: for monaco v2 projects. The run continues without rollback then
+ */
+func takeMonacoSnapshot(deployer common.Deployer, monacoConfigFile *common.MonacoConfigFile, dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, tenantName string, projects string) *common.MonacoSnapshot {
+	snapshot, err := deployer.Snapshot(dtCredentials, keptnEvent, projects)
+	if err != nil {
+		log.Printf("Not able to take a snapshot of %s, rollback is not possible: %v\n", tenantName, err)
+		return nil
+	}
 
-	// Get Env-Variables on whether we should first do a dry run and whether we should do verbose
-	verboseString := os.Getenv("MONACO_VERBOSE_MODE")
-	if verboseString == "" {
-		verboseString = "true"
+	retention := common.DefaultMonacoSnapshotRetention
+	if monacoConfigFile.SnapshotRetention != nil {
+		retention = *monacoConfigFile.SnapshotRetention
 	}
-	dryrunString := os.Getenv("MONACO_DRYRUN")
-	if dryrunString == "" {
-		dryrunString = "true"
+	err = common.UploadMonacoSnapshot(snapshot, keptnEvent, tenantName, retention)
+	if err != nil {
+		log.Printf("Error storing snapshot of %s, rollback is only possible within this run: %v\n", tenantName, err)
 	}
+	return snapshot
+}
 
-	verbose, _ := strconv.ParseBool(verboseString)
-	dryrun, _ := strconv.ParseBool(dryrunString)
+// restores the snapshot after a failed apply and returns a message describing the outcome, the caller holds the key of the tenant in monacoRunQueue
+func restoreMonacoSnapshot(deployer common.Deployer, dtCredentials *common.DTCredentials, snapshot *common.MonacoSnapshot, result *MonacoTenantResult) string {
+	report, err := deployer.Restore(dtCredentials, snapshot)
+	if err != nil {
+		return fmt.Sprintf("Rollback to the configuration before the run failed: %v", err)
+	}
+	result.RolledBack = true
+	return fmt.Sprintf("Rolled back to the configuration before the run: %d configs restored, %d deleted",
+		report.CountByAction(common.MonacoActionUpdated), report.CountByAction(common.MonacoActionDeleted))
+}
 
-	if dryrun {
+/**
+ * Searches the Dynatrace credentials in the secrets of the search order of monaco.conf.yaml, the error lists why every secret couldn't be used
+ */
+func getDynatraceCredentials(monacoConfigFile *common.MonacoConfigFile, secretName string, keptnEvent *common.BaseKeptnEvent) (*common.DTCredentials, error) {
+	candidates := common.GetCredentialSearchOrder(monacoConfigFile, secretName)
+	return common.FindDTCredentials(candidates, common.GetCredentialNamespaces(monacoConfigFile), keptnEvent)
+}
+
+/**
+ * monacoRunError is returned by callMonaco and tells whether monaco failed in the dry run or while applying the configuration
+ */
+type monacoRunError struct {
+	DryRun bool
+	Output string
+	Err    error
+}
+
+func (e *monacoRunError) Error() string {
+	summary := common.SummarizeMonacoOutput(e.Output, maxMonacoOutputLines)
+	if e.DryRun {
+		return fmt.Sprintf("Monaco dry run rejected the configuration, nothing was applied: %v\n%s", e.Err, summary)
+	}
+	return fmt.Sprintf("Monaco failed while applying the configuration, the configuration might be partially applied: %v\n%s", e.Err, summary)
+}
+
+/**
+ * Runs the optional monaco dry run and then applies the configuration unless this is a dry run only.
+ * Returns the report of the last monaco execution, e.g: of the dry run if the dry run failed
+ */
+func callMonaco(deployer common.Deployer, runtimeConfig MonacoRuntimeConfig, dtCredentials *common.DTCredentials, keptnEvent *common.BaseKeptnEvent, projects string) (*common.MonacoDeploymentReport, error) {
+
+	if runtimeConfig.DryRun {
 		// Dry Run to test configuration structure
-		err := common.ExecuteMonaco(dtCredentials, keptnEvent, projects, verbose, true)
+		report, output, err := deployer.Deploy(dtCredentials, keptnEvent, projects, runtimeConfig.Verbose, true)
 		if err != nil {
-			return err
+			return report, &monacoRunError{DryRun: true, Output: output, Err: err}
+		}
+		if runtimeConfig.DryRunOnly {
+			return report, nil
 		}
 	}
 
 	// Apply configuration
-	err := common.ExecuteMonaco(dtCredentials, keptnEvent, projects, verbose, false)
+	report, output, err := deployer.Deploy(dtCredentials, keptnEvent, projects, runtimeConfig.Verbose, false)
+	if err != nil {
+		return report, &monacoRunError{DryRun: false, Output: output, Err: err}
+	}
 
-	return err
+	return report, nil
 }
@@ -3,14 +3,19 @@ package main
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2" // make sure to use v2 cloudevents here
 	"github.com/kelseyhightower/envconfig"
 	keptn "github.com/keptn/go-utils/pkg/lib/keptn"
 	keptnv2 "github.com/keptn/go-utils/pkg/lib/v0_2_0"
+
+	"github.com/keptn-sandbox/monaco-service/pkg/common"
 )
 
 var keptnOptions = keptn.KeptnOpts{}
@@ -24,15 +29,181 @@ type envConfig struct {
 	Env string `envconfig:"ENV" default:"local"`
 	// URL of the Keptn configuration service (this is where we can fetch files from the config repo)
 	ConfigurationServiceUrl string `envconfig:"CONFIGURATION_SERVICE" default:""`
+	// Whether monaco is executed in verbose mode
+	MonacoVerbose bool `envconfig:"MONACO_VERBOSE_MODE" default:"true"`
+	// Whether monaco validates the configuration with a dry run before applying it
+	MonacoDryRun bool `envconfig:"MONACO_DRYRUN" default:"true"`
+	// Whether the temp folder of a Keptn context is kept after the monaco run
+	MonacoKeepTempDir bool `envconfig:"MONACO_KEEP_TEMP_DIR" default:"true"`
+	// How many monaco runs are executed at once over all tenants, 0 means unlimited
+	MonacoMaxConcurrentRuns int `envconfig:"MONACO_MAX_CONCURRENT_RUNS" default:"0"`
+	// Whether runs for the same tenant, project and stage are all executed one after the other (queue) or only the latest waiting run (latest)
+	MonacoQueuePolicy string `envconfig:"MONACO_QUEUE_POLICY" default:"queue"`
+	// Port of the metrics endpoint /debug/vars with the queue depth, 0 disables it
+	MetricsPort int `envconfig:"METRICS_PORT" default:"0"`
+}
+
+// validates the settings that envconfig can't validate by their type
+func (env envConfig) validate() error {
+	if env.Port <= 0 || env.Port > 65535 {
+		return fmt.Errorf("RCV_PORT must be between 1 and 65535 but is %d", env.Port)
+	}
+	if !strings.HasPrefix(env.Path, "/") {
+		return fmt.Errorf("RCV_PATH must start with / but is %s", env.Path)
+	}
+	if env.MonacoMaxConcurrentRuns < 0 {
+		return fmt.Errorf("MONACO_MAX_CONCURRENT_RUNS must not be negative but is %d", env.MonacoMaxConcurrentRuns)
+	}
+	if env.MonacoQueuePolicy != common.RunQueuePolicyQueue && env.MonacoQueuePolicy != common.RunQueuePolicyLatest {
+		return fmt.Errorf("MONACO_QUEUE_POLICY must be %s or %s but is %s", common.RunQueuePolicyQueue, common.RunQueuePolicyLatest, env.MonacoQueuePolicy)
+	}
+	if env.MetricsPort < 0 || env.MetricsPort > 65535 || (env.MetricsPort != 0 && env.MetricsPort == env.Port) {
+		return fmt.Errorf("METRICS_PORT must be between 1 and 65535 and differ from RCV_PORT but is %d", env.MetricsPort)
+	}
+	return nil
 }
 
+// MonacoRuntimeConfig controls how monaco is executed
+type MonacoRuntimeConfig struct {
+	Verbose bool `json:"verbose"`
+	DryRun  bool `json:"dryRun"`
+	// DryRunOnly only validates the configuration with a dry run and doesn't apply it
+	DryRunOnly bool `json:"dryRunOnly"`
+	// Plan only compares the configs with Dynatrace and reports the differences without applying anything
+	Plan        bool `json:"plan"`
+	KeepTempDir bool `json:"keepTempDir"`
+}
+
+// runtime configuration of the service, initialized from envConfig on startup
+var monacoRuntimeConfig = MonacoRuntimeConfig{Verbose: true, DryRun: true, KeepTempDir: true}
+
+// serializes the monaco runs per tenant, project and stage, initialized from envConfig on startup
+var monacoRunQueue = common.NewRunQueue(0, common.RunQueuePolicyQueue)
+
 type MonacoStartedEventData struct {
 	keptnv2.EventData
 }
 
+// MonacoTriggeredEventData is the payload of sh.keptn.event.monaco.triggered
+type MonacoTriggeredEventData struct {
+	keptnv2.EventData
+	Monaco MonacoTriggeredData `json:"monaco"`
+	// Deployment is the output of a preceding deployment task of the sequence
+	Deployment *keptnv2.DeploymentFinishedData `json:"deployment,omitempty"`
+	// ConfigurationChange contains the image of a delivery sequence
+	ConfigurationChange *keptnv2.ConfigurationChange `json:"configurationChange,omitempty"`
+}
+
+/**
+ * MonacoTriggeredData overrides the runtime configuration for a single event, e.g:
+ * "monaco": { "dryRunOnly": true }
+ */
+type MonacoTriggeredData struct {
+	Verbose     *bool `json:"verbose,omitempty"`
+	DryRun      *bool `json:"dryRun,omitempty"`
+	DryRunOnly  *bool `json:"dryRunOnly,omitempty"`
+	Plan        *bool `json:"plan,omitempty"`
+	KeepTempDir *bool `json:"keepTempDir,omitempty"`
+}
+
+type MonacoFinishedEventData struct {
+	keptnv2.EventData
+	Monaco MonacoFinishedData `json:"monaco"`
+}
+
+// MonacoFinishedData contains the result of the monaco run
+type MonacoFinishedData struct {
+	// Report lists every configuration monaco touched, only set when deploying to a single tenant
+	Report *common.MonacoDeploymentReport `json:"report,omitempty"`
+	// Plan lists the differences to Dynatrace in plan mode, only set for a single tenant
+	Plan *common.MonacoPlan `json:"plan,omitempty"`
+	// Tenants contains the result per Dynatrace tenant
+	Tenants []*MonacoTenantResult `json:"tenants,omitempty"`
+	// Config is the effective monaco.conf.yaml for the stage
+	Config *common.MonacoConfigFile `json:"config,omitempty"`
+	// Files maps every downloaded monaco file to the Keptn level (service, stage, project) it was taken from
+	Files map[string]string `json:"files,omitempty"`
+	// Runtime is the effective runtime configuration of the monaco run
+	Runtime *MonacoRuntimeConfig `json:"runtime,omitempty"`
+}
+
+// MonacoTenantResult is the result of the monaco run for a single Dynatrace tenant
+type MonacoTenantResult struct {
+	// Name of the secret with the Dynatrace credentials
+	Name string `json:"name"`
+	// Tenant is the Dynatrace environment URL
+	Tenant string `json:"tenant,omitempty"`
+	// Result is empty if the tenant was skipped after a previous tenant failed
+	Result  keptnv2.ResultType             `json:"result,omitempty"`
+	Message string                         `json:"message"`
+	Report  *common.MonacoDeploymentReport `json:"report,omitempty"`
+	Plan    *common.MonacoPlan             `json:"plan,omitempty"`
+	// RolledBack is true if the configs were restored after applying failed
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+// MonacoDriftTriggeredEventData is the payload of sh.keptn.event.monaco-drift.triggered
+type MonacoDriftTriggeredEventData struct {
+	keptnv2.EventData
+}
+
+type MonacoDriftFinishedEventData struct {
+	keptnv2.EventData
+	MonacoDrift MonacoDriftFinishedData `json:"monacoDrift"`
+}
+
+// MonacoDriftFinishedData contains the drift between the Keptn repo and Dynatrace
+type MonacoDriftFinishedData struct {
+	// Drifted is the number of configs that differ from the Keptn repo or are missing in Dynatrace on any tenant
+	Drifted int `json:"drifted"`
+	// Tenants contains the plan per Dynatrace tenant, configs with action changed or added drifted
+	Tenants []*MonacoTenantResult `json:"tenants,omitempty"`
+	// Files maps every downloaded monaco file to the Keptn level (service, stage, project) it was taken from
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// MonacoDownloadTriggeredEventData is the payload of sh.keptn.event.monaco-download.triggered
+type MonacoDownloadTriggeredEventData struct {
+	keptnv2.EventData
+	MonacoDownload MonacoDownloadData `json:"monacoDownload"`
+}
+
+// MonacoDownloadData defines which configs are exported from Dynatrace and where they are stored in the Keptn repo
+type MonacoDownloadData struct {
+	// Project is the name of the monaco project, defaults to the Keptn project
+	Project string `json:"project,omitempty"`
+	// ConfigTypes are the config types to export, e.g: auto-tag, dashboard. Defaults to all supported config types
+	ConfigTypes []string `json:"configTypes,omitempty"`
+	// Level is the Keptn level the project is stored on: service, stage or project. Defaults to the most specific level of the event
+	Level string `json:"level,omitempty"`
+	// Tenant is the name of the tenant of monaco.conf.yaml to export from, defaults to the first tenant
+	Tenant string `json:"tenant,omitempty"`
+}
+
+type MonacoDownloadFinishedEventData struct {
+	keptnv2.EventData
+	MonacoDownload MonacoDownloadFinishedData `json:"monacoDownload"`
+}
+
+// MonacoDownloadFinishedData contains the files that were committed to the Keptn repo
+type MonacoDownloadFinishedData struct {
+	Project string                         `json:"project"`
+	Level   string                         `json:"level"`
+	Files   []string                       `json:"files,omitempty"`
+	Report  *common.MonacoDeploymentReport `json:"report,omitempty"`
+}
+
+// MonacoRollbackFinishedEventData is the payload of sh.keptn.event.rollback.finished
+type MonacoRollbackFinishedEventData struct {
+	keptnv2.EventData
+	Monaco MonacoFinishedData `json:"monaco"`
+}
+
 // ServiceName specifies the current services name (e.g., used as source when sending CloudEvents)
 const ServiceName = "monaco-service"
 const MonacoEvent = "monaco"
+const MonacoDriftEvent = "monaco-drift"
+const MonacoDownloadEvent = "monaco-download"
 
 /**
  * Parses a Keptn Cloud Event payload (data attribute)
@@ -145,11 +316,34 @@ func processKeptnCloudEvent(ctx context.Context, event cloudevents.Event) error
 	case keptnv2.GetTriggeredEventType(MonacoEvent): // sh.keptn.event.monaco.triggered
 		logger.Info("Processing sh.keptn.event.monaco.triggered Event")
 
-		eventData := &MonacoStartedEventData{}
+		eventData := &MonacoTriggeredEventData{}
 		parseKeptnCloudEventPayload(event, eventData)
 
 		return HandleMonacoTriggeredEvent(myKeptn, event, eventData)
-		break
+
+	case keptnv2.GetTriggeredEventType(MonacoDriftEvent): // sh.keptn.event.monaco-drift.triggered
+		logger.Info("Processing sh.keptn.event.monaco-drift.triggered Event")
+
+		eventData := &MonacoDriftTriggeredEventData{}
+		parseKeptnCloudEventPayload(event, eventData)
+
+		return HandleMonacoDriftTriggeredEvent(myKeptn, event, eventData)
+
+	case keptnv2.GetTriggeredEventType(MonacoDownloadEvent): // sh.keptn.event.monaco-download.triggered
+		logger.Info("Processing sh.keptn.event.monaco-download.triggered Event")
+
+		eventData := &MonacoDownloadTriggeredEventData{}
+		parseKeptnCloudEventPayload(event, eventData)
+
+		return HandleMonacoDownloadTriggeredEvent(myKeptn, event, eventData)
+
+	case keptnv2.GetTriggeredEventType(keptnv2.RollbackTaskName): // sh.keptn.event.rollback.triggered
+		logger.Info("Processing sh.keptn.event.rollback.triggered Event")
+
+		eventData := &keptnv2.RollbackTriggeredEventData{}
+		parseKeptnCloudEventPayload(event, eventData)
+
+		return HandleRollbackTriggeredEvent(myKeptn, event, eventData)
 
 		/*   HERE SOME ADDITIONAL OPTIONS TO CONSIDER IN THE FUTURE!!
 		// -------------------------------------------------------
@@ -214,10 +408,16 @@ func processKeptnCloudEvent(ctx context.Context, event cloudevents.Event) error
  * env=runlocal   -> will fetch resources from local drive instead of configuration service
  */
 func main() {
+	// secrets resolved from $SECRET placeholders never show up in the logs
+	log.SetOutput(&common.MaskingWriter{Writer: os.Stderr})
+
 	var env envConfig
 	if err := envconfig.Process("", &env); err != nil {
 		log.Fatalf("Failed to process env var: %s", err)
 	}
+	if err := env.validate(); err != nil {
+		log.Fatalf("Invalid env var: %s", err)
+	}
 
 	os.Exit(_main(os.Args[1:], env))
 }
@@ -234,6 +434,25 @@ func _main(args []string, env envConfig) int {
 
 	keptnOptions.ConfigurationServiceURL = env.ConfigurationServiceUrl
 
+	monacoRuntimeConfig = MonacoRuntimeConfig{
+		Verbose:     env.MonacoVerbose,
+		DryRun:      env.MonacoDryRun,
+		KeepTempDir: env.MonacoKeepTempDir,
+	}
+	log.Printf("    monaco verbose=%t; dryRun=%t; keepTempDir=%t", monacoRuntimeConfig.Verbose, monacoRuntimeConfig.DryRun, monacoRuntimeConfig.KeepTempDir)
+
+	monacoRunQueue = common.NewRunQueue(env.MonacoMaxConcurrentRuns, env.MonacoQueuePolicy)
+	log.Printf("    monaco maxConcurrentRuns=%d; queuePolicy=%s", env.MonacoMaxConcurrentRuns, env.MonacoQueuePolicy)
+
+	if env.MetricsPort > 0 {
+		// expvar serves the queue depth as JSON on /debug/vars
+		expvar.Publish("monacoRunQueue", expvar.Func(func() interface{} { return monacoRunQueue.Stats() }))
+		go func() {
+			log.Printf("Serving metrics on port %d at /debug/vars", env.MetricsPort)
+			log.Println(http.ListenAndServe(fmt.Sprintf(":%d", env.MetricsPort), nil))
+		}()
+	}
+
 	log.Println("Starting monaco-service...")
 	log.Printf("    on Port = %d; Path=%s", env.Port, env.Path)
 
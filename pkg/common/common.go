@@ -2,23 +2,26 @@ package common
 
 import (
 	"archive/zip"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	keptnmodels "github.com/keptn/go-utils/pkg/api/models"
 	keptnapi "github.com/keptn/go-utils/pkg/api/utils"
 	"gopkg.in/yaml.v2"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -39,11 +42,70 @@ type MonacoConfigFile struct {
 	SpecVersion string   `json:"spec_version" yaml:"spec_version"`
 	DtCreds     string   `json:"dtCreds,omitempty" yaml:"dtCreds,omitempty"`
 	Projects    []string `json:"projects,omitempty" yaml:"projects,omitempty"`
+	// Deployer is either exec (default, runs the monaco executable) or native
+	Deployer string `json:"deployer,omitempty" yaml:"deployer,omitempty"`
+	// ManifestEnvironments maps Keptn stages to environments of a monaco v2 manifest.yaml, defaults to the stage name
+	ManifestEnvironments map[string]string `json:"manifestEnvironments,omitempty" yaml:"manifestEnvironments,omitempty"`
+	// Environments defines the monaco (v1) environments.yaml, defaults to one generated for the Dynatrace credentials
+	Environments *MonacoEnvironmentsConfig `json:"environments,omitempty" yaml:"environments,omitempty"`
+	// Tenants deploys the projects to several Dynatrace environments, replaces dtCreds
+	Tenants []MonacoTenant `json:"tenants,omitempty" yaml:"tenants,omitempty"`
+	// ContinueOnFailure keeps deploying to the remaining tenants after a tenant failed
+	ContinueOnFailure bool `json:"continueOnFailure,omitempty" yaml:"continueOnFailure,omitempty"`
+	// DryRun and Verbose override MONACO_DRYRUN and MONACO_VERBOSE_MODE
+	DryRun  *bool `json:"dryRun,omitempty" yaml:"dryRun,omitempty"`
+	Verbose *bool `json:"verbose,omitempty" yaml:"verbose,omitempty"`
+	// Env are additional env variables that can be used in monaco files
+	Env map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	// DriftResult is the result of a monaco-drift task that detected drift: pass, warning or fail (default)
+	DriftResult string `json:"driftResult,omitempty" yaml:"driftResult,omitempty"`
+	// RollbackOnFailure restores the configs as they were before the run if applying failed, defaults to true
+	RollbackOnFailure *bool `json:"rollbackOnFailure,omitempty" yaml:"rollbackOnFailure,omitempty"`
+	// SnapshotRetention is the number of snapshots kept per tenant in the Keptn repo, defaults to 5, 0 keeps all snapshots
+	SnapshotRetention *int `json:"snapshotRetention,omitempty" yaml:"snapshotRetention,omitempty"`
+	// AutoPrune deletes configs from Dynatrace that a previous run deployed but that were removed from the monaco projects
+	AutoPrune *bool `json:"autoPrune,omitempty" yaml:"autoPrune,omitempty"`
+	// PreRender renders the monaco projects with the Keptn event before monaco runs
+	PreRender *MonacoPreRenderConfig `json:"preRender,omitempty" yaml:"preRender,omitempty"`
+	// CredentialSearchOrder are the secrets searched for the Dynatrace credentials after dtCreds, e.g: dynatrace-credentials-$PROJECT-$STAGE
+	CredentialSearchOrder []string `json:"credentialSearchOrder,omitempty" yaml:"credentialSearchOrder,omitempty"`
+	// CredentialNamespaces are the namespaces searched for the secrets, defaults to the namespace of the monaco-service
+	CredentialNamespaces []string `json:"credentialNamespaces,omitempty" yaml:"credentialNamespaces,omitempty"`
+	// ValidateToken checks the tenant and the scopes of the API token before monaco runs, defaults to true
+	ValidateToken *bool `json:"validateToken,omitempty" yaml:"validateToken,omitempty"`
+	// Stages overrides the settings above for individual stages
+	Stages map[string]*MonacoStageConfig `json:"stages,omitempty" yaml:"stages,omitempty"`
+}
+
+// MonacoStageConfig contains the settings of monaco.conf.yaml that can be overridden per stage
+type MonacoStageConfig struct {
+	DtCreds  string            `json:"dtCreds,omitempty" yaml:"dtCreds,omitempty"`
+	Projects []string          `json:"projects,omitempty" yaml:"projects,omitempty"`
+	Tenants  []MonacoTenant    `json:"tenants,omitempty" yaml:"tenants,omitempty"`
+	DryRun   *bool             `json:"dryRun,omitempty" yaml:"dryRun,omitempty"`
+	Verbose  *bool             `json:"verbose,omitempty" yaml:"verbose,omitempty"`
+	Env      map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+	// DriftResult is the result of a monaco-drift task that detected drift: pass, warning or fail
+	DriftResult string                 `json:"driftResult,omitempty" yaml:"driftResult,omitempty"`
+	AutoPrune   *bool                  `json:"autoPrune,omitempty" yaml:"autoPrune,omitempty"`
+	PreRender   *MonacoPreRenderConfig `json:"preRender,omitempty" yaml:"preRender,omitempty"`
+}
+
+// MonacoTenant references the secret with the Dynatrace credentials of a tenant and optionally the projects to deploy to it
+type MonacoTenant struct {
+	Name     string   `json:"name" yaml:"name"`
+	Projects []string `json:"projects,omitempty" yaml:"projects,omitempty"`
 }
 
 type DTCredentials struct {
 	Tenant   string `json:"DT_TENANT" yaml:"DT_TENANT"`
 	ApiToken string `json:"DT_API_TOKEN" yaml:"DT_API_TOKEN"`
+	// OAuth client for the Dynatrace platform configs, e.g: documents, automations and buckets. TokenEndpoint defaults to DefaultOAuthTokenEndpoint
+	ClientID      string `json:"DT_CLIENT_ID,omitempty" yaml:"DT_CLIENT_ID,omitempty"`
+	ClientSecret  string `json:"DT_CLIENT_SECRET,omitempty" yaml:"DT_CLIENT_SECRET,omitempty"`
+	TokenEndpoint string `json:"DT_TOKEN_ENDPOINT,omitempty" yaml:"DT_TOKEN_ENDPOINT,omitempty"`
+	// PlatformToken can be used instead of the OAuth client
+	PlatformToken string `json:"DT_PLATFORM_TOKEN,omitempty" yaml:"DT_PLATFORM_TOKEN,omitempty"`
 }
 
 type BaseKeptnEvent struct {
@@ -61,7 +123,21 @@ type BaseKeptnEvent struct {
 	Image string
 	Tag   string
 
+	// deployment data of the preceding deployment task
+	DeploymentURIsLocal  []string
+	DeploymentURIsPublic []string
+	DeploymentNames      []string
+
 	Labels map[string]string
+	// Task is the task of the triggering event, e.g: monaco or rollback
+	Task string
+	// RunID separates the runs of the same keptn context and stage, e.g: in the tmp folder, see NewRunID
+	RunID string
+	// Data is the data of the triggering event
+	Data map[string]interface{}
+
+	// secrets read for $SECRET placeholders of this event
+	secrets *keptnSecretCache
 }
 
 var namespace = getPodNamespace()
@@ -75,7 +151,13 @@ func getPodNamespace() string {
 	return ns
 }
 
-func GetKubernetesClient() (*kubernetes.Clientset, error) {
+// GetKubernetesClient returns the in-cluster client, it is created once and shared by all events. See SetKubernetesClient for tests
+func GetKubernetesClient() (kubernetes.Interface, error) {
+	kubernetesClient.Lock()
+	defer kubernetesClient.Unlock()
+	if kubernetesClient.client != nil {
+		return kubernetesClient.client, nil
+	}
 	if RunLocal || RunLocalTest {
 		return nil, nil
 	}
@@ -84,47 +166,12 @@ func GetKubernetesClient() (*kubernetes.Clientset, error) {
 	if err != nil {
 		return nil, err
 	}
-	return kubernetes.NewForConfig(config)
-}
-
-//
-// replaces $ placeholders with actual values
-// $CONTEXT, $EVENT, $SOURCE
-// $PROJECT, $STAGE, $SERVICE, $DEPLOYMENT
-// $TESTSTRATEGY
-// $LABEL.XXXX  -> will replace that with a label called XXXX
-// $ENV.XXXX    -> will replace that with an env variable called XXXX
-// $SECRET.YYYY -> will replace that with the k8s secret called YYYY
-//
-func ReplaceKeptnPlaceholders(input string, keptnEvent *BaseKeptnEvent) string {
-	result := input
-
-	// FIXING on 27.5.2020: URL Escaping of parameters as described in https://github.com/keptn-contrib/dynatrace-sli-service/issues/54
-
-	// first we do the regular keptn values
-	result = strings.Replace(result, "$CONTEXT", url.QueryEscape(keptnEvent.Context), -1)
-	result = strings.Replace(result, "$EVENT", url.QueryEscape(keptnEvent.Event), -1)
-	result = strings.Replace(result, "$SOURCE", url.QueryEscape(keptnEvent.Source), -1)
-	result = strings.Replace(result, "$PROJECT", url.QueryEscape(keptnEvent.Project), -1)
-	result = strings.Replace(result, "$STAGE", url.QueryEscape(keptnEvent.Stage), -1)
-	result = strings.Replace(result, "$SERVICE", url.QueryEscape(keptnEvent.Service), -1)
-	result = strings.Replace(result, "$DEPLOYMENT", url.QueryEscape(keptnEvent.Deployment), -1)
-	result = strings.Replace(result, "$TESTSTRATEGY", url.QueryEscape(keptnEvent.TestStrategy), -1)
-
-	// now we do the labels
-	for key, value := range keptnEvent.Labels {
-		result = strings.Replace(result, "$LABEL."+key, url.QueryEscape(value), -1)
-	}
-
-	// now we do all environment variables
-	for _, env := range os.Environ() {
-		pair := strings.SplitN(env, "=", 2)
-		result = strings.Replace(result, "$ENV."+pair[0], url.QueryEscape(pair[1]), -1)
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
 	}
-
-	// TODO: iterate through k8s secrets!
-
-	return result
+	kubernetesClient.client = clientset
+	return clientset, nil
 }
 
 //
@@ -133,45 +180,51 @@ func ReplaceKeptnPlaceholders(input string, keptnEvent *BaseKeptnEvent) string {
 // In normal mode it first tries to find it on service level, then stage and then project level
 //
 func GetKeptnResource(keptnEvent *BaseKeptnEvent, resourceURI string) (string, error) {
+	fileContent, _, err := GetKeptnResourceWithLevel(keptnEvent, resourceURI)
+	return fileContent, err
+}
+
+// GetKeptnResourceWithLevel is the same as GetKeptnResource but also returns the level (service, stage, project or local) the resource was found on
+func GetKeptnResourceWithLevel(keptnEvent *BaseKeptnEvent, resourceURI string) (string, string, error) {
 
 	// if we run in a runlocal mode we are just getting the file from the local disk
 	var fileContent string
+	var level string
 	if RunLocal {
 		localFileContent, err := ioutil.ReadFile(resourceURI)
 		if err != nil {
 			logMessage := fmt.Sprintf("No %s file found LOCALLY for service %s in stage %s in project %s", resourceURI, keptnEvent.Service, keptnEvent.Stage, keptnEvent.Project)
 			log.Printf(logMessage)
-			return "", nil
+			return "", "", nil
 		}
 		log.Printf("Loaded LOCAL file " + resourceURI)
 		fileContent = string(localFileContent)
+		level = KeptnResourceLevelLocal
 	} else {
 		resourceHandler := keptnapi.NewResourceHandler(GetConfigurationServiceURL())
 
 		// Lets search on SERVICE-LEVEL
+		level = KeptnResourceLevelService
 		keptnResourceContent, err := resourceHandler.GetServiceResource(keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, resourceURI)
 		if err != nil || keptnResourceContent == nil || keptnResourceContent.ResourceContent == "" {
 			// Lets search on STAGE-LEVEL
+			level = KeptnResourceLevelStage
 			keptnResourceContent, err = resourceHandler.GetStageResource(keptnEvent.Project, keptnEvent.Stage, resourceURI)
 			if err != nil || keptnResourceContent == nil || keptnResourceContent.ResourceContent == "" {
 				// Lets search on PROJECT-LEVEL
+				level = KeptnResourceLevelProject
 				keptnResourceContent, err = resourceHandler.GetProjectResource(keptnEvent.Project, resourceURI)
 				if err != nil || keptnResourceContent == nil || keptnResourceContent.ResourceContent == "" {
 					// log.Printf(fmt.Sprintf("No Keptn Resource found: %s/%s/%s/%s - %s", keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, resourceURI, err))
-					return "", err
+					return "", "", err
 				}
-
-				log.Printf("Found " + resourceURI + " on project level")
-			} else {
-				log.Printf("Found " + resourceURI + " on stage level")
 			}
-		} else {
-			log.Printf("Found " + resourceURI + " on service level")
 		}
+		log.Printf("Found " + resourceURI + " on " + level + " level")
 		fileContent = keptnResourceContent.ResourceContent
 	}
 
-	return fileContent, nil
+	return fileContent, level, nil
 }
 
 // GetMonacoConfig loads monaco.conf for the current service
@@ -196,8 +249,61 @@ func GetMonacoConfig(keptnEvent *BaseKeptnEvent) (*MonacoConfigFile, error) {
 		log.Printf(logMessage)
 		return nil, errors.New(logMessage)
 	}
-	fmt.Printf("GetMonacoConfig monacoConfFile: %v\n", monacoConfFile)
-	return monacoConfFile, nil
+	log.Printf("GetMonacoConfig monacoConfFile: %v\n", monacoConfFile)
+
+	effectiveConfFile := monacoConfFile.ForStage(keptnEvent.Stage)
+	effectiveConfFileContent, _ := yaml.Marshal(effectiveConfFile)
+	log.Printf("Effective monaco.conf.yaml for stage %s:\n%s", keptnEvent.Stage, string(effectiveConfFileContent))
+	return effectiveConfFile, nil
+}
+
+/**
+ * Returns the effective configuration for the stage: the settings of the stage in stages are merged on top of the base settings.
+ * env variables are merged per key, all other settings replace the base settings
+ */
+func (monacoConfFile *MonacoConfigFile) ForStage(stage string) *MonacoConfigFile {
+	effective := *monacoConfFile
+	effective.Stages = nil
+
+	stageConfig, ok := monacoConfFile.Stages[stage]
+	if !ok || stageConfig == nil {
+		return &effective
+	}
+
+	if stageConfig.DtCreds != "" {
+		effective.DtCreds = stageConfig.DtCreds
+	}
+	if len(stageConfig.Projects) > 0 {
+		effective.Projects = stageConfig.Projects
+	}
+	if len(stageConfig.Tenants) > 0 {
+		effective.Tenants = stageConfig.Tenants
+	}
+	if stageConfig.DryRun != nil {
+		effective.DryRun = stageConfig.DryRun
+	}
+	if stageConfig.Verbose != nil {
+		effective.Verbose = stageConfig.Verbose
+	}
+	if stageConfig.DriftResult != "" {
+		effective.DriftResult = stageConfig.DriftResult
+	}
+	if stageConfig.AutoPrune != nil {
+		effective.AutoPrune = stageConfig.AutoPrune
+	}
+	if stageConfig.PreRender != nil {
+		effective.PreRender = stageConfig.PreRender
+	}
+	if len(stageConfig.Env) > 0 {
+		effective.Env = map[string]string{}
+		for key, value := range monacoConfFile.Env {
+			effective.Env[key] = value
+		}
+		for key, value := range stageConfig.Env {
+			effective.Env[key] = value
+		}
+	}
+	return &effective
 }
 
 // UploadKeptnResource uploads a file to the Keptn Configuration Service
@@ -226,6 +332,78 @@ func UploadKeptnResource(contentToUpload []byte, remoteResourceURI string, keptn
 	return nil
 }
 
+// DeleteKeptnResource deletes a resource on the level of the keptnEvent, in RunLocal mode the local file is deleted
+func DeleteKeptnResource(keptnEvent *BaseKeptnEvent, resourceURI string) error {
+	if RunLocal || RunLocalTest {
+		err := os.Remove(resourceURI)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Couldnt delete local file %s: %v", resourceURI, err)
+		}
+		return nil
+	}
+
+	resourceHandler := keptnapi.NewResourceHandler(GetConfigurationServiceURL())
+	var err error
+	switch GetKeptnEventLevel(keptnEvent) {
+	case KeptnResourceLevelService:
+		err = resourceHandler.DeleteServiceResource(keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, resourceURI)
+	case KeptnResourceLevelStage:
+		err = resourceHandler.DeleteStageResource(keptnEvent.Project, keptnEvent.Stage, resourceURI)
+	default:
+		err = resourceHandler.DeleteProjectResource(keptnEvent.Project, resourceURI)
+	}
+	if err != nil {
+		return fmt.Errorf("Couldnt delete remote resource %s: %v", resourceURI, err)
+	}
+	log.Printf("Deleted file %s", resourceURI)
+	return nil
+}
+
+// GetKeptnEventLevel returns the level resources of the keptnEvent are uploaded to, e.g: stage for an event without service
+func GetKeptnEventLevel(keptnEvent *BaseKeptnEvent) string {
+	if keptnEvent.Service != "" {
+		return KeptnResourceLevelService
+	}
+	if keptnEvent.Stage != "" {
+		return KeptnResourceLevelStage
+	}
+	return KeptnResourceLevelProject
+}
+
+/**
+ * Uploads several files to the Keptn Configuration Service in a single commit. The files are keyed by their resource URI
+ * The files are stored on the level of the keptnEvent, e.g: on stage level if the event has no service
+ */
+func UploadKeptnResources(files map[string]string, keptnEvent *BaseKeptnEvent) error {
+
+	// if we run in a runlocal mode we are just writing the files to the local disk
+	if RunLocal || RunLocalTest {
+		for remoteResourceURI, content := range files {
+			_, err := storeFile(".", remoteResourceURI, content, true)
+			if err != nil {
+				return fmt.Errorf("Couldnt write local file %s: %v", remoteResourceURI, err)
+			}
+		}
+		log.Printf("%d local files written", len(files))
+		return nil
+	}
+
+	resources := []*keptnmodels.Resource{}
+	for remoteResourceURI, content := range files {
+		resourceURI := remoteResourceURI
+		resources = append(resources, &keptnmodels.Resource{ResourceContent: content, ResourceURI: &resourceURI})
+	}
+
+	resourceHandler := keptnapi.NewResourceHandler(GetConfigurationServiceURL())
+	_, err := resourceHandler.CreateResources(keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, resources)
+	if err != nil {
+		return fmt.Errorf("Couldnt upload %d remote resources: %s", len(resources), *err.Message)
+	}
+
+	log.Printf("Uploaded %d files", len(resources))
+	return nil
+}
+
 /**
  * parses the dynatrace.conf.yaml file that is passed as parameter
  */
@@ -234,50 +412,25 @@ func parseMonacoConfigFile(input []byte) (*MonacoConfigFile, error) {
 	err := yaml.Unmarshal([]byte(input), &monacoConfFile)
 
 	if err != nil {
-		fmt.Printf("Error while parsing: %s\n", err)
+		log.Printf("Error while parsing: %s\n", err)
 		return nil, err
 	}
 	return monacoConfFile, nil
 }
 
 /**
- * Pulls the Dynatrace Credentials from the passed secret
+ * Pulls the Dynatrace Credentials from the passed secret, see NewCredentialProvider for other sources like k8s://namespace/secret or file:///path
  */
 func GetDTCredentials(dynatraceSecretName string) (*DTCredentials, error) {
 	if dynatraceSecretName == "" {
 		return nil, nil
 	}
-	dtCreds := &DTCredentials{}
-	if RunLocal || RunLocalTest {
-		// if we RunLocal we take it from the env-variables
-		dtCreds.Tenant = os.Getenv("DT_TENANT")
-		dtCreds.ApiToken = os.Getenv("DT_API_TOKEN")
-	} else {
-		kubeAPI, err := GetKubernetesClient()
-		if err != nil {
-			return nil, fmt.Errorf("error retrieving Dynatrace credentials: could not initialize Kubernetes client: %v", err)
-		}
-		secret, err := kubeAPI.CoreV1().Secrets(namespace).Get(dynatraceSecretName, metav1.GetOptions{})
-		if err != nil {
-			return nil, fmt.Errorf("error retrieving Dynatrace credentials: could not retrieve secret %s: %v", dynatraceSecretName, err)
-		}
-
-		// grabnerandi: remove check on DT_PAAS_TOKEN as it is not relevant for quality-gate-only use case
-		if string(secret.Data["DT_TENANT"]) == "" || string(secret.Data["DT_API_TOKEN"]) == "" { //|| string(secret.Data["DT_PAAS_TOKEN"]) == "" {
-			return nil, errors.New("invalid or no Dynatrace credentials found. Need DT_TENANT & DT_API_TOKEN stored in secret!")
-		}
-
-		dtCreds.Tenant = string(secret.Data["DT_TENANT"])
-		dtCreds.ApiToken = string(secret.Data["DT_API_TOKEN"])
-	}
 
-	// ensure URL always has http or https in front
-	if strings.HasPrefix(dtCreds.Tenant, "https://") || strings.HasPrefix(dtCreds.Tenant, "http://") {
-		dtCreds.Tenant = dtCreds.Tenant
-	} else {
-		dtCreds.Tenant = "https://" + dtCreds.Tenant
+	provider, err := NewCredentialProvider(dynatraceSecretName)
+	if err != nil {
+		return nil, err
 	}
-	return dtCreds, nil
+	return provider.GetCredentials()
 }
 
 // ParseUnixTimestamp parses a time stamp into Unix foramt
@@ -339,18 +492,29 @@ func DeleteTempFolderForKeptnContext(keptnEvent *BaseKeptnEvent) error {
 	if _, err := os.Stat(path); !os.IsNotExist(err) {
 		err := os.RemoveAll(path)
 		if err != nil {
-			fmt.Printf("Error deleting: %s", err)
+			log.Printf("Error deleting: %s", err)
 			return err
 		}
 	}
 	return nil
 }
 
-// returns the tmp folder for this run, e.g: tmp/KEPTNCONTEXT-STAGE
+// returns the tmp folder for this run, e.g: tmp/KEPTNCONTEXT-STAGE or tmp/KEPTNCONTEXT-STAGE-RUNID
 func GetTempMonacoFolder(keptnEvent *BaseKeptnEvent) string {
+	if keptnEvent.RunID != "" {
+		return fmt.Sprintf("%s%s-%s-%s", MonacoBaseFolder, keptnEvent.Context, keptnEvent.Stage, keptnEvent.RunID)
+	}
 	return fmt.Sprintf("%s%s-%s", MonacoBaseFolder, keptnEvent.Context, keptnEvent.Stage)
 }
 
+// counts the runs since the start of the service
+var monacoRunCounter uint64
+
+// NewRunID returns an ID that is unique for every run of the service, even if the same event is delivered twice
+func NewRunID(eventID string) string {
+	return fmt.Sprintf("%s-%d", strings.Replace(eventID, "/", "_", -1), atomic.AddUint64(&monacoRunCounter, 1))
+}
+
 // Copy file contents to a destination
 func CopyFileContentToDestination(fileContent string, destination string) error {
 	err := ioutil.WriteFile(destination, []byte(fileContent), 0755)
@@ -364,7 +528,7 @@ func CopyFileContentsToMonacoProject(fileContent string, keptnEvent *BaseKeptnEv
 	if err != nil {
 		return err
 	}
-	fmt.Println("Succesfully copied to " + path + "\n")
+	log.Println("Succesfully copied to " + path + "\n")
 	return err
 }
 
@@ -375,50 +539,95 @@ func ExtractMonacoArchive(keptnEvent *BaseKeptnEvent) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println("Succesfully extracted " + file + " to " + folder + "\n")
+	log.Println("Succesfully extracted " + file + " to " + folder + "\n")
 	return err
 }
 
 func ExtractZIPArchive(archiveFileName string, outputFolder string) error {
 	files, err := Unzip(archiveFileName, outputFolder)
 	if err != nil {
-		fmt.Errorf("Error unzipping file: " + err.Error())
+		log.Println("Error unzipping file: " + err.Error())
 		return err
 	}
-	fmt.Println("Succesfully Unzipped:\n" + strings.Join(files, "\n"))
+	log.Println("Succesfully Unzipped:\n" + strings.Join(files, "\n"))
 	return nil
 }
 
-func ExecuteMonaco(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, verbose bool, dryrun bool) error {
+/**
+ * Executes monaco for the passed projects and returns the combined stdout/stderr output of monaco
+ */
+func ExecuteMonaco(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, verbose bool, dryrun bool, env map[string]string) (string, error) {
 
 	cmd := exec.Command(MonacoExecutable)
 
-	tmpMonacoFolder := GetTempMonacoFolder(keptnEvent)
-	// If running in a locla environment, use a local test folder
-	if RunLocal {
-		tmpMonacoFolder = "monaco-test"
-	}
-
 	if verbose {
 		cmd.Args = append(cmd.Args, "-v")
 	}
 	if dryrun {
 		cmd.Args = append(cmd.Args, "-d")
 	}
-	cmd.Args = append(cmd.Args, "-e=/environments.yaml")
+	cmd.Args = append(cmd.Args, "-e="+GetMonacoEnvironmentsPath(keptnEvent))
 	if projects != "" {
 		cmd.Args = append(cmd.Args, "-p="+projects)
 	}
-	cmd.Args = append(cmd.Args, tmpMonacoFolder+"/projects")
+	cmd.Args = append(cmd.Args, GetMonacoProjectsFolder(keptnEvent))
 
 	// Set environment variables to be used in monaco
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, "DT_ENVIRONMENT_URL="+dtCredentials.Tenant)
-	cmd.Env = append(cmd.Env, "DT_API_TOKEN="+dtCredentials.ApiToken)
-	cmd.Env = append(cmd.Env, "KEPTN_PROJECT="+keptnEvent.Project)
-	cmd.Env = append(cmd.Env, "KEPTN_SERVICE="+keptnEvent.Service)
-	cmd.Env = append(cmd.Env, "KEPTN_STAGE="+keptnEvent.Stage)
-	cmd.Env = append(cmd.Env, "KEPTN_CONTEXT="+keptnEvent.Context)
+	cmd.Env = GetMonacoEnvironment(dtCredentials, keptnEvent, env)
+
+	log.Printf("Monaco command: %v\n", cmd.String())
+	stdoutStderr, err := cmd.CombinedOutput()
+	log.Printf("%s\n", MaskSecrets(string(stdoutStderr)))
+
+	return string(stdoutStderr), err
+}
+
+// returns the projects folder monaco is executed on, e.g: tmp/monaco/KEPTNCONTEXT-STAGE/projects
+func GetMonacoProjectsFolder(keptnEvent *BaseKeptnEvent) string {
+	tmpMonacoFolder := GetTempMonacoFolder(keptnEvent)
+	// If running in a locla environment, use a local test folder
+	if RunLocal {
+		tmpMonacoFolder = "monaco-test"
+	}
+	return tmpMonacoFolder + "/" + MonacoProjectsSubfolder
+}
+
+/**
+ * Returns the environment variables that can be used in monaco files, e.g: {{ .Env.KEPTN_PROJECT }}
+ * This includes all env variables of the service, the Dynatrace credentials, Keptn project, stage, service and context, all labels as KEPTN_LABEL_XXXX
+ * as well as the additional env variables configured in monaco.conf.yaml
+ */
+func GetMonacoEnvironment(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, additionalEnv map[string]string) []string {
+	env := os.Environ()
+	for key, value := range additionalEnv {
+		env = append(env, key+"="+value)
+	}
+	env = append(env, "DT_ENVIRONMENT_URL="+dtCredentials.Tenant)
+	env = append(env, "DT_API_TOKEN="+dtCredentials.ApiToken)
+	// OAuth client and platform token for the platform configs, only set if they are in the credentials
+	if dtCredentials.ClientID != "" {
+		env = append(env, "DT_CLIENT_ID="+dtCredentials.ClientID)
+		env = append(env, "DT_CLIENT_SECRET="+dtCredentials.ClientSecret)
+		env = append(env, "DT_TOKEN_ENDPOINT="+dtCredentials.TokenEndpoint)
+	}
+	if dtCredentials.PlatformToken != "" {
+		env = append(env, "DT_PLATFORM_TOKEN="+dtCredentials.PlatformToken)
+	}
+	env = append(env, "KEPTN_PROJECT="+keptnEvent.Project)
+	env = append(env, "KEPTN_SERVICE="+keptnEvent.Service)
+	env = append(env, "KEPTN_STAGE="+keptnEvent.Stage)
+	env = append(env, "KEPTN_CONTEXT="+keptnEvent.Context)
+
+	// deployment data of the preceding deployment task, lists are comma separated
+	env = append(env, "KEPTN_DEPLOYMENT="+keptnEvent.Deployment)
+	env = append(env, "KEPTN_DEPLOYMENT_STRATEGY="+keptnEvent.DeploymentStrategy)
+	env = append(env, "KEPTN_DEPLOYMENT_NAMES="+strings.Join(keptnEvent.DeploymentNames, ","))
+	env = append(env, "KEPTN_DEPLOYMENT_URIS_LOCAL="+strings.Join(keptnEvent.DeploymentURIsLocal, ","))
+	env = append(env, "KEPTN_DEPLOYMENT_URIS_PUBLIC="+strings.Join(keptnEvent.DeploymentURIsPublic, ","))
+	env = append(env, "KEPTN_DEPLOYMENT_URI_LOCAL="+firstOrEmpty(keptnEvent.DeploymentURIsLocal))
+	env = append(env, "KEPTN_DEPLOYMENT_URI_PUBLIC="+firstOrEmpty(keptnEvent.DeploymentURIsPublic))
+	env = append(env, "KEPTN_IMAGE="+keptnEvent.Image)
+	env = append(env, "KEPTN_TAG="+keptnEvent.Tag)
 
 	// also adding labels to env variables
 	for key, value := range keptnEvent.Labels {
@@ -427,32 +636,65 @@ func ExecuteMonaco(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, pro
 		labelKey = strings.ReplaceAll(labelKey, "/", "_")
 		labelKey = strings.ReplaceAll(labelKey, "%", "_")
 
-		cmd.Env = append(cmd.Env, fmt.Sprintf("KEPTN_LABEL_%s=%s", labelKey, url.QueryEscape(value)))
+		env = append(env, fmt.Sprintf("KEPTN_LABEL_%s=%s", labelKey, url.QueryEscape(value)))
 	}
 
-	fmt.Printf("Monaco command: %v\n", cmd.String())
-	stdoutStderr, err := cmd.CombinedOutput()
-	fmt.Printf("%s\n", stdoutStderr)
+	return env
+}
 
-	return err
+func firstOrEmpty(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+/**
+ * Summarizes monaco output so it can be used in a finished event message.
+ * Returns all lines reporting an error or failure - or if there are none the last maxLines lines of the output
+ */
+func SummarizeMonacoOutput(output string, maxLines int) string {
+	lines := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	errorLines := []string{}
+	for _, line := range lines {
+		lowerLine := strings.ToLower(line)
+		if strings.Contains(lowerLine, "error") || strings.Contains(lowerLine, "failed") {
+			errorLines = append(errorLines, line)
+		}
+	}
+	if len(errorLines) > 0 {
+		lines = errorLines
+	}
+
+	if len(lines) > maxLines {
+		lines = lines[len(lines)-maxLines:]
+	}
+	return strings.Join(lines, "\n")
 }
 
 /**
  * Tries to download the zip file and if it exists extracts it into a unique folder based on the keptn context id
  */
-func DownloadAndExtractMonacoZip(keptnEvent *BaseKeptnEvent, zipFilePath string) error {
+func DownloadAndExtractMonacoZip(keptnEvent *BaseKeptnEvent, zipFilePath string) (string, error) {
 	// Get archive from Keptn
-	monacoArchive, err := GetKeptnResource(keptnEvent, zipFilePath)
+	monacoArchive, level, err := GetKeptnResourceWithLevel(keptnEvent, zipFilePath)
 	if err != nil {
 		log.Printf(fmt.Sprintf("No monaco archive found for project=%s,stage=%s,service=%s found as no dynatrace/monaco.zip in repo: %s, breaking", keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, err.Error()))
-		return err
+		return "", err
 	}
 
 	// copy archive
 	err = CopyFileContentsToMonacoProject(monacoArchive, keptnEvent)
 	if err != nil {
 		log.Printf(fmt.Sprintf("Error copying monaco archive for project=%s,stage=%s,service=%s found as no dynatrace/monaco.zip in repo: %s", keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, err.Error()))
-		return err
+		return "", err
 	}
 	log.Printf(fmt.Sprintf("Succesfully copied archive for project=%s,stage=%s,service=%s to temp folder", keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service))
 
@@ -460,17 +702,18 @@ func DownloadAndExtractMonacoZip(keptnEvent *BaseKeptnEvent, zipFilePath string)
 	err = ExtractMonacoArchive(keptnEvent)
 	if err != nil {
 		log.Printf(fmt.Sprintf("Error extracting archive for project=%s,stage=%s,service=%s : %s, breaking ", keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, err.Error()))
-		return err
+		return "", err
 	}
 	log.Printf(fmt.Sprintf("Succesfully copied archive for project=%s,stage=%s,service=%s to temp folder %s", keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, zipFilePath))
 
-	return nil
+	return level, nil
 }
 
 /**
  * Tries to download all files under the projectsPaths it into a unique folder based on the keptn context id
+ * Returns the level (service, stage or project) each file was taken from
  */
-func DownloadAllFilesFromSubfolder(keptnEvent *BaseKeptnEvent, projectsPath string) error {
+func DownloadAllFilesFromSubfolder(keptnEvent *BaseKeptnEvent, projectsPath string) (map[string]string, error) {
 
 	// target folder should be /tmp/monaco/SHKEPTNCONTEXT-STAGE/projects
 	folder := GetTempMonacoFolder(keptnEvent) + "/" + MonacoProjectsSubfolder
@@ -480,35 +723,39 @@ func DownloadAllFilesFromSubfolder(keptnEvent *BaseKeptnEvent, projectsPath stri
 	err := os.RemoveAll(folder)
 	if err != nil {
 		log.Printf(fmt.Sprintf("Error cleaning temp folder '%s' content: %v", folder, err))
-		return err
+		return nil, err
 	}
 	err = os.MkdirAll(folder, os.ModePerm)
 	if err != nil {
 		log.Printf(fmt.Sprintf("Error creating temp folder '%s' content: %v", folder, err))
-		return err
+		return nil, err
 	}
 
 	fileMatchPattern := projectsPath
-	downloadedFileCount, err := GetAllKeptnResources(keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, true, fileMatchPattern, folder)
+	provenance, err := GetAllKeptnResources(keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, true, fileMatchPattern, folder)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if downloadedFileCount == 0 {
-		err = fmt.Errorf("No Monaco files found for project=%s,stage=%s,service=%s under %s", keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, projectsPath)
+	if len(provenance) == 0 {
+		return nil, fmt.Errorf("No Monaco files found for project=%s,stage=%s,service=%s under %s", keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, projectsPath)
 	}
 
-	return nil
+	return provenance, nil
 }
 
-func PrepareFiles(keptnEvent *BaseKeptnEvent) error {
+/**
+ * Downloads the monaco files into the temp folder of the keptn context
+ * Returns the level (service, stage, project) each file was taken from, keyed by the path relative to the temp folder
+ */
+func PrepareFiles(keptnEvent *BaseKeptnEvent) (map[string]string, error) {
 
 	// create base folder
 	err := CreateBaseFolderIfNotExist()
 	if err != nil {
 		log.Printf(fmt.Sprintf("Error creating monaco base folder: %s, breaking", err.Error()))
-		return err
+		return nil, err
 	}
 	log.Printf(fmt.Sprintf("Monaco base folder created"))
 
@@ -516,24 +763,53 @@ func PrepareFiles(keptnEvent *BaseKeptnEvent) error {
 	err, tmpFolderPath := CreateTempFolderForKeptnContext(keptnEvent)
 	if err != nil {
 		log.Printf(fmt.Sprintf("Error creating monaco temp folder %s: %s, breaking", tmpFolderPath, err.Error()))
-		return err
+		return nil, err
 	}
 	log.Printf(fmt.Sprintf("Monaco temp folder created %s", tmpFolderPath))
 
 	// We provide two options for monaco files
 	// Option 1: zipped file under dynatrace/monaco.zip
 	// Option 2: folder structure as defined in project monaco under dynatrace/projects
+	// Both options can either be in the monaco v1 format or in the monaco v2 format with a manifest.yaml
 
 	// We first try option 1 as this was the initial implementation of the monaco service
-	err = DownloadAndExtractMonacoZip(keptnEvent, "dynatrace/monaco.zip")
+	level, err := DownloadAndExtractMonacoZip(keptnEvent, "dynatrace/monaco.zip")
 	if err == nil {
-		return nil
+		return map[string]string{"monaco.zip": level}, nil
 	}
 
 	// Now lets try option 2 where we assume there is a projects folder under dynatrace. we simply download all these files
-	err = DownloadAllFilesFromSubfolder(keptnEvent, "/dynatrace/projects/")
+	projectFiles, err := DownloadAllFilesFromSubfolder(keptnEvent, "/dynatrace/projects/")
+	if err != nil {
+		return nil, err
+	}
 
-	return err
+	provenance := map[string]string{}
+	for file, level := range projectFiles {
+		provenance[MonacoProjectsSubfolder+"/"+file] = level
+	}
+
+	// for monaco v2 we also need the manifest.yaml next to the projects folder
+	level, err = DownloadMonacoManifest(keptnEvent)
+	if level != "" {
+		provenance[MonacoManifestFilename] = level
+	}
+	return provenance, err
+}
+
+/**
+ * Downloads dynatrace/manifest.yaml into the temp folder if it exists
+ * Returns the level the manifest was found on, empty if there is no manifest
+ */
+func DownloadMonacoManifest(keptnEvent *BaseKeptnEvent) (string, error) {
+	manifestContent, level, err := GetKeptnResourceWithLevel(keptnEvent, MonacoManifestResource)
+	if err != nil || manifestContent == "" {
+		log.Printf("No %s found for project=%s,stage=%s,service=%s, using monaco v1 format", MonacoManifestResource, keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service)
+		return "", nil
+	}
+
+	log.Printf("Found %s for project=%s,stage=%s,service=%s, using monaco v2 format", MonacoManifestResource, keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service)
+	return level, CopyFileContentToDestination(manifestContent, GetMonacoManifestPath(keptnEvent))
 }
 
 func GenerateMonacoProjectStringFromMonacoConfig(monacoConfigFile *MonacoConfigFile, keptnEvent *BaseKeptnEvent) string {
@@ -608,106 +884,194 @@ func Unzip(src string, dest string) ([]string, error) {
 	return filenames, nil
 }
 
+/**
+ * Levels of Keptn's configuration repository a resource can be stored on
+ * For the same file a resource on service level overrides the stage level which overrides the project level
+ */
+const KeptnResourceLevelService = "service"
+const KeptnResourceLevelStage = "stage"
+const KeptnResourceLevelProject = "project"
+const KeptnResourceLevelLocal = "local"
+
 /*
  * This function will download ALL Resources from Keptn's Configuration Repository where the name starts with 'resourceUriFolderOfInterest'. This for instance allows us to download all files in the /dynatrace/projects folders
+ * Resources are merged per file: a file on service level overrides the same file on stage level which overrides the same file on project level
  *
  * Parameters:
  * project, stage, string: reference the keptn repo
  * inheritResources: if true it will download all resources from service, stage and project level - otherwise just from service level
- * resourceUriFolderOfInterest: will only download resources where the resourceUri contains that value, e.g: "/jmeter" and then also stores the downloaded files under that prefix
+ * resourceUriFolderOfInterest: will only download resources where the resourceUri starts with that value, e.g: "/jmeter" and then also stores the downloaded files under that prefix
  * localDirectory: the local directory to store these downloaded files
  *
  * Return:
- * no of resources: total number of downloaded resources
+ * provenance: the level (service, stage or project) each downloaded file was taken from, keyed by the file name relative to localDirectory
  * error: any error that occured
  */
-func GetAllKeptnResources(project string, stage string, service string, inheritResources bool, resourceUriFolderOfInterest string, localDirectory string) (int, error) {
+func GetAllKeptnResources(project string, stage string, service string, inheritResources bool, resourceUriFolderOfInterest string, localDirectory string) (map[string]string, error) {
 
 	resourceHandler := keptnapi.NewResourceHandler(GetConfigurationServiceURL())
 
-	// Lets first get the servcie resources
-	// TODO: This endpoint is not yet implemented and therefore this always fails - https://github.com/keptn/keptn/issues/1924
-	/* resourceList, err := resourceHandler.GetAllServiceResources(project, stage, service)
-	if err != nil {
-		return 0, err
-	}*/
+	// levels are listed from the lowest to the highest precedence so that higher levels override the files of lower levels
+	levels := []string{KeptnResourceLevelService}
+	if inheritResources {
+		levels = []string{KeptnResourceLevelProject, KeptnResourceLevelStage, KeptnResourceLevelService}
+	}
 
-	resourceList := []*keptnmodels.Resource{}
+	// as we download files from project, service and stage level we have different file structures, e.g:
+	// Project: /dynatrace/projects/infra/auto-tag/tags.json
+	// Stage: /dynatrace/projects/infra/auto-tag/tags.json
+	// Service: /dynatrace/projects/infra/auto-tag/tags.json (stored in the stage under /myservice/dynatrace/projects/...)
+	// When we store it locally we store all of them as infra/auto-tag/tags.json
+	provenance := map[string]string{}
+	resourceURIs := map[string]string{}
+	listedLevels := 0
+	skippedFileCount := 0
+	for _, level := range levels {
+		if (level == KeptnResourceLevelService && service == "") || (level != KeptnResourceLevelProject && stage == "") {
+			continue
+		}
 
-	// Next - lets get stage and project resources!
-	// if inheritResources == true we also get the list of resources from stage and project level
-	if inheritResources {
-		stageResources, err := resourceHandler.GetAllStageResources(project, stage)
+		resourceList, err := getAllKeptnResourcesOfLevel(resourceHandler, level, project, stage, service)
 		if err != nil {
-			return 0, err
+			log.Printf("Could not list %s resources of project=%s,stage=%s,service=%s: %v", level, project, stage, service, err)
+			continue
 		}
-		resourceList = append(resourceList, stageResources...)
+		listedLevels++
 
-		// TODO: missing configutils.GetAllProjectResources(project)
-		/* projectResources, err := resourceHandler.GetAllProjectResoruces(project)
-		if err != nil {
-			return 0, err
+		for _, resource := range resourceList {
+			targetFileName := getKeptnResourceTargetFileName(*resource.ResourceURI, resourceUriFolderOfInterest)
+			if targetFileName == "" {
+				skippedFileCount = skippedFileCount + 1
+				continue
+			}
+
+			if previousLevel, ok := provenance[targetFileName]; ok {
+				log.Printf("%s on %s level overrides the file on %s level", targetFileName, level, previousLevel)
+			}
+			provenance[targetFileName] = level
+			resourceURIs[targetFileName] = *resource.ResourceURI
 		}
-		resourceList = append(resourceList, projectResources...)*/
 	}
 
-	fileCount := 0
-	skippedFileCount := 0
+	if listedLevels == 0 {
+		return nil, fmt.Errorf("Could not list resources of project=%s,stage=%s,service=%s", project, stage, service)
+	}
 
-	// Download Files
-	// now lets iterate through all resources and download those that match the resourceUriFolderOfInterest and that havent already been downloaded
-	// as we download files from project, service and stage level we have different file structures, e.g:
-	// Project: /jmeter/myjmeter.jmx
-	// Stage: /jmeter/myjmenter2.jmx
-	// Stage: /myservice/jmeter/myjmeter3.jmx
-	// When we store it locally we have to store all these files in /jmeter/filename.jmx
-	for _, resource := range resourceList {
-		startingIndex := strings.Index(*resource.ResourceURI, resourceUriFolderOfInterest)
-
-		// store to local directory if it doesnt already exist
-		// now lets strip off the any prepending directory names prior to resourceUriFolderOfInterest
-
-		targetFileName := ""
-		if startingIndex >= 0 {
-			startingIndex += len(resourceUriFolderOfInterest)
-			targetFileName = (*resource.ResourceURI)[startingIndex:]
-		}
-
-		// only store it if we really know whether and where we have to store it to!
-		if targetFileName != "" {
-
-			// Issue #30 - ran into an issue where a leading / turned out to be a problem in the remote execution plane
-			resourceName := *resource.ResourceURI
-			if strings.HasPrefix(resourceName, "/") {
-				resourceName = resourceName[1:]
-				// log.Printf(fmt.Sprintf("removed leading / of %s", resourceName))
-			}
+	// download in a stable order so that the logs of two runs are comparable
+	targetFileNames := make([]string, 0, len(provenance))
+	for targetFileName := range provenance {
+		targetFileNames = append(targetFileNames, targetFileName)
+	}
+	sort.Strings(targetFileNames)
 
-			// now we have to download that resource first as so far we only have the resourceURI
-			// downloadedResource, err := resourceHandler.GetStageResource(project, stage, *resource.ResourceURI)
-			downloadedResource, err := resourceHandler.GetStageResource(project, stage, resourceName)
-			if err != nil {
-				return fileCount, err
-			}
+	for _, targetFileName := range targetFileNames {
+		level := provenance[targetFileName]
 
-			log.Printf(fmt.Sprintf("Storing %s to %s/%s - size (%d)", *resource.ResourceURI, localDirectory, targetFileName, len(downloadedResource.ResourceContent)))
-			stored, err := storeFile(localDirectory, targetFileName, downloadedResource.ResourceContent, true)
-			if err != nil {
-				return fileCount, err
-			}
+		// Issue #30 - ran into an issue where a leading / turned out to be a problem in the remote execution plane
+		resourceName := strings.TrimPrefix(resourceURIs[targetFileName], "/")
 
-			if stored {
-				fileCount = fileCount + 1
-			}
-		} else {
-			skippedFileCount = skippedFileCount + 1
-			// 	log.Printf(fmt.Sprintf("Not storing %s as it doesnt match %s or %s", *resource.ResourceURI, primaryTestFileName, resourceUriFolderOfInterest))
+		// now we have to download that resource first as so far we only have the resourceURI
+		downloadedResource, err := getKeptnResourceOfLevel(resourceHandler, level, project, stage, service, resourceName)
+		if err != nil {
+			return provenance, fmt.Errorf("Error downloading %s from %s level: %v", resourceName, level, err)
 		}
+
+		log.Printf(fmt.Sprintf("Storing %s from %s level to %s/%s - size (%d)", resourceName, level, localDirectory, targetFileName, len(downloadedResource.ResourceContent)))
+		_, err = storeFile(localDirectory, targetFileName, downloadedResource.ResourceContent, true)
+		if err != nil {
+			return provenance, err
+		}
+	}
+
+	log.Printf(fmt.Sprintf("Downloaded %d and skipped %d files for %s in %s.%s.%s", len(provenance), skippedFileCount, resourceUriFolderOfInterest, project, stage, service))
+
+	return provenance, nil
+}
+
+/**
+ * Returns the file name relative to resourceUriFolderOfInterest or an empty string if the resource is not in that folder
+ * Resources of other services show up in the stage listing as /otherservice/dynatrace/projects/... and are therefore ignored
+ */
+func getKeptnResourceTargetFileName(resourceURI string, resourceUriFolderOfInterest string) string {
+	resourceURI = "/" + strings.TrimPrefix(resourceURI, "/")
+	folder := "/" + strings.TrimPrefix(resourceUriFolderOfInterest, "/")
+	if !strings.HasPrefix(resourceURI, folder) {
+		return ""
+	}
+	return strings.TrimPrefix(resourceURI[len(folder):], "/")
+}
+
+func getAllKeptnResourcesOfLevel(resourceHandler *keptnapi.ResourceHandler, level string, project string, stage string, service string) ([]*keptnmodels.Resource, error) {
+	switch level {
+	case KeptnResourceLevelService:
+		return resourceHandler.GetAllServiceResources(project, stage, service)
+	case KeptnResourceLevelStage:
+		return resourceHandler.GetAllStageResources(project, stage)
+	default:
+		return getAllProjectResources(resourceHandler, project)
+	}
+}
+
+func getKeptnResourceOfLevel(resourceHandler *keptnapi.ResourceHandler, level string, project string, stage string, service string, resourceURI string) (*keptnmodels.Resource, error) {
+	switch level {
+	case KeptnResourceLevelService:
+		return resourceHandler.GetServiceResource(project, stage, service, resourceURI)
+	case KeptnResourceLevelStage:
+		return resourceHandler.GetStageResource(project, stage, resourceURI)
+	default:
+		return resourceHandler.GetProjectResource(project, resourceURI)
 	}
+}
+
+/**
+ * Lists all resources on project level. The resource handler of go-utils only lists stage and service resources
+ * so we page through /v1/project/PROJECT/resource ourselves
+ */
+func getAllProjectResources(resourceHandler *keptnapi.ResourceHandler, project string) ([]*keptnmodels.Resource, error) {
+	resources := []*keptnmodels.Resource{}
+	baseURL := resourceHandler.Scheme + "://" + resourceHandler.BaseURL + "/v1/project/" + url.PathEscape(project) + "/resource"
+
+	nextPageKey := ""
+	for {
+		listURL := baseURL
+		if nextPageKey != "" {
+			listURL += "?nextPageKey=" + url.QueryEscape(nextPageKey)
+		}
 
-	log.Printf(fmt.Sprintf("Downloaded %d and skipped %d files for %s in %s.%s.%s", fileCount, skippedFileCount, resourceUriFolderOfInterest, project, stage, service))
+		req, err := http.NewRequest("GET", listURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if resourceHandler.AuthHeader != "" && resourceHandler.AuthToken != "" {
+			req.Header.Set(resourceHandler.AuthHeader, resourceHandler.AuthToken)
+		}
+
+		resp, err := resourceHandler.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Listing resources of project %s failed with status %d: %s", project, resp.StatusCode, string(body))
+		}
 
-	return fileCount, nil
+		received := keptnmodels.Resources{}
+		err = json.Unmarshal(body, &received)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, received.Resources...)
+
+		if received.NextPageKey == "" || received.NextPageKey == "0" {
+			return resources, nil
+		}
+		nextPageKey = received.NextPageKey
+	}
 }
 
 /**
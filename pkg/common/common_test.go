@@ -0,0 +1,168 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	keptnmodels "github.com/keptn/go-utils/pkg/api/models"
+)
+
+const testMonacoConfigWithStages = `---
+spec_version: '0.1.0'
+dtCreds: dynatrace
+projects:
+  - monaco
+dryRun: true
+env:
+  OWNER: team-a
+  ALERTING: "off"
+stages:
+  production:
+    dtCreds: dynatrace-prod
+    dryRun: false
+    env:
+      ALERTING: "on"
+`
+
+// Tests that stage overrides are merged on top of the base settings of monaco.conf.yaml
+func TestMonacoConfigFileForStage(t *testing.T) {
+	monacoConfFile, err := parseMonacoConfigFile([]byte(testMonacoConfigWithStages))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := monacoConfFile.ForStage("dev")
+	if dev.DtCreds != "dynatrace" || !*dev.DryRun || dev.Env["ALERTING"] != "off" || dev.Stages != nil {
+		t.Errorf("Expected base settings for dev, got %+v", dev)
+	}
+
+	production := monacoConfFile.ForStage("production")
+	if production.DtCreds != "dynatrace-prod" || *production.DryRun {
+		t.Errorf("Expected overridden dtCreds and dryRun for production, got %+v", production)
+	}
+	if len(production.Projects) != 1 || production.Projects[0] != "monaco" {
+		t.Errorf("Expected base projects for production, got %v", production.Projects)
+	}
+	if production.Env["OWNER"] != "team-a" || production.Env["ALERTING"] != "on" {
+		t.Errorf("Expected merged env for production, got %v", production.Env)
+	}
+
+	// the base settings must not be modified
+	if monacoConfFile.Env["ALERTING"] != "off" {
+		t.Errorf("Base env was modified: %v", monacoConfFile.Env)
+	}
+}
+
+// fakeConfigurationService serves the listed resources per level the way Keptn's configuration-service does
+func fakeConfigurationService(t *testing.T, levels map[string]map[string]string) *httptest.Server {
+	prefixes := []string{
+		"/v1/project/sockshop/stage/dev/service/carts/resource",
+		"/v1/project/sockshop/stage/dev/resource",
+		"/v1/project/sockshop/resource",
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// stage and project events have no service or stage to look up
+		if strings.Contains(r.URL.Path, "//") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for _, prefix := range prefixes {
+			if !strings.HasPrefix(r.URL.Path, prefix) {
+				continue
+			}
+			resources := levels[prefix]
+			resourceURI := strings.TrimPrefix(r.URL.Path, prefix)
+
+			if resourceURI == "" || resourceURI == "/" {
+				list := keptnmodels.Resources{Resources: []*keptnmodels.Resource{}}
+				for uri := range resources {
+					uri := uri
+					list.Resources = append(list.Resources, &keptnmodels.Resource{ResourceURI: &uri})
+				}
+				json.NewEncoder(w).Encode(list)
+				return
+			}
+
+			content, ok := resources[resourceURI]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(keptnmodels.Resource{ResourceURI: &resourceURI, ResourceContent: base64.StdEncoding.EncodeToString([]byte(content))})
+			return
+		}
+		t.Errorf("Unexpected request %s", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+// Tests that files on service level override stage level which overrides project level
+func TestGetAllKeptnResources(t *testing.T) {
+	server := fakeConfigurationService(t, map[string]map[string]string{
+		"/v1/project/sockshop/resource": {
+			"/shipyard.yaml": "shipyard",
+			"/dynatrace/projects/infra/auto-tag/tags.yaml":       "project",
+			"/dynatrace/projects/infra/auto-tag/tags.json":       "project",
+			"/dynatrace/projects/infra/management-zone/mz.json":  "project",
+			"/dynatrace/projects/infra/management-zone/mz.yaml":  "project",
+			"/dynatrace/projects/infra/alerting-profile/ap.json": "project",
+		},
+		"/v1/project/sockshop/stage/dev/resource": {
+			"/dynatrace/projects/infra/auto-tag/tags.json":      "stage",
+			"/dynatrace/projects/infra/management-zone/mz.json": "stage",
+			// files of services are part of the stage listing
+			"/carts/dynatrace/projects/infra/auto-tag/tags.json": "service",
+			"/orders/dynatrace/projects/infra/auto-tag/x.json":   "orders",
+		},
+		"/v1/project/sockshop/stage/dev/service/carts/resource": {
+			"/dynatrace/projects/infra/auto-tag/tags.json": "service",
+		},
+	})
+	defer server.Close()
+	os.Setenv("CONFIGURATION_SERVICE", server.URL)
+	defer os.Unsetenv("CONFIGURATION_SERVICE")
+	defer os.RemoveAll("tmp")
+
+	provenance, err := GetAllKeptnResources("sockshop", "dev", "carts", true, "/dynatrace/projects/", "tmp/resources")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"infra/auto-tag/tags.yaml":       KeptnResourceLevelProject,
+		"infra/auto-tag/tags.json":       KeptnResourceLevelService,
+		"infra/management-zone/mz.json":  KeptnResourceLevelStage,
+		"infra/management-zone/mz.yaml":  KeptnResourceLevelProject,
+		"infra/alerting-profile/ap.json": KeptnResourceLevelProject,
+	}
+	if len(provenance) != len(expected) {
+		t.Errorf("Expected %d files but got %v", len(expected), provenance)
+	}
+	for file, level := range expected {
+		if provenance[file] != level {
+			t.Errorf("Expected %s from %s level but got %s", file, level, provenance[file])
+		}
+		content, _ := ioutil.ReadFile("tmp/resources/" + file)
+		if string(content) != level {
+			t.Errorf("Expected content of %s from %s level but got %s", file, level, content)
+		}
+	}
+}
+
+// Tests that two runs of the same keptn context and stage, e.g: of two services or a redelivered event, don't share a tmp folder
+func TestGetTempMonacoFolderRunID(t *testing.T) {
+	first := &BaseKeptnEvent{Context: "abc", Stage: "dev", RunID: NewRunID("event-1")}
+	second := &BaseKeptnEvent{Context: "abc", Stage: "dev", RunID: NewRunID("event-1")}
+	if GetTempMonacoFolder(first) == GetTempMonacoFolder(second) {
+		t.Errorf("Expected separate tmp folders, got %s", GetTempMonacoFolder(first))
+	}
+	if folder := GetTempMonacoFolder(&BaseKeptnEvent{Context: "abc", Stage: "dev"}); folder != MonacoBaseFolder+"abc-dev" {
+		t.Errorf("Unexpected tmp folder %s", folder)
+	}
+}
@@ -0,0 +1,348 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/**
+ * Schemes of dtCreds in monaco.conf.yaml, e.g:
+ * dynatrace                    -> Kubernetes secret dynatrace in the namespace of the pod
+ * k8s://other-ns/dynatrace     -> Kubernetes secret dynatrace in the namespace other-ns
+ * file:///creds/prod.yaml      -> JSON or YAML file with DT_TENANT and DT_API_TOKEN
+ * file:///var/run/secrets/dt   -> mounted folder with the files DT_TENANT and DT_API_TOKEN, e.g: a projected or CSI volume
+ * env://                       -> env variables DT_TENANT and DT_API_TOKEN, env://PROD for PROD_DT_TENANT and PROD_DT_API_TOKEN
+ */
+const CredentialSchemeKubernetes = "k8s"
+const CredentialSchemeFile = "file"
+const CredentialSchemeEnv = "env"
+
+const credentialKeyTenant = "DT_TENANT"
+const credentialKeyApiToken = "DT_API_TOKEN"
+const credentialKeyClientID = "DT_CLIENT_ID"
+const credentialKeyClientSecret = "DT_CLIENT_SECRET"
+const credentialKeyTokenEndpoint = "DT_TOKEN_ENDPOINT"
+const credentialKeyPlatformToken = "DT_PLATFORM_TOKEN"
+
+// keys read by the credential providers, all but DT_TENANT are optional as long as there is a token or an OAuth client
+var credentialKeys = []string{credentialKeyTenant, credentialKeyApiToken, credentialKeyClientID, credentialKeyClientSecret, credentialKeyTokenEndpoint, credentialKeyPlatformToken}
+
+/**
+ * Secrets that are searched for the Dynatrace credentials if no tenants are configured, after dtCreds of monaco.conf.yaml.
+ * The order and the namespaces can be changed with credentialSearchOrder and credentialNamespaces in monaco.conf.yaml
+ * or the comma separated env variables DT_CREDENTIALS_SEARCH_ORDER and DT_CREDENTIALS_NAMESPACES
+ */
+var DefaultCredentialSearchOrder = []string{"dynatrace-credentials-$PROJECT-$STAGE", "dynatrace-credentials-$PROJECT", "dynatrace-credentials", "dynatrace"}
+
+const CredentialSearchOrderEnv = "DT_CREDENTIALS_SEARCH_ORDER"
+const CredentialNamespacesEnv = "DT_CREDENTIALS_NAMESPACES"
+
+/**
+ * dtCreds and credentialNamespaces come from the Keptn repo, so the service only reads what the operator allows with env variables:
+ * secrets of the namespace of the pod and the comma separated namespaces of DT_CREDENTIALS_NAMESPACES and DT_CREDENTIALS_ALLOWED_NAMESPACES,
+ * and file:// credentials below the folder DT_CREDENTIALS_FILE_DIR. Without DT_CREDENTIALS_FILE_DIR file:// is disabled
+ */
+const CredentialAllowedNamespacesEnv = "DT_CREDENTIALS_ALLOWED_NAMESPACES"
+const CredentialFileDirEnv = "DT_CREDENTIALS_FILE_DIR"
+
+// CredentialSearchError lists every credential source that was tried and why it couldn't be used
+type CredentialSearchError struct {
+	Failures []string
+}
+
+func (e *CredentialSearchError) Error() string {
+	return "Could not find Dynatrace credentials, tried:\n- " + strings.Join(e.Failures, "\n- ")
+}
+
+// CredentialProvider provides the Dynatrace credentials of a tenant
+type CredentialProvider interface {
+	GetCredentials() (*DTCredentials, error)
+}
+
+// KubernetesCredentialProvider reads the credentials from a Kubernetes secret
+type KubernetesCredentialProvider struct {
+	Namespace  string
+	SecretName string
+}
+
+// FileCredentialProvider reads the credentials from a JSON or YAML file
+type FileCredentialProvider struct {
+	Path string
+}
+
+// MountedCredentialProvider reads the credentials from a folder with one file per key, e.g: a mounted Kubernetes secret
+type MountedCredentialProvider struct {
+	Path string
+}
+
+// EnvCredentialProvider reads the credentials from the env variables DT_TENANT and DT_API_TOKEN, optionally with a prefix, e.g: PROD_DT_TENANT
+type EnvCredentialProvider struct {
+	Prefix string
+}
+
+/**
+ * Returns the CredentialProvider for dtCreds. Names without scheme are Kubernetes secrets in the namespace of the pod,
+ * in RunLocal mode they are read from the env variables DT_TENANT and DT_API_TOKEN
+ */
+func NewCredentialProvider(dtCreds string) (CredentialProvider, error) {
+	if !strings.Contains(dtCreds, "://") {
+		if RunLocal || RunLocalTest {
+			return &EnvCredentialProvider{}, nil
+		}
+		return &KubernetesCredentialProvider{Namespace: namespace, SecretName: dtCreds}, nil
+	}
+
+	credsURL, err := url.Parse(dtCreds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dtCreds %s: %v", dtCreds, err)
+	}
+
+	switch credsURL.Scheme {
+	case CredentialSchemeKubernetes:
+		// k8s://namespace/secret or k8s://secret
+		secretName := strings.Trim(credsURL.Path, "/")
+		if secretName == "" {
+			return &KubernetesCredentialProvider{Namespace: namespace, SecretName: credsURL.Host}, nil
+		}
+		if strings.Contains(secretName, "/") {
+			return nil, fmt.Errorf("invalid dtCreds %s, use k8s://namespace/secret", dtCreds)
+		}
+		return &KubernetesCredentialProvider{Namespace: credsURL.Host, SecretName: secretName}, nil
+	case CredentialSchemeFile:
+		if credsURL.Host != "" {
+			return nil, fmt.Errorf("invalid dtCreds %s, use file:///absolute/path", dtCreds)
+		}
+		err = checkCredentialFileAllowed(credsURL.Path)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(credsURL.Path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read credentials %s: %v", credsURL.Path, err)
+		}
+		if info.IsDir() {
+			return &MountedCredentialProvider{Path: credsURL.Path}, nil
+		}
+		return &FileCredentialProvider{Path: credsURL.Path}, nil
+	case CredentialSchemeEnv:
+		return &EnvCredentialProvider{Prefix: credsURL.Host}, nil
+	}
+	return nil, fmt.Errorf("unknown scheme %s of dtCreds %s, use %s://, %s:// or %s://", credsURL.Scheme, dtCreds, CredentialSchemeKubernetes, CredentialSchemeFile, CredentialSchemeEnv)
+}
+
+func (provider *KubernetesCredentialProvider) GetCredentials() (*DTCredentials, error) {
+	err := checkCredentialNamespaceAllowed(provider.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := readKubernetesSecret(provider.Namespace, provider.SecretName)
+	if err != nil {
+		return nil, err
+	}
+	return newDTCredentials(secret, "secret "+provider.Namespace+"/"+provider.SecretName)
+}
+
+func (provider *FileCredentialProvider) GetCredentials() (*DTCredentials, error) {
+	content, err := ioutil.ReadFile(provider.Path)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving Dynatrace credentials: %v", err)
+	}
+
+	values := map[string]string{}
+	if strings.ToLower(filepath.Ext(provider.Path)) == ".json" {
+		err = json.Unmarshal(content, &values)
+	} else {
+		err = yaml.Unmarshal(content, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing Dynatrace credentials %s: %v", provider.Path, err)
+	}
+	return newDTCredentials(values, provider.Path)
+}
+
+func (provider *MountedCredentialProvider) GetCredentials() (*DTCredentials, error) {
+	values := map[string]string{}
+	for _, key := range credentialKeys {
+		content, err := ioutil.ReadFile(filepath.Join(provider.Path, key))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("error retrieving Dynatrace credentials: %v", err)
+		}
+		values[key] = strings.TrimSpace(string(content))
+	}
+	return newDTCredentials(values, provider.Path)
+}
+
+func (provider *EnvCredentialProvider) GetCredentials() (*DTCredentials, error) {
+	prefix := ""
+	if provider.Prefix != "" {
+		prefix = provider.Prefix + "_"
+	}
+	values := map[string]string{}
+	for _, key := range credentialKeys {
+		values[key] = os.Getenv(prefix + key)
+	}
+	return newDTCredentials(values, "env variables "+prefix+"DT_*")
+}
+
+/**
+ * Validates the credentials and ensures the tenant URL always has http or https in front.
+ * Besides DT_TENANT an API token, a platform token or an OAuth client (DT_CLIENT_ID and DT_CLIENT_SECRET) is required
+ */
+func newDTCredentials(values map[string]string, source string) (*DTCredentials, error) {
+	dtCreds := &DTCredentials{
+		Tenant:        values[credentialKeyTenant],
+		ApiToken:      values[credentialKeyApiToken],
+		ClientID:      values[credentialKeyClientID],
+		ClientSecret:  values[credentialKeyClientSecret],
+		TokenEndpoint: values[credentialKeyTokenEndpoint],
+		PlatformToken: values[credentialKeyPlatformToken],
+	}
+
+	// grabnerandi: remove check on DT_PAAS_TOKEN as it is not relevant for quality-gate-only use case
+	if dtCreds.Tenant == "" {
+		return nil, fmt.Errorf("missing key %s in %s", credentialKeyTenant, source)
+	}
+	if dtCreds.ApiToken == "" && dtCreds.PlatformToken == "" && dtCreds.ClientID == "" {
+		return nil, fmt.Errorf("missing key %s (or %s & %s or %s) in %s", credentialKeyApiToken, credentialKeyClientID, credentialKeyClientSecret, credentialKeyPlatformToken, source)
+	}
+	if dtCreds.ClientID != "" && dtCreds.ClientSecret == "" {
+		return nil, fmt.Errorf("missing key %s for %s in %s", credentialKeyClientSecret, credentialKeyClientID, source)
+	}
+	if dtCreds.ClientID == "" && dtCreds.ClientSecret != "" {
+		return nil, fmt.Errorf("missing key %s for %s in %s", credentialKeyClientID, credentialKeyClientSecret, source)
+	}
+
+	if !strings.HasPrefix(dtCreds.Tenant, "https://") && !strings.HasPrefix(dtCreds.Tenant, "http://") {
+		dtCreds.Tenant = "https://" + dtCreds.Tenant
+	}
+	if dtCreds.ClientID != "" && dtCreds.TokenEndpoint == "" {
+		dtCreds.TokenEndpoint = DefaultOAuthTokenEndpoint
+	}
+
+	AddMaskedSecret(dtCreds.ApiToken)
+	AddMaskedSecret(dtCreds.ClientSecret)
+	AddMaskedSecret(dtCreds.PlatformToken)
+	return dtCreds, nil
+}
+
+// returns the configured values, otherwise the comma separated values of the env variable, otherwise the defaults
+func configuredOrEnv(configured []string, envName string, defaults []string) []string {
+	if len(configured) > 0 {
+		return configured
+	}
+	values := []string{}
+	for _, value := range strings.Split(os.Getenv(envName), ",") {
+		if strings.TrimSpace(value) != "" {
+			values = append(values, strings.TrimSpace(value))
+		}
+	}
+	if len(values) > 0 {
+		return values
+	}
+	return defaults
+}
+
+// returns an error unless the namespace is the namespace of the pod or one of DT_CREDENTIALS_NAMESPACES or DT_CREDENTIALS_ALLOWED_NAMESPACES
+func checkCredentialNamespaceAllowed(secretNamespace string) error {
+	allowed := append(configuredOrEnv(nil, CredentialNamespacesEnv, nil), configuredOrEnv(nil, CredentialAllowedNamespacesEnv, nil)...)
+	for _, allowedNamespace := range append(allowed, namespace) {
+		if secretNamespace == allowedNamespace {
+			return nil
+		}
+	}
+	return fmt.Errorf("secrets of namespace %s are not allowed, add it to the env variable %s of the monaco-service", secretNamespace, CredentialAllowedNamespacesEnv)
+}
+
+// returns an error unless the path is below DT_CREDENTIALS_FILE_DIR, symlinks are resolved so they can't point outside of it
+func checkCredentialFileAllowed(path string) error {
+	fileDir := os.Getenv(CredentialFileDirEnv)
+	if fileDir == "" {
+		return fmt.Errorf("file:// credentials are disabled, set the env variable %s of the monaco-service to the folder of the credential files", CredentialFileDirEnv)
+	}
+	resolvedDir, err := filepath.EvalSymlinks(fileDir)
+	if err != nil {
+		return fmt.Errorf("could not read %s %s: %v", CredentialFileDirEnv, fileDir, err)
+	}
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("could not read credentials %s: %v", path, err)
+	}
+	relativePath, err := filepath.Rel(resolvedDir, resolvedPath)
+	if err != nil || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("credentials %s are not allowed, only files below %s (%s) can be used", path, fileDir, CredentialFileDirEnv)
+	}
+	return nil
+}
+
+/**
+ * Returns the secrets searched for the Dynatrace credentials: dtCreds followed by credentialSearchOrder of monaco.conf.yaml,
+ * DT_CREDENTIALS_SEARCH_ORDER or DefaultCredentialSearchOrder
+ */
+func GetCredentialSearchOrder(monacoConfigFile *MonacoConfigFile, dtCreds string) []string {
+	candidates := []string{}
+	if dtCreds != "" {
+		candidates = append(candidates, dtCreds)
+	}
+	return append(candidates, configuredOrEnv(monacoConfigFile.CredentialSearchOrder, CredentialSearchOrderEnv, DefaultCredentialSearchOrder)...)
+}
+
+// Returns the namespaces searched for the secrets: credentialNamespaces of monaco.conf.yaml, DT_CREDENTIALS_NAMESPACES or the namespace of the pod
+func GetCredentialNamespaces(monacoConfigFile *MonacoConfigFile) []string {
+	return configuredOrEnv(monacoConfigFile.CredentialNamespaces, CredentialNamespacesEnv, []string{namespace})
+}
+
+/**
+ * Returns the first Dynatrace credentials found. The candidates can contain placeholders, e.g: dynatrace-credentials-$PROJECT-$STAGE.
+ * Secret names are searched in every namespace, URIs like file:///creds/prod.yaml are used as they are.
+ * Returns a CredentialSearchError with the reason of every candidate if none could be used
+ */
+func FindDTCredentials(candidates []string, namespaces []string, keptnEvent *BaseKeptnEvent) (*DTCredentials, error) {
+	searchErr := &CredentialSearchError{}
+	tried := map[string]bool{}
+
+	for _, candidate := range candidates {
+		name, err := RenderKeptnPlaceholders(candidate, keptnEvent, PlaceholderEscapeNone)
+		if err != nil {
+			searchErr.Failures = append(searchErr.Failures, fmt.Sprintf("%s: %v", candidate, err))
+			continue
+		}
+
+		providers := []CredentialProvider{}
+		if strings.Contains(name, "://") || RunLocal || RunLocalTest {
+			provider, err := NewCredentialProvider(name)
+			if err != nil {
+				searchErr.Failures = append(searchErr.Failures, err.Error())
+				continue
+			}
+			providers = append(providers, provider)
+		} else {
+			for _, secretNamespace := range namespaces {
+				providers = append(providers, &KubernetesCredentialProvider{Namespace: secretNamespace, SecretName: name})
+			}
+		}
+
+		for _, provider := range providers {
+			key := fmt.Sprintf("%#v", provider)
+			if tried[key] {
+				continue
+			}
+			tried[key] = true
+
+			dtCredentials, err := provider.GetCredentials()
+			if err == nil {
+				log.Printf("Using Dynatrace credentials of %s (%s)\n", name, dtCredentials.Tenant)
+				return dtCredentials, nil
+			}
+			searchErr.Failures = append(searchErr.Failures, err.Error())
+		}
+	}
+	return nil, searchErr
+}
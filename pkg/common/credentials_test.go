@@ -0,0 +1,230 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewCredentialProvider(t *testing.T) {
+	credsFolder, err := ioutil.TempDir("", "monaco-creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(credsFolder)
+	credsFile := filepath.Join(credsFolder, "prod.yaml")
+	ioutil.WriteFile(credsFile, []byte("DT_TENANT: abc12345.live.dynatrace.com\nDT_API_TOKEN: dt0c01.prod\n"), 0644)
+	os.Setenv(CredentialFileDirEnv, credsFolder)
+	defer os.Unsetenv(CredentialFileDirEnv)
+
+	runLocalTest := RunLocalTest
+	RunLocalTest = false
+	defer func() { RunLocalTest = runLocalTest }()
+
+	tests := []struct {
+		dtCreds  string
+		expected CredentialProvider
+	}{
+		{"dynatrace", &KubernetesCredentialProvider{Namespace: namespace, SecretName: "dynatrace"}},
+		{"k8s://dynatrace-prod", &KubernetesCredentialProvider{Namespace: namespace, SecretName: "dynatrace-prod"}},
+		{"k8s://other-ns/dynatrace", &KubernetesCredentialProvider{Namespace: "other-ns", SecretName: "dynatrace"}},
+		{"file://" + credsFile, &FileCredentialProvider{Path: credsFile}},
+		{"file://" + credsFolder, &MountedCredentialProvider{Path: credsFolder}},
+		{"env://", &EnvCredentialProvider{}},
+		{"env://PROD", &EnvCredentialProvider{Prefix: "PROD"}},
+	}
+	for _, test := range tests {
+		provider, err := NewCredentialProvider(test.dtCreds)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.dtCreds, err)
+			continue
+		}
+		if !credentialProvidersEqual(provider, test.expected) {
+			t.Errorf("Expected %#v for %s, got %#v", test.expected, test.dtCreds, provider)
+		}
+	}
+
+	for _, dtCreds := range []string{"vault://dynatrace", "k8s://ns/dynatrace/x", "file://relative/prod.yaml", "file:///not/existing.yaml"} {
+		_, err := NewCredentialProvider(dtCreds)
+		if err == nil {
+			t.Errorf("Expected an error for %s", dtCreds)
+		}
+	}
+}
+
+// Tests that file:// credentials outside of DT_CREDENTIALS_FILE_DIR and secrets of namespaces that are not allowed are rejected
+func TestCredentialAllowLists(t *testing.T) {
+	tmpFolder, err := ioutil.TempDir("", "monaco-creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpFolder)
+	credsFolder := filepath.Join(tmpFolder, "creds")
+	os.Mkdir(credsFolder, 0755)
+	ioutil.WriteFile(filepath.Join(credsFolder, "prod.yaml"), []byte("DT_TENANT: abc12345.live.dynatrace.com\n"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpFolder, "other.yaml"), []byte("DT_TENANT: abc12345.live.dynatrace.com\n"), 0644)
+	os.Symlink(filepath.Join(tmpFolder, "other.yaml"), filepath.Join(credsFolder, "link.yaml"))
+
+	_, err = NewCredentialProvider("file://" + filepath.Join(credsFolder, "prod.yaml"))
+	if err == nil || !strings.Contains(err.Error(), CredentialFileDirEnv) {
+		t.Errorf("Expected file:// to be disabled without %s, got %v", CredentialFileDirEnv, err)
+	}
+
+	os.Setenv(CredentialFileDirEnv, credsFolder)
+	defer os.Unsetenv(CredentialFileDirEnv)
+	_, err = NewCredentialProvider("file://" + filepath.Join(credsFolder, "prod.yaml"))
+	if err != nil {
+		t.Errorf("Unexpected error for a file below %s: %v", CredentialFileDirEnv, err)
+	}
+	for _, path := range []string{"/etc/passwd", filepath.Join(credsFolder, "..", "other.yaml"), filepath.Join(credsFolder, "link.yaml"), tmpFolder} {
+		_, err = NewCredentialProvider("file://" + path)
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("Expected %s to be rejected, got %v", path, err)
+		}
+	}
+
+	os.Setenv(CredentialNamespacesEnv, "dynatrace")
+	defer os.Unsetenv(CredentialNamespacesEnv)
+	os.Setenv(CredentialAllowedNamespacesEnv, "team-a, team-b")
+	defer os.Unsetenv(CredentialAllowedNamespacesEnv)
+	for _, secretNamespace := range []string{namespace, "dynatrace", "team-a", "team-b"} {
+		if err := checkCredentialNamespaceAllowed(secretNamespace); err != nil {
+			t.Errorf("Expected namespace %s to be allowed, got %v", secretNamespace, err)
+		}
+	}
+	_, err = (&KubernetesCredentialProvider{Namespace: "kube-system", SecretName: "dynatrace"}).GetCredentials()
+	if err == nil || !strings.Contains(err.Error(), CredentialAllowedNamespacesEnv) {
+		t.Errorf("Expected secrets of kube-system to be rejected, got %v", err)
+	}
+}
+
+func credentialProvidersEqual(a CredentialProvider, b CredentialProvider) bool {
+	switch expected := b.(type) {
+	case *KubernetesCredentialProvider:
+		actual, ok := a.(*KubernetesCredentialProvider)
+		return ok && *actual == *expected
+	case *FileCredentialProvider:
+		actual, ok := a.(*FileCredentialProvider)
+		return ok && *actual == *expected
+	case *MountedCredentialProvider:
+		actual, ok := a.(*MountedCredentialProvider)
+		return ok && *actual == *expected
+	case *EnvCredentialProvider:
+		actual, ok := a.(*EnvCredentialProvider)
+		return ok && *actual == *expected
+	}
+	return false
+}
+
+func TestCredentialProviders(t *testing.T) {
+	credsFolder, err := ioutil.TempDir("", "monaco-creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(credsFolder)
+
+	ioutil.WriteFile(filepath.Join(credsFolder, "prod.yaml"), []byte("DT_TENANT: abc12345.live.dynatrace.com\nDT_API_TOKEN: dt0c01.yaml\n"), 0644)
+	ioutil.WriteFile(filepath.Join(credsFolder, "prod.json"), []byte(`{"DT_TENANT": "http://localhost:8080", "DT_API_TOKEN": "dt0c01.json"}`), 0644)
+	mountedFolder := filepath.Join(credsFolder, "mounted")
+	os.Mkdir(mountedFolder, 0755)
+	ioutil.WriteFile(filepath.Join(mountedFolder, "DT_TENANT"), []byte("abc12345.live.dynatrace.com\n"), 0644)
+	ioutil.WriteFile(filepath.Join(mountedFolder, "DT_API_TOKEN"), []byte("dt0c01.mounted\n"), 0644)
+	os.Setenv("MONACOTEST_DT_TENANT", "https://abc12345.live.dynatrace.com")
+	os.Setenv("MONACOTEST_DT_API_TOKEN", "dt0c01.env")
+	defer os.Unsetenv("MONACOTEST_DT_TENANT")
+	defer os.Unsetenv("MONACOTEST_DT_API_TOKEN")
+
+	tests := []struct {
+		provider CredentialProvider
+		expected DTCredentials
+	}{
+		{&FileCredentialProvider{Path: filepath.Join(credsFolder, "prod.yaml")}, DTCredentials{Tenant: "https://abc12345.live.dynatrace.com", ApiToken: "dt0c01.yaml"}},
+		{&FileCredentialProvider{Path: filepath.Join(credsFolder, "prod.json")}, DTCredentials{Tenant: "http://localhost:8080", ApiToken: "dt0c01.json"}},
+		{&MountedCredentialProvider{Path: mountedFolder}, DTCredentials{Tenant: "https://abc12345.live.dynatrace.com", ApiToken: "dt0c01.mounted"}},
+		{&EnvCredentialProvider{Prefix: "MONACOTEST"}, DTCredentials{Tenant: "https://abc12345.live.dynatrace.com", ApiToken: "dt0c01.env"}},
+	}
+	for _, test := range tests {
+		dtCreds, err := test.provider.GetCredentials()
+		if err != nil {
+			t.Errorf("Unexpected error for %#v: %v", test.provider, err)
+			continue
+		}
+		if *dtCreds != test.expected {
+			t.Errorf("Expected %v for %#v, got %v", test.expected, test.provider, *dtCreds)
+		}
+	}
+
+	os.Remove(filepath.Join(mountedFolder, "DT_API_TOKEN"))
+	_, err = (&MountedCredentialProvider{Path: mountedFolder}).GetCredentials()
+	if err == nil || !strings.Contains(err.Error(), "DT_API_TOKEN") {
+		t.Errorf("Expected an error for the missing token, got %v", err)
+	}
+}
+
+// Tests that the first usable credentials are returned and the error lists why every candidate failed
+func TestFindDTCredentials(t *testing.T) {
+	credsFolder, err := ioutil.TempDir("", "monaco-creds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(credsFolder)
+	ioutil.WriteFile(filepath.Join(credsFolder, "sockshop.yaml"), []byte("DT_TENANT: abc12345.live.dynatrace.com\n"), 0644)
+	os.Setenv(CredentialFileDirEnv, credsFolder)
+	defer os.Unsetenv(CredentialFileDirEnv)
+	os.Setenv("sockshop_dev_DT_TENANT", "dev.live.dynatrace.com")
+	os.Setenv("sockshop_dev_DT_API_TOKEN", "dt0c01.dev")
+	defer os.Unsetenv("sockshop_dev_DT_TENANT")
+	defer os.Unsetenv("sockshop_dev_DT_API_TOKEN")
+
+	keptnEvent := &BaseKeptnEvent{Project: "sockshop", Stage: "dev"}
+	candidates := []string{"dynatrace-$LABEL.team", "file://" + credsFolder + "/$PROJECT.yaml", "env://MISSING", "env://{{ .Keptn.Project }}_{{ .Keptn.Stage }}"}
+
+	dtCredentials, err := FindDTCredentials(candidates, []string{"keptn"}, keptnEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dtCredentials.Tenant != "https://dev.live.dynatrace.com" {
+		t.Errorf("Expected the credentials of the last candidate, got %s", dtCredentials.Tenant)
+	}
+
+	_, err = FindDTCredentials(candidates[:3], []string{"keptn"}, keptnEvent)
+	searchErr, ok := err.(*CredentialSearchError)
+	if !ok || len(searchErr.Failures) != 3 {
+		t.Fatalf("Expected a failure for every candidate, got %v", err)
+	}
+	expected := []string{"dynatrace-$LABEL.team: ", "missing key DT_API_TOKEN (or DT_CLIENT_ID & DT_CLIENT_SECRET or DT_PLATFORM_TOKEN) in " + credsFolder + "/sockshop.yaml", "missing key DT_TENANT in env variables MISSING_DT_*"}
+	for i, failure := range searchErr.Failures {
+		if !strings.HasPrefix(failure, expected[i]) {
+			t.Errorf("Expected failure %s, got %s", expected[i], failure)
+		}
+	}
+}
+
+func TestGetCredentialSearchOrder(t *testing.T) {
+	monacoConfigFile := &MonacoConfigFile{}
+	if order := GetCredentialSearchOrder(monacoConfigFile, "dynatrace-prod"); len(order) != 5 || order[0] != "dynatrace-prod" || order[1] != DefaultCredentialSearchOrder[0] {
+		t.Errorf("Expected dtCreds followed by the default order, got %v", order)
+	}
+
+	os.Setenv(CredentialSearchOrderEnv, "dynatrace-$STAGE, dynatrace")
+	os.Setenv(CredentialNamespacesEnv, "keptn,dynatrace")
+	defer os.Unsetenv(CredentialSearchOrderEnv)
+	defer os.Unsetenv(CredentialNamespacesEnv)
+	if order := GetCredentialSearchOrder(monacoConfigFile, ""); len(order) != 2 || order[0] != "dynatrace-$STAGE" {
+		t.Errorf("Expected the order of %s, got %v", CredentialSearchOrderEnv, order)
+	}
+	if namespaces := GetCredentialNamespaces(monacoConfigFile); len(namespaces) != 2 || namespaces[1] != "dynatrace" {
+		t.Errorf("Expected the namespaces of %s, got %v", CredentialNamespacesEnv, namespaces)
+	}
+
+	monacoConfigFile.CredentialSearchOrder = []string{"dynatrace-credentials-$PROJECT"}
+	monacoConfigFile.CredentialNamespaces = []string{"other-ns"}
+	if order := GetCredentialSearchOrder(monacoConfigFile, ""); len(order) != 1 || order[0] != "dynatrace-credentials-$PROJECT" {
+		t.Errorf("Expected the order of monaco.conf.yaml, got %v", order)
+	}
+	if namespaces := GetCredentialNamespaces(monacoConfigFile); len(namespaces) != 1 || namespaces[0] != "other-ns" {
+		t.Errorf("Expected the namespaces of monaco.conf.yaml, got %v", namespaces)
+	}
+}
@@ -0,0 +1,145 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"text/template"
+)
+
+/**
+ * Built-in monaco project that is used by configure-monitoring when no monaco bundle was uploaded for the project.
+ * It creates one auto-tag keptn_stage and one management zone per stage, both based on the Kubernetes namespace
+ * that Keptn deploys to (PROJECT-STAGE)
+ */
+const defaultAutoTagYaml = `config:
+    - keptn-stage: "keptn-stage.json"
+
+keptn-stage:
+    - name: "keptn_stage"
+`
+
+// the rules are rendered by us, only {{ .name }} is left for monaco
+const defaultAutoTagJson = `{
+    "name": "{{"{{"}} .name {{"}}"}}",
+    "rules": [{{ range $i, $stage := .Stages }}{{ if $i }},{{ end }}
+      {
+        "type": "SERVICE",
+        "enabled": true,
+        "valueFormat": "{{ $stage }}",
+        "propagationTypes": [],
+        "conditions": [
+          {
+            "key": {
+              "attribute": "PROCESS_GROUP_PREDEFINED_METADATA",
+              "dynamicKey": "KUBERNETES_NAMESPACE",
+              "type": "PROCESS_PREDEFINED_METADATA_KEY"
+            },
+            "comparisonInfo": {
+              "type": "STRING",
+              "operator": "EQUALS",
+              "value": "{{ $.Project }}-{{ $stage }}",
+              "negate": false,
+              "caseSensitive": true
+            }
+          }
+        ]
+      }{{ end }}
+    ]
+}
+`
+
+const defaultManagementZoneYaml = `config:{{ range .Stages }}
+    - mz-{{ . }}: "management-zone.json"{{ end }}
+{{ range .Stages }}
+mz-{{ . }}:
+    - name: "Keptn: {{ $.Project }} {{ . }}"
+    - namespace: "{{ $.Project }}-{{ . }}"
+{{ end }}`
+
+const defaultManagementZoneJson = `{
+    "name": "{{ .name }}",
+    "rules": [
+        {
+            "type": "SERVICE",
+            "enabled": true,
+            "propagationTypes": [],
+            "conditions": [
+                {
+                    "key": {
+                        "attribute": "PROCESS_GROUP_PREDEFINED_METADATA",
+                        "dynamicKey": "KUBERNETES_NAMESPACE",
+                        "type": "PROCESS_PREDEFINED_METADATA_KEY"
+                    },
+                    "comparisonInfo": {
+                        "type": "STRING",
+                        "operator": "EQUALS",
+                        "value": "{{ .namespace }}",
+                        "negate": false,
+                        "caseSensitive": true
+                    }
+                }
+            ]
+        }
+    ]
+}
+`
+
+type defaultMonacoProjectValues struct {
+	Project string
+	Stages  []string
+}
+
+/**
+ * Writes the built-in default monaco project for the Keptn project into the temp folder of the current run, e.g:
+ * tmp/monaco/KEPTNCONTEXT-STAGE/projects/PROJECT/auto-tag and tmp/monaco/KEPTNCONTEXT-STAGE/projects/PROJECT/management-zone
+ */
+func WriteDefaultMonacoProject(keptnEvent *BaseKeptnEvent, stages []string) error {
+	if len(stages) == 0 {
+		return errors.New("Cannot create default monaco project without any stages")
+	}
+
+	values := defaultMonacoProjectValues{Project: keptnEvent.Project, Stages: stages}
+	projectFolder := fmt.Sprintf("%s/%s/%s", GetTempMonacoFolder(keptnEvent), MonacoProjectsSubfolder, keptnEvent.Project)
+
+	files := map[string]string{
+		"auto-tag/auto-tag.yaml":               defaultAutoTagYaml,
+		"auto-tag/keptn-stage.json":            defaultAutoTagJson,
+		"management-zone/management-zone.yaml": defaultManagementZoneYaml,
+		"management-zone/management-zone.json": defaultManagementZoneJson,
+	}
+
+	for fileName, content := range files {
+		// the management zone json template is passed to monaco as is
+		if fileName != "management-zone/management-zone.json" {
+			rendered, err := renderDefaultTemplate(fileName, content, values)
+			if err != nil {
+				return err
+			}
+			content = rendered
+		}
+
+		_, err := storeFile(projectFolder, fileName, content, true)
+		if err != nil {
+			return fmt.Errorf("Error writing default monaco file %s: %v", fileName, err)
+		}
+	}
+
+	log.Printf("Created default monaco project %s for stages %v", keptnEvent.Project, stages)
+	return nil
+}
+
+func renderDefaultTemplate(name string, content string, values defaultMonacoProjectValues) (string, error) {
+	tmpl, err := template.New(name).Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing default monaco template %s: %v", name, err)
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, values)
+	if err != nil {
+		return "", fmt.Errorf("Error rendering default monaco template %s: %v", name, err)
+	}
+	return buffer.String(), nil
+}
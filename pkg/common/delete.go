@@ -0,0 +1,283 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/**
+ * Support for the monaco (v1) delete.yaml in the root of the projects folder, e.g:
+ * delete:
+ *   - "auto-tag/my-old-tag"
+ *   - "dashboard/My Dashboard"
+ * Every entry is CONFIGTYPE/NAME where NAME is the name of the config in Dynatrace
+ */
+const MonacoDeleteFilename = "delete.yaml"
+
+// Keptn resource folder the deployed configs are tracked in, one file per tenant on stage level
+const MonacoStateFolder = "dynatrace/monaco-state"
+
+// MonacoDeleteEntry is a config that is deleted from Dynatrace
+type MonacoDeleteEntry struct {
+	// Service is the Keptn service of the run that deployed the config, empty for runs without service
+	Service    string `json:"service,omitempty"`
+	Project    string `json:"project,omitempty"`
+	ConfigType string `json:"configType"`
+	ConfigName string `json:"configName,omitempty"`
+	// Name is the name of the config in Dynatrace
+	Name string `json:"name"`
+}
+
+// MonacoState are the configs the monaco-service deployed to a tenant for the services of a stage
+type MonacoState struct {
+	// Tenant is the Dynatrace environment URL the configs were deployed to
+	Tenant  string               `json:"tenant"`
+	Configs []*MonacoDeleteEntry `json:"configs"`
+}
+
+/**
+ * Loads the delete.yaml from the projects folder of the keptn context
+ * Returns nil if there is no delete.yaml
+ */
+func LoadMonacoDeleteFile(keptnEvent *BaseKeptnEvent) ([]*MonacoDeleteEntry, error) {
+	deleteFile := filepath.Join(GetMonacoProjectsFolder(keptnEvent), MonacoDeleteFilename)
+	content, err := ioutil.ReadFile(deleteFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := struct {
+		Delete []string `yaml:"delete"`
+	}{}
+	err = yaml.Unmarshal(content, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", deleteFile, err)
+	}
+
+	entries := []*MonacoDeleteEntry{}
+	for _, entry := range parsed.Delete {
+		configTypeAndName := strings.SplitN(entry, "/", 2)
+		if len(configTypeAndName) != 2 || configTypeAndName[0] == "" || configTypeAndName[1] == "" {
+			return nil, fmt.Errorf("Invalid entry '%s' in %s, use CONFIGTYPE/NAME", entry, deleteFile)
+		}
+		entries = append(entries, &MonacoDeleteEntry{ConfigType: configTypeAndName[0], Name: configTypeAndName[1]})
+	}
+	return entries, nil
+}
+
+/**
+ * Deletes the configs with the name and config type of the entries from Dynatrace. Configs that don't exist are skipped.
+ * In dryrun mode the entries are only validated
+ */
+func DeleteMonacoConfigs(dtCredentials *DTCredentials, entries []*MonacoDeleteEntry, dryrun bool, httpClient *http.Client) (*MonacoDeploymentReport, error) {
+	report := &MonacoDeploymentReport{Configs: []*MonacoConfigResult{}}
+	client := NewDynatraceClient(dtCredentials, httpClient)
+	existingConfigs := map[string][]DynatraceConfigObject{}
+	failedCount := 0
+
+	for _, entry := range entries {
+		result := &MonacoConfigResult{Project: entry.Project, ConfigType: entry.ConfigType, ConfigName: entry.ConfigName, Action: MonacoActionSkipped}
+		if result.ConfigName == "" {
+			result.ConfigName = entry.Name
+		}
+		report.Configs = append(report.Configs, result)
+
+		err := deleteMonacoConfig(client, entry, dryrun, existingConfigs, result)
+		if err != nil {
+			result.Action = MonacoActionFailed
+			result.Error = err.Error()
+			failedCount++
+			log.Printf("Failed to delete %s/%s: %v", entry.ConfigType, entry.Name, err)
+		}
+	}
+
+	if failedCount > 0 {
+		return report, fmt.Errorf("%d of %d configs could not be deleted", failedCount, len(entries))
+	}
+	return report, nil
+}
+
+func deleteMonacoConfig(client *DynatraceClient, entry *MonacoDeleteEntry, dryrun bool, existingConfigs map[string][]DynatraceConfigObject, result *MonacoConfigResult) error {
+	apiPath, ok := MonacoConfigApis[entry.ConfigType]
+	if !ok {
+		return fmt.Errorf("Config type %s is not supported", entry.ConfigType)
+	}
+	if dryrun {
+		return nil
+	}
+
+	if _, ok := existingConfigs[apiPath]; !ok {
+		configs, err := client.ListConfigs(apiPath)
+		if err != nil {
+			return err
+		}
+		existingConfigs[apiPath] = configs
+	}
+	for _, existing := range existingConfigs[apiPath] {
+		if existing.Name == entry.Name {
+			result.EntityID = existing.ID
+			result.Action = MonacoActionDeleted
+			return client.DeleteConfig(apiPath, existing.ID)
+		}
+	}
+	return nil
+}
+
+/**
+ * Returns the configs of the monaco (v1) projects with their rendered names, these are the configs a run deploys
+ */
+func GetMonacoProjectsState(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, additionalEnv map[string]string) (*MonacoState, error) {
+	if FileExists(GetMonacoManifestPath(keptnEvent)) {
+		return nil, fmt.Errorf("Tracking deployed configs is not supported for monaco v2 projects (%s)", MonacoManifestFilename)
+	}
+
+	configs, err := LoadMonacoProjects(GetMonacoProjectsFolder(keptnEvent), SplitMonacoProjects(projects))
+	if err != nil {
+		return nil, err
+	}
+
+	env := MonacoEnvironmentAsMap(GetMonacoEnvironment(dtCredentials, keptnEvent, additionalEnv))
+	state := &MonacoState{Tenant: dtCredentials.Tenant, Configs: []*MonacoDeleteEntry{}}
+	known := map[string]DynatraceConfigObject{}
+
+	for _, config := range configs {
+		_, name, err := RenderMonacoConfig(config, env, known)
+		if err != nil {
+			return nil, err
+		}
+		known[config.FullQualifiedId()] = DynatraceConfigObject{ID: config.FullQualifiedId(), Name: name}
+		state.Configs = append(state.Configs, &MonacoDeleteEntry{Service: keptnEvent.Service, Project: config.Project, ConfigType: config.ConfigType, ConfigName: config.ConfigId, Name: name})
+	}
+	return state, nil
+}
+
+/**
+ * Returns the configs of the previous state that a run of the service deployed but that are no longer part of the monaco projects.
+ * Only configs of the deployed projects are considered, all projects if no projects are passed.
+ * Configs that another service still deploys are no orphans
+ */
+func (state *MonacoState) Orphans(previous *MonacoState, service string, projects string) []*MonacoDeleteEntry {
+	owned := monacoStateOwner(service, projects)
+
+	current := map[string]bool{}
+	for _, config := range state.Configs {
+		current[config.ConfigType+"/"+config.Name] = true
+	}
+	for _, config := range previous.Configs {
+		if !owned(config) {
+			current[config.ConfigType+"/"+config.Name] = true
+		}
+	}
+
+	orphans := []*MonacoDeleteEntry{}
+	for _, config := range previous.Configs {
+		if owned(config) && !current[config.ConfigType+"/"+config.Name] {
+			orphans = append(orphans, config)
+		}
+	}
+	return orphans
+}
+
+/**
+ * Returns the state after a run of the service: the configs of the state and the configs of the previous state
+ * the run doesn't own, e.g: the configs of other services of the stage or of projects that were not deployed
+ */
+func (state *MonacoState) Merge(previous *MonacoState, service string, projects string) *MonacoState {
+	owned := monacoStateOwner(service, projects)
+
+	merged := &MonacoState{Tenant: state.Tenant, Configs: []*MonacoDeleteEntry{}}
+	for _, config := range previous.Configs {
+		if !owned(config) {
+			merged.Configs = append(merged.Configs, config)
+		}
+	}
+	merged.Configs = append(merged.Configs, state.Configs...)
+	return merged
+}
+
+// returns whether a config of the state belongs to a run of the service for the projects, all projects if no projects are passed
+func monacoStateOwner(service string, projects string) func(config *MonacoDeleteEntry) bool {
+	deployedProjects := map[string]bool{}
+	for _, project := range SplitMonacoProjects(projects) {
+		deployedProjects[project] = true
+	}
+	return func(config *MonacoDeleteEntry) bool {
+		return config.Service == service && (len(deployedProjects) == 0 || deployedProjects[config.Project])
+	}
+}
+
+var monacoTenantResourceRegex = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+/**
+ * Returns the name of the Keptn resources of a tenant, e.g: its state and snapshots.
+ * Tenant names can be credential URIs like k8s://keptn/dynatrace or file:///etc/dt.env, these are turned into a safe file name
+ * with a hash of the tenant name so that different URIs never share a file, e.g: k8s-keptn-dynatrace-2765dc41
+ */
+func GetMonacoTenantResourceName(tenantName string) string {
+	if tenantName != "" && !strings.HasPrefix(tenantName, ".") && !monacoTenantResourceRegex.MatchString(tenantName) {
+		return tenantName
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(tenantName))
+	name := strings.Trim(monacoTenantResourceRegex.ReplaceAllString(tenantName, "-"), "-.")
+	if name == "" {
+		name = "tenant"
+	}
+	return fmt.Sprintf("%s-%08x", name, hash.Sum32())
+}
+
+// returns the Keptn resource the deployed configs of the tenant are tracked in, e.g: dynatrace/monaco-state/dynatrace.json
+func GetMonacoStateResource(tenantName string) string {
+	return MonacoStateFolder + "/" + GetMonacoTenantResourceName(tenantName) + ".json"
+}
+
+// the state is tracked per stage so that the services of a stage see each others configs, every config belongs to the service that deployed it
+func monacoStateEvent(keptnEvent *BaseKeptnEvent) *BaseKeptnEvent {
+	stageEvent := *keptnEvent
+	stageEvent.Service = ""
+	return &stageEvent
+}
+
+/**
+ * Loads the configs deployed to the tenant for the stage of the keptn event, returns nil if nothing was tracked yet.
+ * A state inherited from another level, e.g: the project level state of configure-monitoring, tracks the configs of that level
+ */
+func GetMonacoState(keptnEvent *BaseKeptnEvent, tenantName string) (*MonacoState, error) {
+	stateEvent := monacoStateEvent(keptnEvent)
+	content, level, err := GetKeptnResourceWithLevel(stateEvent, GetMonacoStateResource(tenantName))
+	if err != nil || content == "" || (level != KeptnResourceLevelLocal && level != GetKeptnEventLevel(stateEvent)) {
+		return nil, nil
+	}
+
+	state := &MonacoState{}
+	err = json.Unmarshal([]byte(content), state)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", GetMonacoStateResource(tenantName), err)
+	}
+	return state, nil
+}
+
+/**
+ * Stores the configs deployed to the tenant on the stage level of the keptn event
+ */
+func UploadMonacoState(state *MonacoState, keptnEvent *BaseKeptnEvent, tenantName string) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return UploadKeptnResource(content, GetMonacoStateResource(tenantName), monacoStateEvent(keptnEvent))
+}
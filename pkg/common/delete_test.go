@@ -0,0 +1,162 @@
+package common
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Tests that the native deployer deletes the configs of delete.yaml after deploying
+func TestNativeDeployerDeleteFile(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "delete-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"monaco/auto-tag/tagging.yaml": "config:\n  - tagging: \"tagging.json\"\ntagging:\n  - name: \"{{ .Env.KEPTN_STAGE }}\"\n",
+		"monaco/auto-tag/tagging.json": `{"name": "{{ .name }}", "rules": []}`,
+		"delete.yaml":                  "delete:\n  - \"auto-tag/old-tag\"\n  - \"management-zone/unknown zone\"\n",
+	})
+
+	api := newFakeDynatraceConfigAPI()
+	api.add("/api/config/v1/autoTags", "old-tag-id", `{"id": "old-tag-id", "name": "old-tag", "rules": []}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dtCredentials := &DTCredentials{Tenant: server.URL, ApiToken: "test-token"}
+	deployer := &NativeDeployer{HTTPClient: server.Client()}
+
+	_, _, err := deployer.Deploy(dtCredentials, keptnEvent, "monaco", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := api.configs["/api/config/v1/autoTags"]["old-tag-id"]; !ok {
+		t.Errorf("Expected a dry run not to delete anything")
+	}
+
+	report, _, err := deployer.Deploy(dtCredentials, keptnEvent, "monaco", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.CountByAction(MonacoActionCreated) != 1 || report.CountByAction(MonacoActionDeleted) != 1 || report.CountByAction(MonacoActionSkipped) != 1 {
+		t.Errorf("Expected one created, one deleted and one skipped config, got %+v", report.Configs)
+	}
+	if _, ok := api.configs["/api/config/v1/autoTags"]["old-tag-id"]; ok {
+		t.Errorf("Expected old-tag to be deleted")
+	}
+}
+
+func TestLoadMonacoDeleteFileInvalidEntry(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "delete-invalid-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{"delete.yaml": "delete:\n  - \"old-tag\"\n"})
+
+	_, err := LoadMonacoDeleteFile(keptnEvent)
+	if err == nil {
+		t.Errorf("Expected an error for an entry without config type")
+	}
+}
+
+// Tests that configs of a previous run that are no longer part of the deployed projects are orphans
+func TestMonacoStateOrphans(t *testing.T) {
+	previous := &MonacoState{Configs: []*MonacoDeleteEntry{
+		{Project: "monaco", ConfigType: "auto-tag", ConfigName: "tagging", Name: "dev"},
+		{Project: "monaco", ConfigType: "dashboard", ConfigName: "overview", Name: "Overview"},
+		{Project: "infrastructure", ConfigType: "management-zone", ConfigName: "zone", Name: "zone"},
+	}}
+	state := &MonacoState{Configs: []*MonacoDeleteEntry{
+		{Project: "monaco", ConfigType: "auto-tag", ConfigName: "tagging", Name: "dev"},
+	}}
+
+	orphans := state.Orphans(previous, "", "monaco")
+	if len(orphans) != 1 || orphans[0].Name != "Overview" {
+		t.Errorf("Expected only the dashboard of the deployed project to be an orphan, got %+v", orphans)
+	}
+
+	orphans = state.Orphans(previous, "", "")
+	if len(orphans) != 2 {
+		t.Errorf("Expected the configs of all projects to be considered, got %+v", orphans)
+	}
+}
+
+// Tests that two services of a stage only prune their own configs and keep the configs of each other tracked
+func TestMonacoStateServices(t *testing.T) {
+	previous := &MonacoState{Configs: []*MonacoDeleteEntry{
+		{Service: "carts", Project: "monaco", ConfigType: "auto-tag", ConfigName: "tagging", Name: "carts"},
+		{Service: "carts", Project: "monaco", ConfigType: "management-zone", ConfigName: "zone", Name: "shop"},
+		{Service: "orders", Project: "monaco", ConfigType: "auto-tag", ConfigName: "tagging", Name: "orders"},
+		{Service: "orders", Project: "monaco", ConfigType: "management-zone", ConfigName: "zone", Name: "shop"},
+	}}
+
+	// the run of orders no longer deploys its tag and the shared zone
+	state := &MonacoState{Configs: []*MonacoDeleteEntry{}}
+
+	orphans := state.Orphans(previous, "orders", "monaco")
+	if len(orphans) != 1 || orphans[0].Name != "orders" {
+		t.Errorf("Expected only the tag of orders to be an orphan, the zone is still deployed by carts, got %+v", orphans)
+	}
+
+	merged := state.Merge(previous, "orders", "monaco")
+	if len(merged.Configs) != 2 || merged.Configs[0].Service != "carts" || merged.Configs[1].Service != "carts" {
+		t.Errorf("Expected the configs of carts to stay tracked, got %+v", merged.Configs)
+	}
+
+	// the run of carts deploys the same configs again
+	state = &MonacoState{Configs: previous.Configs[:2]}
+	if orphans := state.Orphans(previous, "carts", "monaco"); len(orphans) != 0 {
+		t.Errorf("Expected no orphans for carts, got %+v", orphans)
+	}
+	if merged := state.Merge(previous, "carts", "monaco"); len(merged.Configs) != 4 {
+		t.Errorf("Expected the configs of both services, got %+v", merged.Configs)
+	}
+}
+
+// Tests that tenant names that are credential URIs are turned into safe resource names
+func TestGetMonacoTenantResourceName(t *testing.T) {
+	if name := GetMonacoTenantResourceName("dynatrace-prod_1.0"); name != "dynatrace-prod_1.0" {
+		t.Errorf("Expected plain tenant names to stay unchanged, got %s", name)
+	}
+
+	names := map[string]bool{}
+	for _, tenantName := range []string{"k8s://keptn/dynatrace", "k8s://keptn-dynatrace", "file:///etc/dt.env", "..", ""} {
+		name := GetMonacoTenantResourceName(tenantName)
+		if monacoTenantResourceRegex.MatchString(name) || strings.HasPrefix(name, ".") || names[name] {
+			t.Errorf("Expected a safe and unique resource name for %s, got %s", tenantName, name)
+		}
+		names[name] = true
+	}
+
+	if resource := GetMonacoStateResource("k8s://keptn/dynatrace"); !strings.HasPrefix(resource, MonacoStateFolder+"/k8s-keptn-dynatrace-") || strings.Count(resource, "/") != 2 {
+		t.Errorf("Expected the state of the tenant in the state folder, got %s", resource)
+	}
+}
+
+// Tests that a stage ignores the state configure-monitoring tracks on project level, so its configs are no orphans of the stage
+func TestGetMonacoStateLevel(t *testing.T) {
+	projectState := `{"tenant": "https://abc12345.live.dynatrace.com", "configs": [{"project": "keptn", "configType": "auto-tag", "configName": "keptn-stage", "name": "keptn_stage"}]}`
+	levels := map[string]map[string]string{
+		"/v1/project/sockshop/resource": {"/" + GetMonacoStateResource("dynatrace"): projectState},
+	}
+	server := fakeConfigurationService(t, levels)
+	defer server.Close()
+	os.Setenv("CONFIGURATION_SERVICE", server.URL)
+	defer os.Unsetenv("CONFIGURATION_SERVICE")
+
+	keptnEvent := &BaseKeptnEvent{Project: "sockshop", Stage: "dev", Service: "carts"}
+	previous, err := GetMonacoState(keptnEvent, "dynatrace")
+	if err != nil || previous != nil {
+		t.Fatalf("Expected no state for the stage, got %+v %v", previous, err)
+	}
+
+	previous, err = GetMonacoState(&BaseKeptnEvent{Project: "sockshop"}, "dynatrace")
+	if err != nil || previous == nil || len(previous.Configs) != 1 {
+		t.Errorf("Expected the state of the project level, got %+v %v", previous, err)
+	}
+
+	levels["/v1/project/sockshop/stage/dev/resource"] = map[string]string{"/" + GetMonacoStateResource("dynatrace"): `{"tenant": "https://abc12345.live.dynatrace.com", "configs": []}`}
+	previous, err = GetMonacoState(keptnEvent, "dynatrace")
+	if err != nil || previous == nil || len(previous.Configs) != 0 {
+		t.Errorf("Expected the state of the stage, got %+v %v", previous, err)
+	}
+}
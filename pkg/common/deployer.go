@@ -0,0 +1,496 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+/**
+ * Deployers that can be selected with deployer in monaco.conf.yaml
+ */
+const DeployerExec = "exec"
+const DeployerNative = "native"
+
+// Deployer deploys the monaco projects prepared in the temp folder of the keptn context to a Dynatrace environment
+type Deployer interface {
+	// Deploy returns the deployment report, the log output of the deployment and an error if the deployment failed
+	Deploy(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, verbose bool, dryrun bool) (*MonacoDeploymentReport, string, error)
+	// Plan returns what deploying the monaco projects and deleting the removed configs would change without changing anything
+	Plan(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, removed []*MonacoDeleteEntry) (*MonacoPlan, error)
+	// Snapshot returns the state of the configs in Dynatrace before the deployment
+	Snapshot(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string) (*MonacoSnapshot, error)
+	// Restore restores a snapshot and returns a report of the restored configs
+	Restore(dtCredentials *DTCredentials, snapshot *MonacoSnapshot) (*MonacoDeploymentReport, error)
+	// Delete deletes the configs from Dynatrace and returns a report of the deleted configs
+	Delete(dtCredentials *DTCredentials, entries []*MonacoDeleteEntry, dryrun bool) (*MonacoDeploymentReport, error)
+	// Validate checks that the tenant is reachable and the API token has the scopes the projects need
+	Validate(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, write bool) error
+}
+
+// NewDeployer returns the Deployer configured in monaco.conf.yaml
+func NewDeployer(monacoConfigFile *MonacoConfigFile) (Deployer, error) {
+	deployer := ""
+	if monacoConfigFile != nil {
+		deployer = monacoConfigFile.Deployer
+	}
+
+	switch deployer {
+	case "", DeployerExec:
+		execDeployer := &ExecDeployer{}
+		if monacoConfigFile != nil {
+			execDeployer.ManifestEnvironments = monacoConfigFile.ManifestEnvironments
+			execDeployer.Env = monacoConfigFile.Env
+		}
+		return execDeployer, nil
+	case DeployerNative:
+		return &NativeDeployer{Env: monacoConfigFile.Env}, nil
+	}
+	return nil, fmt.Errorf("Unknown deployer '%s' in %s, use %s or %s", deployer, MonacoConfigFilename, DeployerExec, DeployerNative)
+}
+
+// ExecDeployer deploys by running the monaco executable
+type ExecDeployer struct {
+	// ManifestEnvironments maps Keptn stages to monaco v2 manifest environments
+	ManifestEnvironments map[string]string
+	// Env are additional env variables passed to monaco
+	Env map[string]string
+}
+
+// Deploy runs monaco v1 - or monaco v2 if there is a manifest.yaml - and parses its output into the deployment report
+func (deployer *ExecDeployer) Deploy(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, verbose bool, dryrun bool) (*MonacoDeploymentReport, string, error) {
+	manifest, err := GetMonacoManifest(keptnEvent)
+	if err != nil {
+		return ParseMonacoOutput(""), err.Error(), err
+	}
+
+	if manifest == nil {
+		output, err := ExecuteMonaco(dtCredentials, keptnEvent, projects, verbose, dryrun, deployer.Env)
+		return ParseMonacoOutput(output), output, err
+	}
+
+	environment, err := manifest.EnvironmentForStage(keptnEvent.Stage, deployer.ManifestEnvironments)
+	if err != nil {
+		return ParseMonacoOutput(""), err.Error(), err
+	}
+
+	output, err := ExecuteMonacoV2(dtCredentials, keptnEvent, manifest, environment, projects, verbose, dryrun, deployer.Env)
+	return ParseMonacoOutput(output), output, err
+}
+
+// Plan compares the monaco (v1) projects with Dynatrace, monaco itself can't tell what it would change
+func (deployer *ExecDeployer) Plan(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, removed []*MonacoDeleteEntry) (*MonacoPlan, error) {
+	return PlanMonacoProjects(dtCredentials, keptnEvent, projects, removed, deployer.Env, nil)
+}
+
+// Snapshot reads the configs of the monaco (v1) projects from Dynatrace
+func (deployer *ExecDeployer) Snapshot(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string) (*MonacoSnapshot, error) {
+	return SnapshotMonacoProjects(dtCredentials, keptnEvent, projects, deployer.Env, nil)
+}
+
+// Restore writes the snapshot back to Dynatrace
+func (deployer *ExecDeployer) Restore(dtCredentials *DTCredentials, snapshot *MonacoSnapshot) (*MonacoDeploymentReport, error) {
+	return RestoreMonacoSnapshot(dtCredentials, snapshot, nil)
+}
+
+// Delete deletes the configs through the Dynatrace Configuration API, monaco itself only deletes the configs of delete.yaml
+func (deployer *ExecDeployer) Delete(dtCredentials *DTCredentials, entries []*MonacoDeleteEntry, dryrun bool) (*MonacoDeploymentReport, error) {
+	return DeleteMonacoConfigs(dtCredentials, entries, dryrun, nil)
+}
+
+// Validate checks the credentials before monaco runs, monaco itself only fails on the first config it can't deploy
+func (deployer *ExecDeployer) Validate(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, write bool) error {
+	return ValidateMonacoCredentials(dtCredentials, keptnEvent, projects, write, nil)
+}
+
+// NativeDeployer reads the monaco project tree itself and talks to the Dynatrace Configuration API directly
+type NativeDeployer struct {
+	// HTTPClient is used for the Dynatrace API calls, defaults to a client with a 30s timeout
+	HTTPClient *http.Client
+	// Env are additional env variables that can be used in the templates
+	Env map[string]string
+}
+
+// MonacoConfig is a single config of a monaco (v1) project, e.g: the config tagging of projects/monaco/auto-tag/tagging.yaml
+type MonacoConfig struct {
+	Project      string
+	ConfigType   string
+	ConfigId     string
+	TemplateFile string
+	Properties   map[string]string
+}
+
+// FullQualifiedId returns the id monaco uses for the config, e.g: monaco/auto-tag/tagging
+func (config *MonacoConfig) FullQualifiedId() string {
+	return config.Project + "/" + config.ConfigType + "/" + config.ConfigId
+}
+
+// Deploy renders every config of the projects and creates or updates it in Dynatrace. In dryrun mode configs are only rendered and validated
+func (deployer *NativeDeployer) Deploy(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, verbose bool, dryrun bool) (*MonacoDeploymentReport, string, error) {
+	report := &MonacoDeploymentReport{Configs: []*MonacoConfigResult{}}
+	var output strings.Builder
+	logLine := func(format string, args ...interface{}) {
+		line := fmt.Sprintf(format, args...)
+		output.WriteString(line + "\n")
+		if verbose {
+			log.Println(line)
+		}
+	}
+
+	// we only understand the monaco v1 project format
+	if FileExists(GetMonacoManifestPath(keptnEvent)) {
+		err := fmt.Errorf("The %s deployer does not support monaco v2 projects (%s), use the %s deployer", DeployerNative, MonacoManifestFilename, DeployerExec)
+		logLine("ERROR %v", err)
+		return report, output.String(), err
+	}
+
+	configs, err := LoadMonacoProjects(GetMonacoProjectsFolder(keptnEvent), SplitMonacoProjects(projects))
+	if err != nil {
+		logLine("ERROR %v", err)
+		return report, output.String(), err
+	}
+
+	env := MonacoEnvironmentAsMap(GetMonacoEnvironment(dtCredentials, keptnEvent, deployer.Env))
+	client := NewDynatraceClient(dtCredentials, deployer.HTTPClient)
+
+	// existing configs per API so we know whether to create or update
+	existingConfigs := map[string][]DynatraceConfigObject{}
+	// configs deployed in this run, used to resolve references like /monaco/management-zone/zone.id
+	deployed := map[string]DynatraceConfigObject{}
+	failedCount := 0
+
+	for _, config := range configs {
+		logLine("Processing config %s", config.FullQualifiedId())
+		result := &MonacoConfigResult{Project: config.Project, ConfigType: config.ConfigType, ConfigName: config.ConfigId, Action: MonacoActionSkipped}
+		report.Configs = append(report.Configs, result)
+
+		payload, name, err := RenderMonacoConfig(config, env, deployed)
+		if err != nil {
+			result.Action = MonacoActionFailed
+			result.Error = err.Error()
+			logLine("ERROR %s", result.Error)
+			failedCount++
+			continue
+		}
+
+		apiPath := MonacoConfigApis[config.ConfigType]
+		if dryrun {
+			deployed[config.FullQualifiedId()] = DynatraceConfigObject{ID: config.FullQualifiedId(), Name: name}
+			continue
+		}
+
+		if _, ok := existingConfigs[apiPath]; !ok {
+			existingConfigs[apiPath], err = client.ListConfigs(apiPath)
+			if err != nil {
+				result.Action = MonacoActionFailed
+				result.Error = err.Error()
+				logLine("ERROR %s", result.Error)
+				failedCount++
+				continue
+			}
+		}
+
+		id := ""
+		for _, existing := range existingConfigs[apiPath] {
+			if existing.Name == name {
+				id = existing.ID
+				break
+			}
+		}
+
+		logMessage := "Updated existing object for %s (%s)"
+		if id != "" {
+			err = client.UpdateConfig(apiPath, id, payload)
+			result.Action = MonacoActionUpdated
+		} else {
+			id, err = client.CreateConfig(apiPath, payload)
+			result.Action = MonacoActionCreated
+			logMessage = "Created new object for %s (%s)"
+			existingConfigs[apiPath] = append(existingConfigs[apiPath], DynatraceConfigObject{ID: id, Name: name})
+		}
+
+		if err != nil {
+			result.Action = MonacoActionFailed
+			result.Error = err.Error()
+			logLine("ERROR Failed to deploy %s: %s", config.FullQualifiedId(), result.Error)
+			failedCount++
+			continue
+		}
+
+		result.EntityID = id
+		deployed[config.FullQualifiedId()] = DynatraceConfigObject{ID: id, Name: name}
+		logLine(logMessage, name, id)
+	}
+
+	// like monaco we delete the configs of delete.yaml after deploying
+	deleteEntries, err := LoadMonacoDeleteFile(keptnEvent)
+	if err != nil {
+		logLine("ERROR %v", err)
+		return report, output.String(), err
+	}
+	if len(deleteEntries) > 0 {
+		deleteReport, err := DeleteMonacoConfigs(dtCredentials, deleteEntries, dryrun, deployer.HTTPClient)
+		for _, result := range deleteReport.Configs {
+			if result.Action == MonacoActionDeleted {
+				logLine("Deleted %s/%s (%s)", result.ConfigType, result.ConfigName, result.EntityID)
+			}
+			if result.Error != "" {
+				logLine("ERROR Failed to delete %s/%s: %s", result.ConfigType, result.ConfigName, result.Error)
+			}
+		}
+		report.Configs = append(report.Configs, deleteReport.Configs...)
+		if err != nil && failedCount == 0 {
+			return report, output.String(), err
+		}
+	}
+
+	if failedCount > 0 {
+		return report, output.String(), fmt.Errorf("%d of %d configs failed", failedCount, len(configs))
+	}
+	return report, output.String(), nil
+}
+
+// Plan compares the rendered configs with the configs in Dynatrace
+func (deployer *NativeDeployer) Plan(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, removed []*MonacoDeleteEntry) (*MonacoPlan, error) {
+	return PlanMonacoProjects(dtCredentials, keptnEvent, projects, removed, deployer.Env, deployer.HTTPClient)
+}
+
+// Snapshot reads the configs of the monaco projects from Dynatrace
+func (deployer *NativeDeployer) Snapshot(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string) (*MonacoSnapshot, error) {
+	return SnapshotMonacoProjects(dtCredentials, keptnEvent, projects, deployer.Env, deployer.HTTPClient)
+}
+
+// Restore writes the snapshot back to Dynatrace
+func (deployer *NativeDeployer) Restore(dtCredentials *DTCredentials, snapshot *MonacoSnapshot) (*MonacoDeploymentReport, error) {
+	return RestoreMonacoSnapshot(dtCredentials, snapshot, deployer.HTTPClient)
+}
+
+// Delete deletes the configs through the Dynatrace Configuration API
+func (deployer *NativeDeployer) Delete(dtCredentials *DTCredentials, entries []*MonacoDeleteEntry, dryrun bool) (*MonacoDeploymentReport, error) {
+	return DeleteMonacoConfigs(dtCredentials, entries, dryrun, deployer.HTTPClient)
+}
+
+// Validate checks the credentials before the configs are deployed
+func (deployer *NativeDeployer) Validate(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, write bool) error {
+	return ValidateMonacoCredentials(dtCredentials, keptnEvent, projects, write, deployer.HTTPClient)
+}
+
+// SplitMonacoProjects splits the comma separated projects string we pass to monaco
+func SplitMonacoProjects(projects string) []string {
+	result := []string{}
+	for _, project := range strings.Split(projects, ",") {
+		project = strings.TrimSpace(project)
+		if project != "" {
+			result = append(result, project)
+		}
+	}
+	return result
+}
+
+// MonacoEnvironmentAsMap converts a list of KEY=VALUE env variables into a map
+func MonacoEnvironmentAsMap(env []string) map[string]string {
+	result := map[string]string{}
+	for _, pair := range env {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) == 2 {
+			result[keyValue[0]] = keyValue[1]
+		}
+	}
+	return result
+}
+
+/**
+ * Loads all configs of the passed projects from the monaco (v1) projects folder.
+ * If no projects are passed all projects in the folder are loaded. The configs are sorted by MonacoConfigApiOrder.
+ * Environment specific overrides (e.g. tagging.production) are not supported
+ */
+func LoadMonacoProjects(projectsFolder string, projects []string) ([]*MonacoConfig, error) {
+	if len(projects) == 0 {
+		files, err := ioutil.ReadDir(projectsFolder)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading monaco projects folder %s: %v", projectsFolder, err)
+		}
+		for _, file := range files {
+			if file.IsDir() {
+				projects = append(projects, file.Name())
+			}
+		}
+	}
+
+	configs := []*MonacoConfig{}
+	for _, project := range projects {
+		projectFolder := filepath.Join(projectsFolder, project)
+		if _, err := os.Stat(projectFolder); err != nil {
+			return nil, fmt.Errorf("Monaco project %s not found in %s", project, projectsFolder)
+		}
+
+		configTypeFolders, err := ioutil.ReadDir(projectFolder)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading monaco project %s: %v", project, err)
+		}
+
+		for _, configTypeFolder := range configTypeFolders {
+			if !configTypeFolder.IsDir() {
+				continue
+			}
+
+			// unsupported config types are loaded as well so they show up as failed in the report
+			configType := configTypeFolder.Name()
+			yamlFiles, _ := filepath.Glob(filepath.Join(projectFolder, configType, "*.yaml"))
+			ymlFiles, _ := filepath.Glob(filepath.Join(projectFolder, configType, "*.yml"))
+			yamlFiles = append(yamlFiles, ymlFiles...)
+			sort.Strings(yamlFiles)
+
+			for _, yamlFile := range yamlFiles {
+				fileConfigs, err := loadMonacoConfigYaml(yamlFile, project, configType)
+				if err != nil {
+					return nil, err
+				}
+				configs = append(configs, fileConfigs...)
+			}
+		}
+	}
+
+	sort.SliceStable(configs, func(i, j int) bool {
+		return monacoConfigApiIndex(configs[i].ConfigType) < monacoConfigApiIndex(configs[j].ConfigType)
+	})
+	return configs, nil
+}
+
+// returns the position of the config type in MonacoConfigApiOrder, unknown config types go last
+func monacoConfigApiIndex(configType string) int {
+	for i, apiConfigType := range MonacoConfigApiOrder {
+		if apiConfigType == configType {
+			return i
+		}
+	}
+	return len(MonacoConfigApiOrder)
+}
+
+/**
+ * Parses a monaco (v1) config yaml, e.g:
+ * config:
+ *   - tagging: "tagging.json"
+ * tagging:
+ *   - name: "{{ .Env.KEPTN_STAGE }}"
+ */
+func loadMonacoConfigYaml(yamlFile string, project string, configType string) ([]*MonacoConfig, error) {
+	content, err := ioutil.ReadFile(yamlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed := map[string][]map[string]string{}
+	err = yaml.Unmarshal(content, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", yamlFile, err)
+	}
+
+	configs := []*MonacoConfig{}
+	for _, configEntry := range parsed["config"] {
+		for configId, templateFile := range configEntry {
+			config := &MonacoConfig{
+				Project:      project,
+				ConfigType:   configType,
+				ConfigId:     configId,
+				TemplateFile: filepath.Join(filepath.Dir(yamlFile), templateFile),
+				Properties:   map[string]string{},
+			}
+			for _, property := range parsed[configId] {
+				for key, value := range property {
+					config.Properties[key] = value
+				}
+			}
+			configs = append(configs, config)
+		}
+	}
+	return configs, nil
+}
+
+var monacoReferenceRegex = regexp.MustCompile(`^/?([\w\-./]+/)?([\w\-]+)/([\w\-]+)\.(id|name)$`)
+
+/**
+ * Renders the JSON template of a config. Properties are rendered first with {{ .Env.XXX }}, references to already deployed
+ * configs (e.g: /monaco/management-zone/zone.id) are resolved and then the properties are passed to the JSON template.
+ * Returns the rendered JSON and the name of the config
+ */
+func RenderMonacoConfig(config *MonacoConfig, env map[string]string, deployed map[string]DynatraceConfigObject) ([]byte, string, error) {
+	properties := map[string]interface{}{"Env": env}
+	for key, value := range config.Properties {
+		rendered, err := renderMonacoTemplate(config.FullQualifiedId()+"."+key, value, map[string]interface{}{"Env": env})
+		if err != nil {
+			return nil, "", err
+		}
+		properties[key] = resolveMonacoReference(rendered, config.Project, deployed)
+	}
+
+	name, _ := properties["name"].(string)
+	if name == "" {
+		return nil, "", fmt.Errorf("Config %s has no name property", config.FullQualifiedId())
+	}
+
+	if _, ok := MonacoConfigApis[config.ConfigType]; !ok {
+		return nil, name, fmt.Errorf("Config type %s of %s is not supported", config.ConfigType, config.FullQualifiedId())
+	}
+
+	templateContent, err := ioutil.ReadFile(config.TemplateFile)
+	if err != nil {
+		return nil, name, fmt.Errorf("Error reading template of %s: %v", config.FullQualifiedId(), err)
+	}
+
+	rendered, err := renderMonacoTemplate(config.FullQualifiedId(), string(templateContent), properties)
+	if err != nil {
+		return nil, name, err
+	}
+
+	if !json.Valid([]byte(rendered)) {
+		return nil, name, fmt.Errorf("Rendered template of %s is not valid JSON", config.FullQualifiedId())
+	}
+	return []byte(rendered), name, nil
+}
+
+func resolveMonacoReference(value string, project string, deployed map[string]DynatraceConfigObject) string {
+	match := monacoReferenceRegex.FindStringSubmatch(value)
+	if match == nil {
+		return value
+	}
+
+	referencedProject := strings.TrimSuffix(match[1], "/")
+	if referencedProject == "" {
+		referencedProject = project
+	}
+	referenced, ok := deployed[referencedProject+"/"+match[2]+"/"+match[3]]
+	if !ok {
+		return value
+	}
+
+	if match[4] == "id" {
+		return referenced.ID
+	}
+	return referenced.Name
+}
+
+func renderMonacoTemplate(name string, content string, data map[string]interface{}) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing template of %s: %v", name, err)
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, data)
+	if err != nil {
+		return "", fmt.Errorf("Error rendering template of %s: %v", name, err)
+	}
+	return buffer.String(), nil
+}
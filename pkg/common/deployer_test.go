@@ -0,0 +1,169 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+/**
+ * fakeDynatraceConfigAPI is a minimal in-memory stand-in for the Dynatrace Configuration API
+ */
+type fakeDynatraceConfigAPI struct {
+	mutex   sync.Mutex
+	configs map[string]map[string][]byte
+	nextId  int
+}
+
+func newFakeDynatraceConfigAPI() *fakeDynatraceConfigAPI {
+	return &fakeDynatraceConfigAPI{configs: map[string]map[string][]byte{}}
+}
+
+func (api *fakeDynatraceConfigAPI) add(apiPath string, id string, payload string) {
+	if api.configs[apiPath] == nil {
+		api.configs[apiPath] = map[string][]byte{}
+	}
+	api.configs[apiPath][id] = []byte(payload)
+}
+
+func (api *fakeDynatraceConfigAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "Api-Token test-token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	switch r.Method {
+	case "GET":
+		index := strings.LastIndex(r.URL.Path, "/")
+		if payload, ok := api.configs[r.URL.Path[:index]][r.URL.Path[index+1:]]; ok {
+			w.Write(payload)
+			return
+		}
+		values := []DynatraceConfigObject{}
+		for id, payload := range api.configs[r.URL.Path] {
+			config := struct {
+				DynatraceConfigObject
+				DashboardMetadata *DynatraceConfigObject `json:"dashboardMetadata"`
+			}{}
+			json.Unmarshal(payload, &config)
+			// dashboards are listed with the name of their metadata
+			if config.DashboardMetadata != nil {
+				config.Name = config.DashboardMetadata.Name
+			}
+			values = append(values, DynatraceConfigObject{ID: id, Name: config.Name})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"values": values})
+	case "POST":
+		api.nextId++
+		id := fmt.Sprintf("id-%d", api.nextId)
+		api.add(r.URL.Path, id, string(body))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(DynatraceConfigObject{ID: id})
+	case "PUT":
+		index := strings.LastIndex(r.URL.Path, "/")
+		api.add(r.URL.Path[:index], r.URL.Path[index+1:], string(body))
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		index := strings.LastIndex(r.URL.Path, "/")
+		delete(api.configs[r.URL.Path[:index]], r.URL.Path[index+1:])
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writes the files into the monaco projects folder of the keptn event
+func writeTestMonacoProject(t *testing.T, keptnEvent *BaseKeptnEvent, files map[string]string) {
+	for fileName, content := range files {
+		_, err := storeFile(GetMonacoProjectsFolder(keptnEvent), fileName, content, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Tests that the NativeDeployer creates and updates configs and resolves references between configs
+func TestNativeDeployerDeploy(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "native-deployer-test", Project: "sockshop", Stage: "dev", Service: "carts"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"monaco/management-zone/zone.yaml":     "config:\n  - zone: \"zone.json\"\nzone:\n  - name: \"{{ .Env.KEPTN_PROJECT }}-{{ .Env.KEPTN_STAGE }}\"\n",
+		"monaco/management-zone/zone.json":     `{"name": "{{ .name }}", "rules": []}`,
+		"monaco/auto-tag/tagging.yaml":         "config:\n  - tagging: \"tagging.json\"\ntagging:\n  - name: \"{{ .Env.KEPTN_STAGE }}\"\n  - zoneId: \"/monaco/management-zone/zone.id\"\n",
+		"monaco/auto-tag/tagging.json":         `{"name": "{{ .name }}", "description": "{{ .zoneId }}", "rules": []}`,
+		"monaco/alerting-profile/profile.yaml": "config:\n  - profile: \"profile.json\"\nprofile:\n  - name: \"broken\"\n",
+		"monaco/alerting-profile/profile.json": `{"name": "{{ .name }}", "rules": [}`,
+	})
+
+	api := newFakeDynatraceConfigAPI()
+	api.add("/api/config/v1/autoTags", "existing-tag", `{"name": "dev"}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dtCredentials := &DTCredentials{Tenant: server.URL, ApiToken: "test-token"}
+	deployer := &NativeDeployer{HTTPClient: server.Client()}
+
+	report, _, err := deployer.Deploy(dtCredentials, keptnEvent, "monaco", false, false)
+	if err == nil {
+		t.Errorf("Expected an error for the invalid alerting profile")
+	}
+
+	if len(report.Configs) != 3 {
+		t.Fatalf("Expected 3 configs in report, got %d", len(report.Configs))
+	}
+
+	zone, tagging, profile := report.Configs[0], report.Configs[1], report.Configs[2]
+	if zone.ConfigType != "management-zone" || zone.Action != MonacoActionCreated || zone.EntityID == "" {
+		t.Errorf("Expected management zone to be created first, got %+v", *zone)
+	}
+	if tagging.ConfigType != "auto-tag" || tagging.Action != MonacoActionUpdated || tagging.EntityID != "existing-tag" {
+		t.Errorf("Expected existing auto-tag to be updated, got %+v", *tagging)
+	}
+	if profile.Action != MonacoActionFailed || profile.Error == "" {
+		t.Errorf("Expected alerting profile to fail, got %+v", *profile)
+	}
+
+	createdZone := string(api.configs["/api/config/v1/managementZones"][zone.EntityID])
+	if !strings.Contains(createdZone, `"name": "sockshop-dev"`) {
+		t.Errorf("Expected rendered management zone name, got %s", createdZone)
+	}
+
+	updatedTag := string(api.configs["/api/config/v1/autoTags"]["existing-tag"])
+	if !strings.Contains(updatedTag, `"description": "`+zone.EntityID+`"`) {
+		t.Errorf("Expected management zone reference to be resolved, got %s", updatedTag)
+	}
+}
+
+// Tests that a dry run of the NativeDeployer does not call the Dynatrace API
+func TestNativeDeployerDryRun(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "native-deployer-dryrun-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"monaco/auto-tag/tagging.yaml": "config:\n  - tagging: \"tagging.json\"\ntagging:\n  - name: \"{{ .Env.KEPTN_STAGE }}\"\n",
+		"monaco/auto-tag/tagging.json": `{"name": "{{ .name }}", "rules": []}`,
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected call to Dynatrace API in dry run: %s %s", r.Method, r.URL.Path)
+	}))
+	defer server.Close()
+
+	deployer := &NativeDeployer{HTTPClient: server.Client()}
+	report, _, err := deployer.Deploy(&DTCredentials{Tenant: server.URL, ApiToken: "test-token"}, keptnEvent, "", false, true)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if len(report.Configs) != 1 || report.Configs[0].Action != MonacoActionSkipped {
+		t.Errorf("Expected one skipped config, got %v", report.Configs)
+	}
+}
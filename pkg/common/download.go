@@ -0,0 +1,172 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var monacoConfigIdRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
+/**
+ * Exports the configs of the passed config types (all supported config types if empty) from Dynatrace into the monaco (v1) project layout, e.g:
+ * projects/PROJECTNAME/auto-tag/auto-tag.yaml
+ * projects/PROJECTNAME/auto-tag/keptn-stage.json
+ * The name of every config is replaced by {{ .name }} in the JSON template and set as name property in the yaml,
+ * names that need JSON escaping, e.g: with " or \, stay in the JSON template as monaco inserts properties unescaped.
+ * Returns the files keyed by their path and a report of the downloaded configs
+ */
+func DownloadMonacoProject(dtCredentials *DTCredentials, projectName string, configTypes []string, httpClient *http.Client) (map[string]string, *MonacoDeploymentReport, error) {
+	files := map[string]string{}
+	report := &MonacoDeploymentReport{Configs: []*MonacoConfigResult{}}
+
+	if len(configTypes) == 0 {
+		configTypes = MonacoConfigApiOrder
+	}
+	for _, configType := range configTypes {
+		if _, ok := MonacoConfigApis[configType]; !ok {
+			return nil, report, fmt.Errorf("Config type %s is not supported, use one of %s", configType, strings.Join(MonacoConfigApiOrder, ", "))
+		}
+	}
+
+	client := NewDynatraceClient(dtCredentials, httpClient)
+	failedCount := 0
+
+	for _, configType := range configTypes {
+		apiPath := MonacoConfigApis[configType]
+		existingConfigs, err := client.ListConfigs(apiPath)
+		if err != nil {
+			return nil, report, err
+		}
+		if len(existingConfigs) == 0 {
+			continue
+		}
+
+		configFolder := path.Join(MonacoProjectsSubfolder, projectName, configType)
+		configList := []yaml.MapSlice{}
+		properties := yaml.MapSlice{}
+		usedIds := map[string]bool{}
+
+		for _, existing := range existingConfigs {
+			configId := newMonacoConfigId(existing.Name, usedIds)
+			result := &MonacoConfigResult{Project: projectName, ConfigType: configType, ConfigName: configId, Action: MonacoActionDownloaded, EntityID: existing.ID}
+			report.Configs = append(report.Configs, result)
+
+			payload, err := client.GetConfig(apiPath, existing.ID)
+			if err == nil {
+				payload, err = newMonacoConfigTemplate(payload)
+			}
+			if err != nil {
+				result.Action = MonacoActionFailed
+				result.Error = err.Error()
+				failedCount++
+				continue
+			}
+
+			files[path.Join(configFolder, configId+".json")] = string(payload)
+			configList = append(configList, yaml.MapSlice{{Key: configId, Value: configId + ".json"}})
+			properties = append(properties, yaml.MapItem{Key: configId, Value: []yaml.MapSlice{{{Key: "name", Value: escapeMonacoTemplate(existing.Name)}}}})
+		}
+
+		if len(configList) == 0 {
+			continue
+		}
+		content, err := yaml.Marshal(append(yaml.MapSlice{{Key: "config", Value: configList}}, properties...))
+		if err != nil {
+			return nil, report, err
+		}
+		files[path.Join(configFolder, configType+".yaml")] = string(content)
+	}
+
+	if failedCount > 0 {
+		return files, report, fmt.Errorf("%d of %d configs could not be downloaded", failedCount, len(report.Configs))
+	}
+	return files, report, nil
+}
+
+// returns a unique config id for the name, e.g: Keptn: sockshop dev -> keptn-sockshop-dev
+func newMonacoConfigId(name string, usedIds map[string]bool) string {
+	configId := strings.Trim(monacoConfigIdRegex.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if configId == "" {
+		configId = "config"
+	}
+
+	uniqueId := configId
+	for i := 2; usedIds[uniqueId]; i++ {
+		uniqueId = configId + "-" + strconv.Itoa(i)
+	}
+	usedIds[uniqueId] = true
+	return uniqueId
+}
+
+/**
+ * Turns a config as returned by Dynatrace into a monaco JSON template: the fields id and metadata are removed
+ * and the name (dashboardMetadata.name for dashboards) is replaced by {{ .name }} unless it needs JSON escaping
+ */
+func newMonacoConfigTemplate(payload []byte) ([]byte, error) {
+	config := map[string]interface{}{}
+	err := json.Unmarshal(payload, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing config: %v", err)
+	}
+	delete(config, "id")
+	delete(config, "metadata")
+	escapeMonacoTemplateValues(config)
+
+	// the name is set after escaping so that the placeholder stays a template action
+	nameConfig := config
+	if dashboardMetadata, ok := config["dashboardMetadata"].(map[string]interface{}); ok && config["name"] == nil {
+		nameConfig = dashboardMetadata
+	}
+	if name, ok := nameConfig["name"].(string); !ok || !needsJSONEscaping(name) {
+		nameConfig["name"] = "{{ .name }}"
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(config)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// returns whether the value changes when it is encoded as JSON string, e.g: for " and \
+func needsJSONEscaping(value string) bool {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return strings.TrimSpace(buffer.String()) != `"`+value+`"`
+}
+
+// escapes all string values of the config, see escapeMonacoTemplate
+func escapeMonacoTemplateValues(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case string:
+		return escapeMonacoTemplate(typedValue)
+	case map[string]interface{}:
+		for key, item := range typedValue {
+			typedValue[key] = escapeMonacoTemplateValues(item)
+		}
+	case []interface{}:
+		for i, item := range typedValue {
+			typedValue[i] = escapeMonacoTemplateValues(item)
+		}
+	}
+	return value
+}
+
+// escapes {{ in values of Dynatrace configs so that monaco doesn't render them as template actions
+func escapeMonacoTemplate(value string) string {
+	return strings.Replace(value, "{{", "{{`{{`}}", -1)
+}
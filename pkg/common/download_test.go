@@ -0,0 +1,78 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Tests that downloaded configs render to the configs of Dynatrace again, including values that look like templates
+func TestDownloadMonacoProject(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "download-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	api := newFakeDynatraceConfigAPI()
+	api.add("/api/config/v1/autoTags", "tag-1", `{"metadata": {"clusterVersion": "1.0"}, "id": "tag-1", "name": "Keptn: dev", "rules": [{"key": "stage"}]}`)
+	api.add("/api/config/v1/autoTags", "tag-2", `{"id": "tag-2", "name": "keptn dev", "rules": [{"valueFormat": "{{.value}} <env>"}]}`)
+	api.add("/api/config/v1/autoTags", "tag-3", `{"id": "tag-3", "name": "Keptn \"dev\" C:\\tags", "rules": []}`)
+	api.add("/api/config/v1/dashboards", "dashboard-1", `{"id": "dashboard-1", "dashboardMetadata": {"name": "{{ sockshop }}", "owner": "keptn"}, "tiles": []}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dtCredentials := &DTCredentials{Tenant: server.URL, ApiToken: "test-token"}
+	files, report, err := DownloadMonacoProject(dtCredentials, "exported", []string{"auto-tag", "dashboard"}, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.CountByAction(MonacoActionDownloaded) != 4 {
+		t.Errorf("Expected 4 downloaded configs, got %+v", report.Configs)
+	}
+	if _, ok := files["projects/exported/auto-tag/keptn-dev-2.json"]; !ok {
+		t.Errorf("Expected unique config ids for configs with similar names, got %v", files)
+	}
+
+	projectFiles := map[string]string{}
+	for file, content := range files {
+		projectFiles[strings.TrimPrefix(file, MonacoProjectsSubfolder+"/")] = content
+	}
+	writeTestMonacoProject(t, keptnEvent, projectFiles)
+
+	configs, err := LoadMonacoProjects(GetMonacoProjectsFolder(keptnEvent), []string{"exported"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 4 {
+		t.Fatalf("Expected 4 configs in the downloaded project, got %d", len(configs))
+	}
+
+	for _, config := range configs {
+		payload, _, err := RenderMonacoConfig(config, map[string]string{}, map[string]DynatraceConfigObject{})
+		if err != nil {
+			t.Fatalf("Error rendering %s: %v", config.FullQualifiedId(), err)
+		}
+
+		var rendered, original map[string]interface{}
+		json.Unmarshal(payload, &rendered)
+		for _, existing := range api.configs[MonacoConfigApis[config.ConfigType]] {
+			json.Unmarshal(existing, &original)
+			delete(original, "id")
+			delete(original, "metadata")
+			if reflect.DeepEqual(rendered, original) {
+				break
+			}
+		}
+		if !reflect.DeepEqual(rendered, original) {
+			t.Errorf("Rendered %s doesn't match any config in Dynatrace: %s", config.FullQualifiedId(), payload)
+		}
+	}
+}
+
+func TestDownloadMonacoProjectUnsupportedConfigType(t *testing.T) {
+	_, _, err := DownloadMonacoProject(&DTCredentials{}, "exported", []string{"unknown"}, nil)
+	if err == nil {
+		t.Errorf("Expected an error for an unsupported config type")
+	}
+}
@@ -0,0 +1,225 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/**
+ * Maps the monaco (v1) config types to the Dynatrace Configuration API endpoints
+ */
+var MonacoConfigApis = map[string]string{
+	"alerting-profile":                "/api/config/v1/alertingProfiles",
+	"management-zone":                 "/api/config/v1/managementZones",
+	"auto-tag":                        "/api/config/v1/autoTags",
+	"dashboard":                       "/api/config/v1/dashboards",
+	"notification":                    "/api/config/v1/notifications",
+	"maintenance-window":              "/api/config/v1/maintenanceWindows",
+	"request-attributes":              "/api/config/v1/service/requestAttributes",
+	"request-naming-service":          "/api/config/v1/service/requestNaming",
+	"custom-service-java":             "/api/config/v1/service/customServices/java",
+	"calculated-metrics-service":      "/api/config/v1/calculatedMetrics/service",
+	"conditional-naming-processgroup": "/api/config/v1/conditionalNaming/processGroup",
+	"conditional-naming-service":      "/api/config/v1/conditionalNaming/service",
+	"anomaly-detection-metrics":       "/api/config/v1/anomalyDetection/metricEvents",
+	"application-web":                 "/api/config/v1/applications/web",
+	"app-detection-rule":              "/api/config/v1/applicationDetectionRules",
+}
+
+/**
+ * Order in which config types are deployed so that configs can reference configs of the types deployed before them,
+ * e.g: an alerting profile referencing a management zone
+ */
+var MonacoConfigApiOrder = []string{
+	"management-zone",
+	"auto-tag",
+	"request-attributes",
+	"calculated-metrics-service",
+	"conditional-naming-processgroup",
+	"conditional-naming-service",
+	"custom-service-java",
+	"request-naming-service",
+	"application-web",
+	"app-detection-rule",
+	"anomaly-detection-metrics",
+	"maintenance-window",
+	"alerting-profile",
+	"notification",
+	"dashboard",
+}
+
+// DynatraceConfigObject is the id and name of a config as returned by the list endpoints of the Configuration API
+type DynatraceConfigObject struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// DynatraceTokenInfo is the metadata of an API token as returned by the token lookup API
+type DynatraceTokenInfo struct {
+	Name           string   `json:"name"`
+	Enabled        bool     `json:"enabled"`
+	ExpirationDate string   `json:"expirationDate,omitempty"`
+	Scopes         []string `json:"scopes"`
+}
+
+// DynatraceAPIError is returned if the Dynatrace API responds with a status other than 2xx
+type DynatraceAPIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *DynatraceAPIError) Error() string {
+	return fmt.Sprintf("%s %s failed with status %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// DynatraceClient talks to the Dynatrace Configuration API of a single tenant
+type DynatraceClient struct {
+	Credentials *DTCredentials
+	HTTPClient  *http.Client
+}
+
+// NewDynatraceClient creates a DynatraceClient for the passed credentials
+func NewDynatraceClient(dtCredentials *DTCredentials, httpClient *http.Client) *DynatraceClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &DynatraceClient{Credentials: dtCredentials, HTTPClient: httpClient}
+}
+
+// ListConfigs returns all configs of an API, e.g: /api/config/v1/autoTags
+func (client *DynatraceClient) ListConfigs(apiPath string) ([]DynatraceConfigObject, error) {
+	body, err := client.send("GET", apiPath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// most APIs return the list as values, dashboards return them as dashboards
+	list := map[string]json.RawMessage{}
+	err = json.Unmarshal(body, &list)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing config list of %s: %v", apiPath, err)
+	}
+
+	configs := []DynatraceConfigObject{}
+	for _, key := range []string{"values", "dashboards"} {
+		if values, ok := list[key]; ok {
+			err = json.Unmarshal(values, &configs)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing config list of %s: %v", apiPath, err)
+			}
+			break
+		}
+	}
+	return configs, nil
+}
+
+// GetConfig returns the JSON of the config with the passed id
+func (client *DynatraceClient) GetConfig(apiPath string, id string) ([]byte, error) {
+	return client.send("GET", apiPath+"/"+id, nil)
+}
+
+// CreateConfig creates a new config and returns its id
+func (client *DynatraceClient) CreateConfig(apiPath string, payload []byte) (string, error) {
+	body, err := client.send("POST", apiPath, payload)
+	if err != nil {
+		return "", err
+	}
+
+	created := DynatraceConfigObject{}
+	err = json.Unmarshal(body, &created)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing response of %s: %v", apiPath, err)
+	}
+	return created.ID, nil
+}
+
+// UpdateConfig updates the config with the passed id
+func (client *DynatraceClient) UpdateConfig(apiPath string, id string, payload []byte) error {
+	_, err := client.send("PUT", apiPath+"/"+id, payload)
+	return err
+}
+
+// DeleteConfig deletes the config with the passed id
+func (client *DynatraceClient) DeleteConfig(apiPath string, id string) error {
+	_, err := client.send("DELETE", apiPath+"/"+id, nil)
+	return err
+}
+
+// LookupToken returns the metadata of the API token of the credentials, the lookup doesn't need any scope
+func (client *DynatraceClient) LookupToken() (*DynatraceTokenInfo, error) {
+	payload, _ := json.Marshal(map[string]string{"token": client.Credentials.ApiToken})
+	body, err := client.send("POST", "/api/v2/apiTokens/lookup", payload)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenInfo := &DynatraceTokenInfo{}
+	err = json.Unmarshal(body, tokenInfo)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing token lookup response: %v", err)
+	}
+	return tokenInfo, nil
+}
+
+/**
+ * Returns the Authorization header. The API token is preferred, without it the platform token or an access token of the OAuth client is used
+ */
+func (client *DynatraceClient) authorization() (string, error) {
+	switch {
+	case client.Credentials.ApiToken != "":
+		return "Api-Token " + client.Credentials.ApiToken, nil
+	case client.Credentials.PlatformToken != "":
+		return "Bearer " + client.Credentials.PlatformToken, nil
+	case client.Credentials.ClientID != "":
+		accessToken, err := GetOAuthTokenSource(client.Credentials, client.HTTPClient).Token()
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + accessToken, nil
+	}
+	return "", fmt.Errorf("No API token, platform token or OAuth client for %s", client.Credentials.Tenant)
+}
+
+func (client *DynatraceClient) send(method string, apiPath string, payload []byte) ([]byte, error) {
+	var requestBody io.Reader
+	if payload != nil {
+		requestBody = bytes.NewReader(payload)
+	}
+
+	url := strings.TrimSuffix(client.Credentials.Tenant, "/") + apiPath
+	req, err := http.NewRequest(method, url, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	authorization, err := client.authorization()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %v", method, apiPath, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed reading response: %v", method, apiPath, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &DynatraceAPIError{Method: method, Path: apiPath, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
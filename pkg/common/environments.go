@@ -0,0 +1,86 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+const MonacoEnvironmentsFilename = "environments.yaml"
+const DefaultMonacoEnvironmentName = "monaco"
+
+/**
+ * Defines where the monaco (v1) environments.yaml comes from. Only one of Resource and Inline can be set, e.g:
+ * environments:
+ *   resource: dynatrace/environments.yaml
+ * If neither is set the environments.yaml is generated for the resolved Dynatrace credentials
+ */
+type MonacoEnvironmentsConfig struct {
+	// Resource is a Keptn resource that is looked up on service, stage and project level
+	Resource string `json:"resource,omitempty" yaml:"resource,omitempty"`
+	// Inline is the content of the environments.yaml
+	Inline yaml.MapSlice `json:"inline,omitempty" yaml:"inline,omitempty"`
+	// Name of the generated environment, defaults to monaco
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+}
+
+// returns the path of the environments.yaml in the temp folder of the keptn context
+func GetMonacoEnvironmentsPath(keptnEvent *BaseKeptnEvent) string {
+	return filepath.Join(filepath.Dir(GetMonacoProjectsFolder(keptnEvent)), MonacoEnvironmentsFilename)
+}
+
+/**
+ * Generates the environments.yaml for the monaco run. The Dynatrace credentials are always passed via the
+ * env variables DT_ENVIRONMENT_URL and DT_API_TOKEN so the generated file works for every tenant
+ */
+func GenerateMonacoEnvironments(environmentName string) string {
+	if environmentName == "" {
+		environmentName = DefaultMonacoEnvironmentName
+	}
+	return fmt.Sprintf(`%s:
+  - name: "%s"
+  - env-url: "{{ .Env.DT_ENVIRONMENT_URL }}"
+  - env-token-name: "DT_API_TOKEN"
+`, environmentName, environmentName)
+}
+
+/**
+ * Writes the environments.yaml for this run into the temp folder of the keptn context,
+ * either from the Keptn resource, the inline block or generated
+ */
+func PrepareMonacoEnvironmentsFile(keptnEvent *BaseKeptnEvent, monacoConfigFile *MonacoConfigFile) error {
+	environments := &MonacoEnvironmentsConfig{}
+	if monacoConfigFile != nil && monacoConfigFile.Environments != nil {
+		environments = monacoConfigFile.Environments
+	}
+
+	if environments.Resource != "" && len(environments.Inline) > 0 {
+		return errors.New("Only one of environments.resource and environments.inline can be set in " + MonacoConfigFilename)
+	}
+
+	content := ""
+	switch {
+	case environments.Resource != "":
+		resourceContent, err := GetKeptnResource(keptnEvent, environments.Resource)
+		if err != nil || resourceContent == "" {
+			return fmt.Errorf("Could not load environments file %s for project=%s,stage=%s,service=%s: %v", environments.Resource, keptnEvent.Project, keptnEvent.Stage, keptnEvent.Service, err)
+		}
+		log.Printf("Using environments file %s", environments.Resource)
+		content = resourceContent
+	case len(environments.Inline) > 0:
+		inlineContent, err := yaml.Marshal(environments.Inline)
+		if err != nil {
+			return fmt.Errorf("Could not convert inline environments: %v", err)
+		}
+		log.Printf("Using inline environments from %s", MonacoConfigFilename)
+		content = string(inlineContent)
+	default:
+		log.Printf("Generating environments file for the Dynatrace credentials")
+		content = GenerateMonacoEnvironments(environments.Name)
+	}
+
+	return CopyFileContentToDestination(content, GetMonacoEnvironmentsPath(keptnEvent))
+}
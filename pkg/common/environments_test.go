@@ -0,0 +1,48 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Tests that the environments.yaml is generated or taken from the inline block of monaco.conf.yaml
+func TestPrepareMonacoEnvironmentsFile(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "environments-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+	os.MkdirAll(GetMonacoProjectsFolder(keptnEvent), os.ModePerm)
+
+	err := PrepareMonacoEnvironmentsFile(keptnEvent, &MonacoConfigFile{Environments: &MonacoEnvironmentsConfig{Name: "dev"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(GetMonacoEnvironmentsPath(keptnEvent))
+	if !strings.HasPrefix(string(content), "dev:\n") || !strings.Contains(string(content), "{{ .Env.DT_ENVIRONMENT_URL }}") {
+		t.Errorf("Unexpected generated environments.yaml: %s", content)
+	}
+
+	monacoConfigFile, err := parseMonacoConfigFile([]byte(`
+environments:
+  inline:
+    primary:
+      - name: "primary"
+      - env-url: "https://primary.live.dynatrace.com"
+      - env-token-name: "DT_API_TOKEN"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PrepareMonacoEnvironmentsFile(keptnEvent, monacoConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadFile(GetMonacoEnvironmentsPath(keptnEvent))
+	environments := map[string][]map[string]string{}
+	err = yaml.Unmarshal(content, &environments)
+	if err != nil || len(environments["primary"]) != 3 || environments["primary"][1]["env-url"] != "https://primary.live.dynatrace.com" {
+		t.Errorf("Unexpected inline environments.yaml: %s (%v)", content, err)
+	}
+}
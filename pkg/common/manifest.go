@@ -0,0 +1,152 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+/**
+ * Support for the monaco v2 project format that is described by a manifest.yaml, e.g:
+ * manifestVersion: 1.0
+ * projects:
+ *   - name: infrastructure
+ *     path: projects/infrastructure
+ * environmentGroups:
+ *   - name: default
+ *     environments:
+ *       - name: dev
+ *         url:
+ *           type: environment
+ *           value: DT_ENVIRONMENT_URL
+ *         auth:
+ *           token:
+ *             name: DT_API_TOKEN
+ */
+const MonacoManifestFilename = "manifest.yaml"
+const MonacoManifestResource = "dynatrace/manifest.yaml"
+const MonacoV2Executable = "./monaco-v2"
+
+type MonacoManifest struct {
+	ManifestVersion   string                           `yaml:"manifestVersion"`
+	Projects          []MonacoManifestProject          `yaml:"projects"`
+	EnvironmentGroups []MonacoManifestEnvironmentGroup `yaml:"environmentGroups"`
+}
+
+type MonacoManifestProject struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path,omitempty"`
+}
+
+type MonacoManifestEnvironmentGroup struct {
+	Name         string                      `yaml:"name"`
+	Environments []MonacoManifestEnvironment `yaml:"environments"`
+}
+
+type MonacoManifestEnvironment struct {
+	Name string `yaml:"name"`
+}
+
+// returns the path of the manifest.yaml in the temp folder of the keptn context
+func GetMonacoManifestPath(keptnEvent *BaseKeptnEvent) string {
+	return filepath.Join(filepath.Dir(GetMonacoProjectsFolder(keptnEvent)), MonacoManifestFilename)
+}
+
+/**
+ * Loads the manifest.yaml from the temp folder of the keptn context
+ * Returns nil if there is no manifest, e.g: the files are in the monaco v1 format
+ */
+func GetMonacoManifest(keptnEvent *BaseKeptnEvent) (*MonacoManifest, error) {
+	manifestPath := GetMonacoManifestPath(keptnEvent)
+	content, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &MonacoManifest{}
+	err = yaml.Unmarshal(content, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", manifestPath, err)
+	}
+	return manifest, nil
+}
+
+/**
+ * Returns the manifest environment for the Keptn stage. The environment is either
+ * 1: explicitly mapped to the stage in monaco.conf.yaml (manifestEnvironments)
+ * 2: the environment with the same name as the stage
+ * 3: the only environment of the manifest
+ */
+func (manifest *MonacoManifest) EnvironmentForStage(stage string, manifestEnvironments map[string]string) (string, error) {
+	environments := []string{}
+	for _, group := range manifest.EnvironmentGroups {
+		for _, environment := range group.Environments {
+			environments = append(environments, environment.Name)
+		}
+	}
+
+	candidate := stage
+	if mapped, ok := manifestEnvironments[stage]; ok {
+		candidate = mapped
+	}
+	for _, environment := range environments {
+		if environment == candidate {
+			return environment, nil
+		}
+	}
+
+	if len(environments) == 1 && manifestEnvironments[stage] == "" {
+		return environments[0], nil
+	}
+	return "", fmt.Errorf("Could not find environment '%s' for stage %s in %s, available environments: %v", candidate, stage, MonacoManifestFilename, environments)
+}
+
+// HasProject returns true if the manifest defines a project with that name
+func (manifest *MonacoManifest) HasProject(name string) bool {
+	for _, project := range manifest.Projects {
+		if project.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Executes monaco v2 for the manifest in the temp folder, e.g: monaco-v2 deploy manifest.yaml --environment dev --project infrastructure
+ * Projects that are not part of the manifest are ignored. If none of the projects is part of the manifest all projects are deployed
+ */
+func ExecuteMonacoV2(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, manifest *MonacoManifest, environment string, projects string, verbose bool, dryrun bool, env map[string]string) (string, error) {
+
+	cmd := exec.Command(MonacoV2Executable, "deploy", GetMonacoManifestPath(keptnEvent), "--environment", environment)
+
+	for _, project := range SplitMonacoProjects(projects) {
+		if manifest.HasProject(project) {
+			cmd.Args = append(cmd.Args, "--project", project)
+		} else {
+			log.Printf("Ignoring monaco project %s as it is not part of %s\n", project, MonacoManifestFilename)
+		}
+	}
+	if verbose {
+		cmd.Args = append(cmd.Args, "--verbose")
+	}
+	if dryrun {
+		cmd.Args = append(cmd.Args, "--dry-run")
+	}
+
+	// Set environment variables to be used in monaco
+	cmd.Env = GetMonacoEnvironment(dtCredentials, keptnEvent, env)
+
+	log.Printf("Monaco command: %v\n", cmd.String())
+	stdoutStderr, err := cmd.CombinedOutput()
+	log.Printf("%s\n", MaskSecrets(string(stdoutStderr)))
+
+	return string(stdoutStderr), err
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const testMonacoManifest = `manifestVersion: 1.0
+projects:
+  - name: infrastructure
+    path: projects/infrastructure
+environmentGroups:
+  - name: nonprod
+    environments:
+      - name: dev
+      - name: hardening
+  - name: prod
+    environments:
+      - name: production
+`
+
+// Tests the mapping of Keptn stages to monaco v2 manifest environments
+func TestMonacoManifestEnvironmentForStage(t *testing.T) {
+	manifest := &MonacoManifest{}
+	err := yaml.Unmarshal([]byte(testMonacoManifest), manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := map[string]string{"prod": "production"}
+
+	tests := []struct {
+		stage    string
+		expected string
+		fails    bool
+	}{
+		{stage: "dev", expected: "dev"},
+		{stage: "prod", expected: "production"},
+		{stage: "staging", fails: true},
+	}
+
+	for _, test := range tests {
+		environment, err := manifest.EnvironmentForStage(test.stage, mapping)
+		if test.fails {
+			if err == nil {
+				t.Errorf("Expected error for stage %s, got environment %s", test.stage, environment)
+			}
+			continue
+		}
+		if err != nil || environment != test.expected {
+			t.Errorf("Expected environment %s for stage %s, got %s (%v)", test.expected, test.stage, environment, err)
+		}
+	}
+
+	if !manifest.HasProject("infrastructure") || manifest.HasProject("sockshop") {
+		t.Errorf("HasProject returned unexpected results")
+	}
+}
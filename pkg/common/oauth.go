@@ -0,0 +1,120 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultOAuthTokenEndpoint is used if the credentials contain an OAuth client but no DT_TOKEN_ENDPOINT
+const DefaultOAuthTokenEndpoint = "https://sso.dynatrace.com/sso/oauth2/token"
+
+// tokens are refreshed this long before they expire so they don't expire during a request
+const oauthTokenExpiryDelta = 30 * time.Second
+
+/**
+ * OAuthTokenSource gets access tokens for the Dynatrace platform APIs with the OAuth client credentials flow.
+ * The token is cached and refreshed shortly before it expires
+ */
+type OAuthTokenSource struct {
+	TokenEndpoint string
+	ClientID      string
+	ClientSecret  string
+	HTTPClient    *http.Client
+
+	mutex       sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+// response of the OAuth token endpoint
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// token sources by token endpoint and client id so every client only gets a new token when the cached one expires
+var oauthTokenSources = struct {
+	sync.Mutex
+	sources map[string]*OAuthTokenSource
+}{sources: map[string]*OAuthTokenSource{}}
+
+/**
+ * Returns the token source for the OAuth client of the credentials. Token sources are shared by all events
+ */
+func GetOAuthTokenSource(dtCredentials *DTCredentials, httpClient *http.Client) *OAuthTokenSource {
+	tokenEndpoint := dtCredentials.TokenEndpoint
+	if tokenEndpoint == "" {
+		tokenEndpoint = DefaultOAuthTokenEndpoint
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	oauthTokenSources.Lock()
+	defer oauthTokenSources.Unlock()
+	key := tokenEndpoint + "|" + dtCredentials.ClientID
+	source, ok := oauthTokenSources.sources[key]
+	if !ok || source.ClientSecret != dtCredentials.ClientSecret {
+		source = &OAuthTokenSource{TokenEndpoint: tokenEndpoint, ClientID: dtCredentials.ClientID, ClientSecret: dtCredentials.ClientSecret, HTTPClient: httpClient}
+		oauthTokenSources.sources[key] = source
+	}
+	return source
+}
+
+// Token returns a valid access token, a new one is requested if there is none yet or it is about to expire
+func (source *OAuthTokenSource) Token() (string, error) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	if source.accessToken != "" && time.Now().Add(oauthTokenExpiryDelta).Before(source.expiry) {
+		return source.accessToken, nil
+	}
+
+	accessToken, expiresIn, err := source.requestToken()
+	if err != nil {
+		return "", err
+	}
+	AddMaskedSecret(accessToken)
+	source.accessToken = accessToken
+	source.expiry = time.Now().Add(expiresIn)
+	return accessToken, nil
+}
+
+func (source *OAuthTokenSource) requestToken() (string, time.Duration, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", source.ClientID)
+	form.Set("client_secret", source.ClientSecret)
+
+	resp, err := source.HTTPClient.Post(source.TokenEndpoint, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("Error requesting an OAuth token from %s: %v", source.TokenEndpoint, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("Error reading the OAuth token response of %s: %v", source.TokenEndpoint, err)
+	}
+
+	tokenResponse := oauthTokenResponse{}
+	parseErr := json.Unmarshal(body, &tokenResponse)
+	if resp.StatusCode != http.StatusOK {
+		if parseErr == nil && tokenResponse.Error != "" {
+			return "", 0, fmt.Errorf("OAuth client %s was rejected by %s: %s %s", source.ClientID, source.TokenEndpoint, tokenResponse.Error, tokenResponse.ErrorDescription)
+		}
+		return "", 0, fmt.Errorf("OAuth client %s was rejected by %s with status %d", source.ClientID, source.TokenEndpoint, resp.StatusCode)
+	}
+	if parseErr != nil || tokenResponse.AccessToken == "" {
+		return "", 0, fmt.Errorf("Invalid OAuth token response of %s: %s", source.TokenEndpoint, string(body))
+	}
+	return tokenResponse.AccessToken, time.Duration(tokenResponse.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeOAuthServer issues access tokens for the client, valid for expiresIn seconds, and counts the token requests
+type fakeOAuthServer struct {
+	clientID     string
+	clientSecret string
+	expiresIn    int
+	requests     int
+}
+
+func (server *fakeOAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != server.clientID || r.Form.Get("client_secret") != server.clientSecret {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_client", "error_description": "Client authentication failed"}`))
+		return
+	}
+	server.requests++
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": fmt.Sprintf("access-token-%d", server.requests), "token_type": "Bearer", "expires_in": server.expiresIn})
+}
+
+func TestOAuthTokenSource(t *testing.T) {
+	oauthServer := &fakeOAuthServer{clientID: "dt0s02.client", clientSecret: "dt0s02.client.secret", expiresIn: 300}
+	server := httptest.NewServer(oauthServer)
+	defer server.Close()
+
+	dtCredentials := &DTCredentials{Tenant: "https://abc12345.apps.dynatrace.com", ClientID: "dt0s02.client", ClientSecret: "dt0s02.client.secret", TokenEndpoint: server.URL + "/sso/oauth2/token"}
+	for i := 0; i < 3; i++ {
+		token, err := GetOAuthTokenSource(dtCredentials, server.Client()).Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "access-token-1" {
+			t.Errorf("Expected the cached token, got %s", token)
+		}
+	}
+	if oauthServer.requests != 1 {
+		t.Errorf("Expected a single token request, got %d", oauthServer.requests)
+	}
+
+	// tokens that expire within oauthTokenExpiryDelta are refreshed
+	oauthServer.expiresIn = 10
+	dtCredentials.TokenEndpoint = server.URL + "/refresh"
+	source := GetOAuthTokenSource(dtCredentials, server.Client())
+	source.Token()
+	token, _ := source.Token()
+	if oauthServer.requests != 3 || token != "access-token-3" {
+		t.Errorf("Expected the token to be refreshed, got %s after %d requests", token, oauthServer.requests)
+	}
+
+	dtCredentials.ClientSecret = "wrong"
+	_, err := GetOAuthTokenSource(dtCredentials, server.Client()).Token()
+	if err == nil || !strings.Contains(err.Error(), "invalid_client Client authentication failed") {
+		t.Errorf("Expected the error of the token endpoint, got %v", err)
+	}
+}
+
+// Tests that the Dynatrace API is called with an access token of the OAuth client if there is no API token
+func TestDynatraceClientOAuth(t *testing.T) {
+	oauthServer := &fakeOAuthServer{clientID: "dt0s02.native", clientSecret: "dt0s02.native.secret", expiresIn: 300}
+	mux := http.NewServeMux()
+	mux.Handle("/sso/oauth2/token", oauthServer)
+	mux.HandleFunc("/api/config/v1/autoTags", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access-token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"values": [{"id": "tag-1", "name": "keptn"}]}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dtCredentials, err := newDTCredentials(map[string]string{"DT_TENANT": server.URL, "DT_CLIENT_ID": "dt0s02.native", "DT_CLIENT_SECRET": "dt0s02.native.secret", "DT_TOKEN_ENDPOINT": server.URL + "/sso/oauth2/token"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := NewDynatraceClient(dtCredentials, server.Client()).ListConfigs("/api/config/v1/autoTags")
+	if err != nil || len(configs) != 1 {
+		t.Errorf("Expected the configs to be listed with the OAuth token, got %v %v", configs, err)
+	}
+
+	err = ValidateDTCredentials(dtCredentials, RequiredTokenScopes([]string{"auto-tag"}, true), server.Client())
+	if err != nil {
+		t.Errorf("Unexpected error validating OAuth credentials: %v", err)
+	}
+
+	env := MonacoEnvironmentAsMap(GetMonacoEnvironment(dtCredentials, &BaseKeptnEvent{}, nil))
+	if env["DT_CLIENT_ID"] != "dt0s02.native" || env["DT_CLIENT_SECRET"] != "dt0s02.native.secret" || env["DT_TOKEN_ENDPOINT"] != server.URL+"/sso/oauth2/token" {
+		t.Errorf("Expected the OAuth client to be passed to monaco, got %v", env)
+	}
+}
+
+func TestNewDTCredentialsOAuth(t *testing.T) {
+	dtCredentials, err := newDTCredentials(map[string]string{"DT_TENANT": "abc12345.apps.dynatrace.com", "DT_CLIENT_ID": "dt0s02.client", "DT_CLIENT_SECRET": "secret"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dtCredentials.TokenEndpoint != DefaultOAuthTokenEndpoint || dtCredentials.Tenant != "https://abc12345.apps.dynatrace.com" {
+		t.Errorf("Unexpected credentials %+v", dtCredentials)
+	}
+
+	_, err = newDTCredentials(map[string]string{"DT_TENANT": "abc12345.apps.dynatrace.com", "DT_API_TOKEN": "dt0c01.token", "DT_CLIENT_ID": "dt0s02.client"}, "test")
+	if err == nil || !strings.Contains(err.Error(), "DT_CLIENT_SECRET") {
+		t.Errorf("Expected an error for the missing client secret, got %v", err)
+	}
+	_, err = newDTCredentials(map[string]string{"DT_TENANT": "abc12345.apps.dynatrace.com", "DT_PLATFORM_TOKEN": "dt0s16.token"}, "test")
+	if err != nil {
+		t.Errorf("Expected a platform token to be enough, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+/**
+ * Escape functions for placeholder values, e.g: urlquery for values used in URLs, json for values used in JSON strings and none for secret names
+ */
+const PlaceholderEscapeNone = "none"
+const PlaceholderEscapeURLQuery = "urlquery"
+const PlaceholderEscapeJSON = "json"
+
+// KeptnPlaceholderData is passed to the placeholder templates, e.g: {{ .Keptn.Project }}, {{ .Labels.owner }} or {{ .Env.DT_TENANT }}
+type KeptnPlaceholderData struct {
+	Keptn  KeptnPlaceholderValues
+	Labels map[string]string
+	Env    map[string]string
+	// Event is the data of the triggering event, e.g: {{ index .Event.deployment.deploymentURIsPublic 0 }}
+	Event map[string]interface{}
+}
+
+// KeptnPlaceholderValues are the values of the Keptn event
+type KeptnPlaceholderValues struct {
+	Context      string
+	Event        string
+	Source       string
+	Project      string
+	Stage        string
+	Service      string
+	Deployment   string
+	TestStrategy string
+
+	DeploymentStrategy string
+	Image              string
+	Tag                string
+
+	DeploymentURIsLocal  []string
+	DeploymentURIsPublic []string
+	DeploymentNames      []string
+}
+
+// legacy $ placeholders and the field of KeptnPlaceholderValues they map to
+var legacyKeptnPlaceholders = map[string]string{
+	"CONTEXT":      "Context",
+	"EVENT":        "Event",
+	"SOURCE":       "Source",
+	"PROJECT":      "Project",
+	"STAGE":        "Stage",
+	"SERVICE":      "Service",
+	"DEPLOYMENT":   "Deployment",
+	"TESTSTRATEGY": "TestStrategy",
+
+	"DEPLOYMENTSTRATEGY": "DeploymentStrategy",
+	"IMAGE":              "Image",
+	"TAG":                "Tag",
+}
+
+// $ followed by the name of the placeholder, e.g: $STAGE, $ENV.DT_TENANT or $LABEL.owner
+var legacyPlaceholderRegex = regexp.MustCompile(`\$([A-Z][A-Z0-9_]*)(\.[\w.\-]+)?`)
+
+var placeholderFuncs = template.FuncMap{
+	PlaceholderEscapeNone: func(value string) string { return value },
+	PlaceholderEscapeJSON: func(value string) string {
+		escaped, _ := json.Marshal(value)
+		return string(escaped[1 : len(escaped)-1])
+	},
+}
+
+// returns the values that can be used in placeholders for the keptn event
+func GetKeptnPlaceholderData(keptnEvent *BaseKeptnEvent) *KeptnPlaceholderData {
+	data := &KeptnPlaceholderData{
+		Keptn: KeptnPlaceholderValues{
+			Context:      keptnEvent.Context,
+			Event:        keptnEvent.Event,
+			Source:       keptnEvent.Source,
+			Project:      keptnEvent.Project,
+			Stage:        keptnEvent.Stage,
+			Service:      keptnEvent.Service,
+			Deployment:   keptnEvent.Deployment,
+			TestStrategy: keptnEvent.TestStrategy,
+
+			DeploymentStrategy: keptnEvent.DeploymentStrategy,
+			Image:              keptnEvent.Image,
+			Tag:                keptnEvent.Tag,
+
+			DeploymentURIsLocal:  keptnEvent.DeploymentURIsLocal,
+			DeploymentURIsPublic: keptnEvent.DeploymentURIsPublic,
+			DeploymentNames:      keptnEvent.DeploymentNames,
+		},
+		Labels: map[string]string{},
+		Env:    MonacoEnvironmentAsMap(os.Environ()),
+		Event:  keptnEvent.Data,
+	}
+	if data.Event == nil {
+		data.Event = map[string]interface{}{}
+	}
+	for key, value := range keptnEvent.Labels {
+		data.Labels[key] = value
+	}
+	return data
+}
+
+/**
+ * Renders the placeholders of the input, either as Go template, e.g: {{ .Keptn.Project }}, {{ .Labels.owner | urlquery }}, {{ .Env.X }}
+ * or in the legacy $ syntax:
+ * $CONTEXT, $EVENT, $SOURCE
+ * $PROJECT, $STAGE, $SERVICE, $DEPLOYMENT
+ * $TESTSTRATEGY, $DEPLOYMENTSTRATEGY, $IMAGE, $TAG
+ * $LABEL.XXXX  -> the label called XXXX
+ * $ENV.XXXX    -> the env variable called XXXX
+ * $SECRET.YYYY.XXXX -> the key XXXX of the k8s secret called YYYY, in templates: {{ secret "YYYY" "XXXX" }}
+ * The longest label, env variable or secret key that matches wins, e.g: $LABEL.owner-id is the label owner-id if it exists, otherwise the label owner followed by -id
+ * Values of $ placeholders are escaped with the escape function: none, urlquery or json. Unknown placeholders are an error
+ */
+func RenderKeptnPlaceholders(input string, keptnEvent *BaseKeptnEvent, escape string) (string, error) {
+	if _, ok := placeholderFuncs[escape]; !ok && escape != PlaceholderEscapeURLQuery {
+		return "", fmt.Errorf("Unknown escape function %s, use %s, %s or %s", escape, PlaceholderEscapeNone, PlaceholderEscapeURLQuery, PlaceholderEscapeJSON)
+	}
+	data := GetKeptnPlaceholderData(keptnEvent)
+
+	// the legacy placeholders are converted into template actions so that their values are never rendered again
+	var convertErr error
+	converted := legacyPlaceholderRegex.ReplaceAllStringFunc(input, func(placeholder string) string {
+		action, err := convertLegacyPlaceholder(placeholder, keptnEvent, data, escape)
+		if err != nil && convertErr == nil {
+			convertErr = err
+		}
+		return action
+	})
+	if convertErr != nil {
+		return "", convertErr
+	}
+
+	tmpl, err := NewKeptnTemplate("placeholders", keptnEvent).Parse(converted)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing placeholders of '%s': %v", input, err)
+	}
+	var result bytes.Buffer
+	err = tmpl.Execute(&result, data)
+	if err != nil {
+		return "", fmt.Errorf("Error rendering placeholders of '%s': %v", input, err)
+	}
+	return result.String(), nil
+}
+
+/**
+ * Returns a template with the escape functions none, urlquery and json and the function secret, e.g: {{ secret "dynatrace" "DT_TENANT" }}
+ * Executing it with missing map keys is an error
+ */
+func NewKeptnTemplate(name string, keptnEvent *BaseKeptnEvent) *template.Template {
+	funcs := template.FuncMap{
+		"secret": func(secretName string, key string) (string, error) {
+			return getKeptnSecretValue(keptnEvent, secretName, key)
+		},
+	}
+	return template.New(name).Funcs(placeholderFuncs).Funcs(funcs).Option("missingkey=error")
+}
+
+// converts a $ placeholder into a template action, anything after the placeholder name is kept as text
+func convertLegacyPlaceholder(placeholder string, keptnEvent *BaseKeptnEvent, data *KeptnPlaceholderData, escape string) (string, error) {
+	match := legacyPlaceholderRegex.FindStringSubmatch(placeholder)
+	name, suffix := match[1], strings.TrimPrefix(match[2], ".")
+
+	switch name {
+	case "SECRET":
+		// secret names may contain dots, e.g: $SECRET.dynatrace.production.DT_API_TOKEN, the longest secret name that has the key wins
+		var resolveErr error
+		for end := strings.LastIndex(suffix, "."); end > 0; end = strings.LastIndex(suffix[:end], ".") {
+			secretName, rest := suffix[:end], suffix[end+1:]
+			if rest == "" {
+				continue
+			}
+			secret, err := GetKeptnSecret(keptnEvent, secretName)
+			if err != nil {
+				resolveErr = fmt.Errorf("Error resolving %s: %v", placeholder, err)
+				continue
+			}
+			key := longestPlaceholderMatch(rest, secret)
+			if key == "" {
+				resolveErr = fmt.Errorf("Unknown placeholder %s, secret %s has no such key", placeholder, secretName)
+				continue
+			}
+			return fmt.Sprintf(`{{ secret %q %q | %s }}`, secretName, key, escape) + rest[len(key):], nil
+		}
+		if resolveErr == nil {
+			return "", fmt.Errorf("Invalid placeholder %s, use $SECRET.<secret>.<key>", placeholder)
+		}
+		return "", resolveErr
+	case "LABEL", "ENV":
+		values := data.Labels
+		if name == "ENV" {
+			values = data.Env
+		}
+		key := longestPlaceholderMatch(suffix, values)
+		if key == "" {
+			return "", fmt.Errorf("Unknown placeholder %s", placeholder)
+		}
+		field := "Labels"
+		if name == "ENV" {
+			field = "Env"
+		}
+		return fmt.Sprintf(`{{ index .%s %q | %s }}`, field, key, escape) + suffix[len(key):], nil
+	}
+
+	field, ok := legacyKeptnPlaceholders[name]
+	if !ok {
+		return "", fmt.Errorf("Unknown placeholder $%s", name)
+	}
+	return fmt.Sprintf(`{{ .Keptn.%s | %s }}`, field, escape) + match[2], nil
+}
+
+/**
+ * Returns the longest key of the values the text starts with, empty if no key matches.
+ * A key only matches if it isn't followed by another word character, e.g: FOO doesn't match FOOBAR but FOO-BAR
+ */
+func longestPlaceholderMatch(text string, values map[string]string) string {
+	key := ""
+	for candidate := range values {
+		if len(candidate) > len(key) && (text == candidate || strings.HasPrefix(text, candidate) && !isPlaceholderWordChar(text[len(candidate)])) {
+			key = candidate
+		}
+	}
+	return key
+}
+
+func isPlaceholderWordChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
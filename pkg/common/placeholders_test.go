@@ -0,0 +1,77 @@
+package common
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRenderKeptnPlaceholders(t *testing.T) {
+	os.Setenv("MONACO_TEST_FOO", "foo")
+	os.Setenv("MONACO_TEST_FOOBAR", "foo&bar")
+	defer os.Unsetenv("MONACO_TEST_FOO")
+	defer os.Unsetenv("MONACO_TEST_FOOBAR")
+
+	keptnEvent := &BaseKeptnEvent{Project: "sockshop", Stage: "dev", Service: "carts", Labels: map[string]string{"owner": "John Doe", "owner-team": "sre", "quote": `say "hi"`}}
+
+	tests := []struct {
+		input    string
+		escape   string
+		expected string
+	}{
+		{"dynatrace-$PROJECT-$STAGE", PlaceholderEscapeNone, "dynatrace-sockshop-dev"},
+		{"$SERVICE.$STAGE", PlaceholderEscapeNone, "carts.dev"},
+		{"$ENV.MONACO_TEST_FOOBAR", PlaceholderEscapeNone, "foo&bar"},
+		{"$ENV.MONACO_TEST_FOO-$ENV.MONACO_TEST_FOOBAR", PlaceholderEscapeURLQuery, "foo-foo%26bar"},
+		{"$LABEL.owner-team", PlaceholderEscapeNone, "sre"},
+		{"$LABEL.owner-x", PlaceholderEscapeURLQuery, "John+Doe-x"},
+		{"$LABEL.quote", PlaceholderEscapeJSON, `say \"hi\"`},
+		{"{{ .Keptn.Project }}-{{ .Labels.owner | urlquery }}", PlaceholderEscapeNone, "sockshop-John+Doe"},
+		{"{{ .Env.MONACO_TEST_FOO }}", PlaceholderEscapeNone, "foo"},
+		{"costs $1", PlaceholderEscapeNone, "costs $1"},
+	}
+	for _, test := range tests {
+		result, err := RenderKeptnPlaceholders(test.input, keptnEvent, test.escape)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.input, err)
+			continue
+		}
+		if result != test.expected {
+			t.Errorf("Expected %s for %s, got %s", test.expected, test.input, result)
+		}
+	}
+}
+
+// Tests that placeholders that don't exist are reported instead of being left in the result
+func TestRenderKeptnPlaceholdersUnknown(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Project: "sockshop", Labels: map[string]string{"owner": "John"}}
+
+	for _, input := range []string{"$SERVICE_NAME", "$ENV.MONACO_TEST_NOT_SET", "$LABEL.ownerid", "{{ .Labels.team }}", "{{ .Keptn.Cluster }}"} {
+		_, err := RenderKeptnPlaceholders(input, keptnEvent, PlaceholderEscapeNone)
+		if err == nil {
+			t.Errorf("Expected an error for %s", input)
+		}
+	}
+
+	_, err := RenderKeptnPlaceholders("$PROJECT", keptnEvent, "base64")
+	if err == nil {
+		t.Errorf("Expected an error for an unknown escape function")
+	}
+}
+
+// Tests that the deployment data is available as template values and monaco env variables
+func TestDeploymentDataPlaceholders(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Project: "sockshop", Image: "keptnexamples/carts:0.12.1", Tag: "0.12.1", DeploymentURIsPublic: []string{"http://carts.example.com", "http://carts2.example.com"}}
+
+	result, err := RenderKeptnPlaceholders("$TAG {{ index .Keptn.DeploymentURIsPublic 0 }}", keptnEvent, PlaceholderEscapeNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "0.12.1 http://carts.example.com" {
+		t.Errorf("Unexpected result %s", result)
+	}
+
+	env := MonacoEnvironmentAsMap(GetMonacoEnvironment(&DTCredentials{}, keptnEvent, nil))
+	if env["KEPTN_IMAGE"] != keptnEvent.Image || env["KEPTN_DEPLOYMENT_URI_PUBLIC"] != "http://carts.example.com" || env["KEPTN_DEPLOYMENT_URIS_PUBLIC"] != "http://carts.example.com,http://carts2.example.com" {
+		t.Errorf("Unexpected env variables %v", env)
+	}
+}
@@ -0,0 +1,280 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+/**
+ * Actions of a plan, on config level a config is added, changed, unchanged or removed, on field level a field is added, changed or removed
+ */
+const MonacoDiffActionAdded = "added"
+const MonacoDiffActionChanged = "changed"
+const MonacoDiffActionRemoved = "removed"
+const MonacoDiffActionUnchanged = "unchanged"
+
+// fields Dynatrace adds to every config, they are ignored even if a template contains them
+var monacoPlanIgnoredFields = map[string]bool{"id": true, "metadata": true}
+
+// MonacoFieldChange is a single changed JSON field of a config, e.g: rules[0].tagKey
+type MonacoFieldChange struct {
+	Path    string      `json:"path"`
+	Action  string      `json:"action"`
+	Current interface{} `json:"current,omitempty"`
+	Desired interface{} `json:"desired,omitempty"`
+}
+
+// MonacoConfigDiff is the difference between the rendered config and the config in Dynatrace
+type MonacoConfigDiff struct {
+	Project    string               `json:"project"`
+	ConfigType string               `json:"configType"`
+	ConfigName string               `json:"configName"`
+	Action     string               `json:"action"`
+	EntityID   string               `json:"entityId,omitempty"`
+	Changes    []*MonacoFieldChange `json:"changes,omitempty"`
+	Error      string               `json:"error,omitempty"`
+}
+
+// MonacoPlan lists what applying the monaco projects would change in Dynatrace
+type MonacoPlan struct {
+	Configs []*MonacoConfigDiff `json:"configs"`
+}
+
+// Counts the configs in the plan with the passed action
+func (plan *MonacoPlan) CountByAction(action string) int {
+	count := 0
+	for _, config := range plan.Configs {
+		if config.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+/**
+ * Renders every config of the monaco (v1) projects and compares it with the config of the same name in Dynatrace.
+ * Only reads from the Dynatrace Configuration API, nothing is created or updated.
+ * References to other configs are resolved to the existing Dynatrace ids, configs that don't exist yet are referenced by their monaco id.
+ * The configs of delete.yaml and the removed configs, e.g: configs a previous run deployed, are planned as removed if they exist in Dynatrace
+ */
+func PlanMonacoProjects(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, removed []*MonacoDeleteEntry, additionalEnv map[string]string, httpClient *http.Client) (*MonacoPlan, error) {
+	plan := &MonacoPlan{Configs: []*MonacoConfigDiff{}}
+
+	if FileExists(GetMonacoManifestPath(keptnEvent)) {
+		return plan, fmt.Errorf("Planning is not supported for monaco v2 projects (%s)", MonacoManifestFilename)
+	}
+
+	configs, err := LoadMonacoProjects(GetMonacoProjectsFolder(keptnEvent), SplitMonacoProjects(projects))
+	if err != nil {
+		return plan, err
+	}
+
+	env := MonacoEnvironmentAsMap(GetMonacoEnvironment(dtCredentials, keptnEvent, additionalEnv))
+	client := NewDynatraceClient(dtCredentials, httpClient)
+
+	existingConfigs := map[string][]DynatraceConfigObject{}
+	planned := map[string]DynatraceConfigObject{}
+	failedCount := 0
+
+	for _, config := range configs {
+		diff := &MonacoConfigDiff{Project: config.Project, ConfigType: config.ConfigType, ConfigName: config.ConfigId}
+		plan.Configs = append(plan.Configs, diff)
+
+		err := planMonacoConfig(client, config, env, existingConfigs, planned, diff)
+		if err != nil {
+			diff.Error = err.Error()
+			failedCount++
+		}
+	}
+
+	deleteEntries, err := LoadMonacoDeleteFile(keptnEvent)
+	if err != nil {
+		return plan, err
+	}
+	removing := map[string]bool{}
+	for _, entry := range append(deleteEntries, removed...) {
+		if removing[entry.ConfigType+"/"+entry.Name] {
+			continue
+		}
+		removing[entry.ConfigType+"/"+entry.Name] = true
+
+		diff, err := planMonacoDeletion(client, entry, existingConfigs)
+		if err != nil {
+			diff.Error = err.Error()
+			failedCount++
+		}
+		if diff.Action != "" {
+			plan.Configs = append(plan.Configs, diff)
+		}
+	}
+
+	if failedCount > 0 {
+		return plan, fmt.Errorf("%d of %d configs could not be planned", failedCount, len(plan.Configs))
+	}
+	return plan, nil
+}
+
+// plans the deletion of the config, the action stays empty if the config doesn't exist in Dynatrace
+func planMonacoDeletion(client *DynatraceClient, entry *MonacoDeleteEntry, existingConfigs map[string][]DynatraceConfigObject) (*MonacoConfigDiff, error) {
+	diff := &MonacoConfigDiff{Project: entry.Project, ConfigType: entry.ConfigType, ConfigName: entry.ConfigName}
+	if diff.ConfigName == "" {
+		diff.ConfigName = entry.Name
+	}
+
+	apiPath, ok := MonacoConfigApis[entry.ConfigType]
+	if !ok {
+		diff.Action = MonacoDiffActionRemoved
+		return diff, fmt.Errorf("Config type %s is not supported", entry.ConfigType)
+	}
+	if _, ok := existingConfigs[apiPath]; !ok {
+		configs, err := client.ListConfigs(apiPath)
+		if err != nil {
+			diff.Action = MonacoDiffActionRemoved
+			return diff, err
+		}
+		existingConfigs[apiPath] = configs
+	}
+
+	for _, existing := range existingConfigs[apiPath] {
+		if existing.Name == entry.Name {
+			diff.Action = MonacoDiffActionRemoved
+			diff.EntityID = existing.ID
+			break
+		}
+	}
+	return diff, nil
+}
+
+/**
+ * Renders the config and looks up the config with the same name in Dynatrace. The configs of an API are only listed once.
+ * Returns the rendered payload, the name and the id of the existing config, empty if the config doesn't exist yet
+ */
+func lookupMonacoConfig(client *DynatraceClient, config *MonacoConfig, env map[string]string, existingConfigs map[string][]DynatraceConfigObject, known map[string]DynatraceConfigObject) ([]byte, string, string, error) {
+	payload, name, err := RenderMonacoConfig(config, env, known)
+	if err != nil {
+		return nil, name, "", err
+	}
+
+	apiPath := MonacoConfigApis[config.ConfigType]
+	if _, ok := existingConfigs[apiPath]; !ok {
+		existingConfigs[apiPath], err = client.ListConfigs(apiPath)
+		if err != nil {
+			return nil, name, "", err
+		}
+	}
+
+	for _, existing := range existingConfigs[apiPath] {
+		if existing.Name == name {
+			return payload, name, existing.ID, nil
+		}
+	}
+	return payload, name, "", nil
+}
+
+func planMonacoConfig(client *DynatraceClient, config *MonacoConfig, env map[string]string, existingConfigs map[string][]DynatraceConfigObject, planned map[string]DynatraceConfigObject, diff *MonacoConfigDiff) error {
+	payload, name, id, err := lookupMonacoConfig(client, config, env, existingConfigs, planned)
+	if err != nil {
+		return err
+	}
+	apiPath := MonacoConfigApis[config.ConfigType]
+
+	var desired interface{}
+	err = json.Unmarshal(payload, &desired)
+	if err != nil {
+		return fmt.Errorf("Error parsing rendered config %s: %v", config.FullQualifiedId(), err)
+	}
+
+	if id == "" {
+		diff.Action = MonacoDiffActionAdded
+		planned[config.FullQualifiedId()] = DynatraceConfigObject{ID: config.FullQualifiedId(), Name: name}
+		return nil
+	}
+
+	currentPayload, err := client.GetConfig(apiPath, id)
+	if err != nil {
+		return err
+	}
+	var current interface{}
+	err = json.Unmarshal(currentPayload, &current)
+	if err != nil {
+		return fmt.Errorf("Error parsing config %s of %s: %v", id, apiPath, err)
+	}
+
+	diff.EntityID = id
+	diff.Changes = DiffMonacoConfig(current, desired)
+	diff.Action = MonacoDiffActionUnchanged
+	if len(diff.Changes) > 0 {
+		diff.Action = MonacoDiffActionChanged
+	}
+	planned[config.FullQualifiedId()] = DynatraceConfigObject{ID: id, Name: name}
+	return nil
+}
+
+/**
+ * Returns the field level changes between the current and the desired JSON of a config, e.g:
+ * {"name": "a", "rules": [{"key": "x"}]} -> {"name": "b", "rules": []} results in name changed and rules[0] removed
+ * Only the fields of the desired config are compared, fields that only exist in Dynatrace (e.g: defaults like enabled
+ * or the id and metadata of every config) are ignored. Array items are compared by position
+ */
+func DiffMonacoConfig(current interface{}, desired interface{}) []*MonacoFieldChange {
+	changes := []*MonacoFieldChange{}
+	diffMonacoValue("", current, desired, &changes)
+	return changes
+}
+
+func diffMonacoValue(path string, current interface{}, desired interface{}, changes *[]*MonacoFieldChange) {
+	switch {
+	case current == nil && desired == nil:
+		return
+	case current == nil:
+		*changes = append(*changes, &MonacoFieldChange{Path: path, Action: MonacoDiffActionAdded, Desired: desired})
+		return
+	case desired == nil:
+		*changes = append(*changes, &MonacoFieldChange{Path: path, Action: MonacoDiffActionRemoved, Current: current})
+		return
+	}
+
+	currentObject, currentIsObject := current.(map[string]interface{})
+	desiredObject, desiredIsObject := desired.(map[string]interface{})
+	if currentIsObject && desiredIsObject {
+		keys := []string{}
+		for key := range desiredObject {
+			if path != "" || !monacoPlanIgnoredFields[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			diffMonacoValue(fieldPath, currentObject[key], desiredObject[key], changes)
+		}
+		return
+	}
+
+	currentArray, currentIsArray := current.([]interface{})
+	desiredArray, desiredIsArray := desired.([]interface{})
+	if currentIsArray && desiredIsArray {
+		for i := 0; i < len(currentArray) || i < len(desiredArray); i++ {
+			var currentItem, desiredItem interface{}
+			if i < len(currentArray) {
+				currentItem = currentArray[i]
+			}
+			if i < len(desiredArray) {
+				desiredItem = desiredArray[i]
+			}
+			diffMonacoValue(path+"["+strconv.Itoa(i)+"]", currentItem, desiredItem, changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(current, desired) {
+		*changes = append(*changes, &MonacoFieldChange{Path: path, Action: MonacoDiffActionChanged, Current: current, Desired: desired})
+	}
+}
@@ -0,0 +1,119 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// Tests the field level diff of two configs, fields that only exist in Dynatrace are not compared
+func TestDiffMonacoConfig(t *testing.T) {
+	var current, desired interface{}
+	json.Unmarshal([]byte(`{"id": "1", "metadata": {"clusterVersion": "1.2"}, "name": "dev", "description": null, "owner": "team-a", "rules": [{"key": "a", "enabled": true}, {"key": "b"}]}`), &current)
+	json.Unmarshal([]byte(`{"name": "dev", "enabled": true, "owner": null, "rules": [{"key": "c"}]}`), &desired)
+
+	changes := DiffMonacoConfig(current, desired)
+
+	expected := []MonacoFieldChange{
+		{Path: "enabled", Action: MonacoDiffActionAdded},
+		{Path: "owner", Action: MonacoDiffActionRemoved},
+		{Path: "rules[0].key", Action: MonacoDiffActionChanged},
+		{Path: "rules[1]", Action: MonacoDiffActionRemoved},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %d", len(expected), len(changes))
+	}
+	for i, change := range changes {
+		if change.Path != expected[i].Path || change.Action != expected[i].Action {
+			t.Errorf("Expected %s %s, got %s %s", expected[i].Path, expected[i].Action, change.Path, change.Action)
+		}
+	}
+
+	if len(DiffMonacoConfig(desired, desired)) != 0 {
+		t.Errorf("Expected no changes for equal configs")
+	}
+
+	// defaults that Dynatrace adds to a deployed config are no changes
+	json.Unmarshal([]byte(`{"id": "1", "name": "dev", "enabled": true, "rules": [{"key": "a", "propagationTypes": [], "conditions": [{"negate": false}]}]}`), &current)
+	json.Unmarshal([]byte(`{"name": "dev", "rules": [{"key": "a"}]}`), &desired)
+	if changes := DiffMonacoConfig(current, desired); len(changes) != 0 {
+		t.Errorf("Expected no changes for server defaults, got %+v", changes[0])
+	}
+}
+
+// Tests that a plan compares with Dynatrace without changing anything
+func TestPlanMonacoProjects(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "plan-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"monaco/management-zone/zone.yaml": "config:\n  - zone: \"zone.json\"\nzone:\n  - name: \"{{ .Env.KEPTN_PROJECT }}-{{ .Env.KEPTN_STAGE }}\"\n",
+		"monaco/management-zone/zone.json": `{"name": "{{ .name }}", "rules": []}`,
+		"monaco/auto-tag/tagging.yaml":     "config:\n  - tagging: \"tagging.json\"\n  - other: \"other.json\"\ntagging:\n  - name: \"{{ .Env.KEPTN_STAGE }}\"\nother:\n  - name: \"other\"\n",
+		"monaco/auto-tag/tagging.json":     `{"name": "{{ .name }}", "rules": [{"key": "stage"}]}`,
+		"monaco/auto-tag/other.json":       `{"name": "{{ .name }}", "rules": []}`,
+	})
+
+	api := newFakeDynatraceConfigAPI()
+	api.add("/api/config/v1/autoTags", "existing-tag", `{"id": "existing-tag", "name": "dev", "rules": [{"key": "environment"}]}`)
+	api.add("/api/config/v1/autoTags", "other-tag", `{"id": "other-tag", "name": "other", "rules": []}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	plan, err := PlanMonacoProjects(&DTCredentials{Tenant: server.URL, ApiToken: "test-token"}, keptnEvent, "monaco", nil, nil, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.CountByAction(MonacoDiffActionAdded) != 1 || plan.CountByAction(MonacoDiffActionChanged) != 1 || plan.CountByAction(MonacoDiffActionUnchanged) != 1 {
+		t.Errorf("Unexpected plan %+v", plan.Configs)
+	}
+	for _, config := range plan.Configs {
+		if config.ConfigName == "tagging" && (len(config.Changes) != 1 || config.Changes[0].Path != "rules[0].key") {
+			t.Errorf("Expected rules[0].key to change, got %+v", config.Changes)
+		}
+	}
+	if len(api.configs["/api/config/v1/managementZones"]) != 0 || len(api.configs["/api/config/v1/autoTags"]) != 2 {
+		t.Errorf("Expected plan not to change anything in Dynatrace")
+	}
+}
+
+// Tests that the configs of delete.yaml and removed configs are planned as removed if they exist in Dynatrace
+func TestPlanMonacoProjectsRemoved(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "plan-removed-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"monaco/auto-tag/tagging.yaml": "config:\n  - tagging: \"tagging.json\"\ntagging:\n  - name: \"dev\"\n",
+		"monaco/auto-tag/tagging.json": `{"name": "{{ .name }}", "rules": []}`,
+		"delete.yaml":                  "delete:\n  - \"auto-tag/old-tag\"\n  - \"management-zone/unknown zone\"\n",
+	})
+
+	api := newFakeDynatraceConfigAPI()
+	api.add("/api/config/v1/autoTags", "old-tag-id", `{"id": "old-tag-id", "name": "old-tag", "rules": []}`)
+	api.add("/api/config/v1/autoTags", "orphan-id", `{"id": "orphan-id", "name": "orphan", "rules": []}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	removed := []*MonacoDeleteEntry{
+		{Project: "monaco", ConfigType: "auto-tag", ConfigName: "orphan", Name: "orphan"},
+		{Project: "monaco", ConfigType: "auto-tag", ConfigName: "old", Name: "old-tag"},
+	}
+	plan, err := PlanMonacoProjects(&DTCredentials{Tenant: server.URL, ApiToken: "test-token"}, keptnEvent, "monaco", removed, nil, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.CountByAction(MonacoDiffActionAdded) != 1 || plan.CountByAction(MonacoDiffActionRemoved) != 2 || len(plan.Configs) != 3 {
+		t.Errorf("Expected one added and two removed configs, got %+v", plan.Configs)
+	}
+	for _, config := range plan.Configs {
+		if config.Action == MonacoDiffActionRemoved && config.EntityID == "" {
+			t.Errorf("Expected the entity id of the removed config %s", config.ConfigName)
+		}
+	}
+	if len(api.configs["/api/config/v1/autoTags"]) != 2 {
+		t.Errorf("Expected plan not to delete anything in Dynatrace")
+	}
+}
@@ -0,0 +1,88 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * Delimiters of the pre-render templates. They differ from {{ }} so that the templates monaco renders itself, e.g: {{ .name }}, are kept
+ */
+const MonacoPreRenderLeftDelim = "{%"
+const MonacoPreRenderRightDelim = "%}"
+
+// file extensions of the monaco projects that are pre-rendered
+var monacoPreRenderExtensions = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// MonacoPreRenderConfig enables pre-rendering the monaco projects with the Keptn event in monaco.conf.yaml
+type MonacoPreRenderConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Delims overrides the delimiters {% and %}, e.g: ["[[", "]]"]
+	Delims []string `json:"delims,omitempty" yaml:"delims,omitempty"`
+}
+
+/**
+ * Renders the .yaml and .json files of the projects folder of the keptn context with the Keptn event before monaco runs, e.g:
+ * url: "{% index .Event.deployment.deploymentURIsPublic 0 %}"
+ * name: "{% .Keptn.Service %} owned by {% .Labels.owner %}"
+ * The files are rendered with the same data and functions as the placeholders of monaco.conf.yaml
+ * Returns the rendered files relative to the projects folder
+ */
+func PreRenderMonacoProjects(keptnEvent *BaseKeptnEvent, config *MonacoPreRenderConfig) ([]string, error) {
+	leftDelim, rightDelim := MonacoPreRenderLeftDelim, MonacoPreRenderRightDelim
+	if len(config.Delims) > 0 {
+		if len(config.Delims) != 2 || config.Delims[0] == "" || config.Delims[1] == "" {
+			return nil, fmt.Errorf("Invalid preRender delims %v, use a left and a right delimiter", config.Delims)
+		}
+		leftDelim, rightDelim = config.Delims[0], config.Delims[1]
+	}
+
+	projectsFolder := GetMonacoProjectsFolder(keptnEvent)
+	data := GetKeptnPlaceholderData(keptnEvent)
+	rendered := []string{}
+	failures := []string{}
+
+	err := filepath.Walk(projectsFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !monacoPreRenderExtensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(content, []byte(leftDelim)) {
+			return nil
+		}
+
+		relativePath, _ := filepath.Rel(projectsFolder, path)
+		tmpl, err := NewKeptnTemplate(relativePath, keptnEvent).Delims(leftDelim, rightDelim).Parse(string(content))
+		if err != nil {
+			failures = append(failures, err.Error())
+			return nil
+		}
+		var result bytes.Buffer
+		err = tmpl.Execute(&result, data)
+		if err != nil {
+			failures = append(failures, err.Error())
+			return nil
+		}
+
+		rendered = append(rendered, relativePath)
+		return ioutil.WriteFile(path, result.Bytes(), info.Mode())
+	})
+	if err != nil {
+		return rendered, fmt.Errorf("Error pre-rendering monaco projects in %s: %v", projectsFolder, err)
+	}
+	if len(failures) > 0 {
+		return rendered, fmt.Errorf("Error pre-rendering %d monaco files:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	return rendered, nil
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Tests that the Keptn event is rendered into the monaco files while the monaco templates are kept
+func TestPreRenderMonacoProjects(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{
+		Context: "prerender-test", Project: "sockshop", Stage: "dev", Service: "carts",
+		Labels: map[string]string{"owner": "team-a"},
+		Data: map[string]interface{}{
+			"deployment": map[string]interface{}{"deploymentURIsPublic": []interface{}{"http://carts.sockshop-dev.example.com"}},
+		},
+	}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"monaco/synthetic-monitor/monitor.yaml": "config:\n  - monitor: \"monitor.json\"\nmonitor:\n  - name: \"{% .Keptn.Service %} ({% .Labels.owner %})\"\n  - url: \"{% index .Event.deployment.deploymentURIsPublic 0 %}\"\n",
+		"monaco/synthetic-monitor/monitor.json": `{"name": "{{ .name }}", "script": {"url": "{{ .url }}"}, "tags": [[1]]}`,
+		"monaco/README.md":                      "{% .Keptn.Unknown %}",
+	})
+
+	rendered, err := PreRenderMonacoProjects(keptnEvent, &MonacoPreRenderConfig{Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rendered) != 1 {
+		t.Errorf("Expected only the yaml to be rendered, got %v", rendered)
+	}
+
+	content, _ := ioutil.ReadFile(filepath.Join(GetMonacoProjectsFolder(keptnEvent), "monaco/synthetic-monitor/monitor.yaml"))
+	if !strings.Contains(string(content), `name: "carts (team-a)"`) || !strings.Contains(string(content), `url: "http://carts.sockshop-dev.example.com"`) {
+		t.Errorf("Unexpected rendered yaml: %s", content)
+	}
+	content, _ = ioutil.ReadFile(filepath.Join(GetMonacoProjectsFolder(keptnEvent), "monaco/synthetic-monitor/monitor.json"))
+	if !strings.Contains(string(content), `"name": "{{ .name }}"`) {
+		t.Errorf("Expected the monaco template to be kept, got %s", content)
+	}
+}
+
+func TestPreRenderMonacoProjectsErrors(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "prerender-error-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"monaco/auto-tag/tagging.yaml": "config:\n  - tagging: \"tagging.json\"\ntagging:\n  - name: \"[[ .Labels.owner ]]\"\n",
+	})
+
+	_, err := PreRenderMonacoProjects(keptnEvent, &MonacoPreRenderConfig{Enabled: true, Delims: []string{"[["}})
+	if err == nil {
+		t.Errorf("Expected an error for invalid delims")
+	}
+	_, err = PreRenderMonacoProjects(keptnEvent, &MonacoPreRenderConfig{Enabled: true, Delims: []string{"[[", "]]"}})
+	if err == nil || !strings.Contains(err.Error(), "owner") {
+		t.Errorf("Expected an error for the missing label, got %v", err)
+	}
+}
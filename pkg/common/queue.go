@@ -0,0 +1,163 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+/**
+ * Policies of the run queue for runs that wait for the same key
+ * queue  -> every run is executed one after the other (default)
+ * latest -> only the latest waiting run of a kind is executed, older waiting runs of the same kind are skipped with ErrRunSuperseded
+ */
+const RunQueuePolicyQueue = "queue"
+const RunQueuePolicyLatest = "latest"
+
+// ErrRunSuperseded is returned by RunQueue.Acquire if a newer run of the same kind for the same key replaced the waiting run
+var ErrRunSuperseded = errors.New("Skipped as a newer run of the same task and service for the same tenant, project and stage is queued")
+
+/**
+ * RunQueue serializes the runs with the same key, e.g: a Dynatrace tenant, project and stage, and limits how many runs
+ * are executed at once. Runs with different keys only wait for a free slot of the concurrency limit
+ */
+type RunQueue struct {
+	// MaxConcurrent limits the runs executed at once, 0 means unlimited
+	MaxConcurrent int
+	// Policy is RunQueuePolicyQueue or RunQueuePolicyLatest
+	Policy string
+
+	mutex      sync.Mutex
+	keys       map[string]*runQueueKey
+	slots      chan struct{}
+	running    int
+	superseded int
+}
+
+// the run holding the key and the runs waiting for it
+type runQueueKey struct {
+	waiting []*runQueueWaiter
+}
+
+// a run waiting for the key
+type runQueueWaiter struct {
+	kind  string
+	ready chan error
+}
+
+// RunQueueStats is the current state of the queue, e.g: to expose the queue depth as metric
+type RunQueueStats struct {
+	// Running are the runs that are executed right now
+	Running int `json:"running"`
+	// Queued are the runs waiting for their key or a free slot
+	Queued int `json:"queued"`
+	// QueuedByKey are the runs waiting for the key
+	QueuedByKey map[string]int `json:"queuedByKey"`
+	// Superseded counts the runs that were skipped for a newer run since the start of the service
+	Superseded    int `json:"superseded"`
+	MaxConcurrent int `json:"maxConcurrent"`
+}
+
+// NewRunQueue creates a run queue with the concurrency limit and the policy, unknown policies fall back to RunQueuePolicyQueue
+func NewRunQueue(maxConcurrent int, policy string) *RunQueue {
+	queue := &RunQueue{MaxConcurrent: maxConcurrent, Policy: policy, keys: map[string]*runQueueKey{}}
+	if queue.Policy != RunQueuePolicyLatest {
+		queue.Policy = RunQueuePolicyQueue
+	}
+	if maxConcurrent > 0 {
+		queue.slots = make(chan struct{}, maxConcurrent)
+	}
+	return queue
+}
+
+// RunQueueKey returns the key of the runs of a project and stage on a tenant. tenant is the URL of the credentials, never the tenant name
+// of monaco.conf.yaml, so that runs are serialized even if several tenant names point to the same tenant
+func RunQueueKey(tenant string, project string, stage string) string {
+	return strings.TrimSuffix(tenant, "/") + "|" + project + "|" + stage
+}
+
+/**
+ * Blocks until no other run holds the key and there is a free slot. The returned function releases the key and the slot
+ * and has to be called when the run is done. Returns ErrRunSuperseded if the policy is latest and a newer run of the same kind,
+ * e.g: the same task and service, replaced this one. Runs of other kinds never replace each other, only wait for each other
+ */
+func (queue *RunQueue) Acquire(key string, kind string) (func(), error) {
+	queue.mutex.Lock()
+	queueKey, ok := queue.keys[key]
+	if !ok {
+		// nobody holds the key
+		queue.keys[key] = &runQueueKey{}
+		queue.mutex.Unlock()
+	} else {
+		if queue.Policy == RunQueuePolicyLatest {
+			waiting := []*runQueueWaiter{}
+			for _, waiter := range queueKey.waiting {
+				if waiter.kind != kind {
+					waiting = append(waiting, waiter)
+					continue
+				}
+				waiter.ready <- ErrRunSuperseded
+				queue.superseded++
+			}
+			queueKey.waiting = waiting
+		}
+		ready := make(chan error, 1)
+		queueKey.waiting = append(queueKey.waiting, &runQueueWaiter{kind: kind, ready: ready})
+		queue.mutex.Unlock()
+
+		err := <-ready
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if queue.slots != nil {
+		queue.slots <- struct{}{}
+	}
+	queue.mutex.Lock()
+	queue.running++
+	queue.mutex.Unlock()
+
+	released := false
+	return func() {
+		queue.mutex.Lock()
+		defer queue.mutex.Unlock()
+		if released {
+			return
+		}
+		released = true
+
+		queue.running--
+		if queue.slots != nil {
+			<-queue.slots
+		}
+		// hand the key over to the next waiting run
+		queueKey := queue.keys[key]
+		if len(queueKey.waiting) == 0 {
+			delete(queue.keys, key)
+			return
+		}
+		next := queueKey.waiting[0]
+		queueKey.waiting = queueKey.waiting[1:]
+		next.ready <- nil
+	}, nil
+}
+
+// Stats returns the runs that are executed and queued right now
+func (queue *RunQueue) Stats() RunQueueStats {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	stats := RunQueueStats{Running: queue.running, QueuedByKey: map[string]int{}, Superseded: queue.superseded, MaxConcurrent: queue.MaxConcurrent}
+	holding := 0
+	for key, queueKey := range queue.keys {
+		holding++
+		if len(queueKey.waiting) > 0 {
+			stats.QueuedByKey[key] = len(queueKey.waiting)
+			stats.Queued += len(queueKey.waiting)
+		}
+	}
+	// runs that hold their key but wait for a free slot
+	stats.Queued += holding - queue.running
+	return stats
+}
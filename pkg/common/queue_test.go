@@ -0,0 +1,152 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+// acquires the key in the background and returns the channel that receives the result of Acquire
+func acquireAsync(queue *RunQueue, key string, kind string) (chan func(), chan error) {
+	acquired := make(chan func(), 1)
+	failed := make(chan error, 1)
+	go func() {
+		release, err := queue.Acquire(key, kind)
+		if err != nil {
+			failed <- err
+			return
+		}
+		acquired <- release
+	}()
+	return acquired, failed
+}
+
+// waits until the queue has the number of queued runs
+func waitForQueued(t *testing.T, queue *RunQueue, queued int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.Stats().Queued != queued {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d queued runs, got %+v", queued, queue.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunQueueSerializesKey(t *testing.T) {
+	queue := NewRunQueue(0, RunQueuePolicyQueue)
+	key := RunQueueKey("https://abc12345.live.dynatrace.com/", "sockshop", "dev")
+
+	release, err := queue.Acquire(key, "monaco|carts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired, _ := acquireAsync(queue, key, "monaco|carts")
+	waitForQueued(t, queue, 1)
+
+	// other keys are not blocked
+	otherRelease, err := queue.Acquire(RunQueueKey("https://abc12345.live.dynatrace.com", "sockshop", "production"), "monaco|carts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRelease()
+
+	stats := queue.Stats()
+	if stats.Running != 1 || stats.QueuedByKey[key] != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	select {
+	case <-acquired:
+		t.Fatal("Expected the second run to wait for the first one")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release()
+	// releasing twice doesn't release the key of the next run
+	release()
+
+	select {
+	case secondRelease := <-acquired:
+		secondRelease()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the second run to start after the first one")
+	}
+	if stats := queue.Stats(); stats.Running != 0 || stats.Queued != 0 {
+		t.Errorf("Expected an empty queue, got %+v", stats)
+	}
+}
+
+func TestRunQueueMaxConcurrent(t *testing.T) {
+	queue := NewRunQueue(1, RunQueuePolicyQueue)
+
+	release, _ := queue.Acquire(RunQueueKey("https://tenant-a.live.dynatrace.com", "sockshop", "dev"), "monaco|carts")
+	acquired, _ := acquireAsync(queue, RunQueueKey("https://tenant-b.live.dynatrace.com", "sockshop", "dev"), "monaco|carts")
+	waitForQueued(t, queue, 1)
+
+	release()
+	select {
+	case secondRelease := <-acquired:
+		secondRelease()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the second run to start after a slot was freed")
+	}
+}
+
+func TestRunQueueLatest(t *testing.T) {
+	queue := NewRunQueue(0, RunQueuePolicyLatest)
+	key := RunQueueKey("https://abc12345.live.dynatrace.com", "sockshop", "dev")
+
+	release, _ := queue.Acquire(key, "monaco|carts")
+	_, olderFailed := acquireAsync(queue, key, "monaco|carts")
+	waitForQueued(t, queue, 1)
+	newerAcquired, _ := acquireAsync(queue, key, "monaco|carts")
+
+	select {
+	case err := <-olderFailed:
+		if err != ErrRunSuperseded {
+			t.Errorf("Expected ErrRunSuperseded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the older waiting run to be superseded")
+	}
+	waitForQueued(t, queue, 1)
+
+	release()
+	select {
+	case newerRelease := <-newerAcquired:
+		newerRelease()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the newer run to start")
+	}
+	if stats := queue.Stats(); stats.Superseded != 1 {
+		t.Errorf("Expected one superseded run, got %+v", stats)
+	}
+}
+
+// Tests that with the latest policy runs of other kinds, e.g: a plan or another service, don't replace a waiting run
+func TestRunQueueLatestOtherKinds(t *testing.T) {
+	queue := NewRunQueue(0, RunQueuePolicyLatest)
+	key := RunQueueKey("https://abc12345.live.dynatrace.com", "sockshop", "dev")
+
+	release, _ := queue.Acquire(key, "monaco|carts")
+	applyAcquired, applyFailed := acquireAsync(queue, key, "monaco|carts")
+	waitForQueued(t, queue, 1)
+	planAcquired, _ := acquireAsync(queue, key, "monaco-plan|carts")
+	waitForQueued(t, queue, 2)
+	otherServiceAcquired, _ := acquireAsync(queue, key, "monaco|orders")
+	waitForQueued(t, queue, 3)
+
+	// the runs are executed in the order they were queued
+	release()
+	for _, acquired := range []chan func(){applyAcquired, planAcquired, otherServiceAcquired} {
+		select {
+		case nextRelease := <-acquired:
+			nextRelease()
+		case err := <-applyFailed:
+			t.Fatalf("Expected the waiting apply to run, got %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected every waiting run to start")
+		}
+	}
+	if stats := queue.Stats(); stats.Superseded != 0 {
+		t.Errorf("Expected no superseded run, got %+v", stats)
+	}
+}
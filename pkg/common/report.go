@@ -0,0 +1,163 @@
+package common
+
+import (
+	"regexp"
+	"strings"
+)
+
+/**
+ * Actions monaco performed on a single configuration
+ */
+const MonacoActionCreated = "created"
+const MonacoActionUpdated = "updated"
+const MonacoActionSkipped = "skipped"
+const MonacoActionFailed = "failed"
+const MonacoActionDeleted = "deleted"
+const MonacoActionDownloaded = "downloaded"
+
+// MonacoConfigResult is the result of a single monaco configuration, e.g: an auto-tag or a dashboard
+type MonacoConfigResult struct {
+	Project    string `json:"project"`
+	ConfigType string `json:"configType"`
+	ConfigName string `json:"configName"`
+	Action     string `json:"action"`
+	EntityID   string `json:"entityId,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// MonacoDeploymentReport is the typed report of a monaco run that we parse from monaco's verbose output
+type MonacoDeploymentReport struct {
+	Configs []*MonacoConfigResult `json:"configs"`
+	// errors that could not be attributed to a specific configuration
+	Errors []string `json:"errors,omitempty"`
+}
+
+var monacoProjectLineRegex = regexp.MustCompile(`(?i)processing project ([^\s.]+(?:\.[^\s.]+)*)`)
+var monacoConfigLineRegex = regexp.MustCompile(`(?i)(?:processing|deploying) config ([^\s]+)`)
+var monacoSkipLineRegex = regexp.MustCompile(`(?i)skipping (?:deployment of )?config ([^\s]+)`)
+var monacoCreatedLineRegex = regexp.MustCompile(`(?i)created new (?:object|config) (?:for )?(.*?)\s*\(([^)]+)\)`)
+var monacoUpdatedLineRegex = regexp.MustCompile(`(?i)updated existing (?:object|config) (?:for )?(.*?)\s*\(([^)]+)\)`)
+var monacoErrorLineRegex = regexp.MustCompile(`(?i)\b(error|failed)\b`)
+var monacoEnvironmentLineRegex = regexp.MustCompile(`(?i)(processing|deployment failed for) environment`)
+
+/**
+ * Parses the verbose output of monaco into a MonacoDeploymentReport. Monaco logs the following lines we are interested in:
+ * Processing project PROJECT
+ * Processing config PROJECT/CONFIGTYPE/CONFIGNAME
+ * Created new object NAME (ID) / Updated existing object NAME (ID)
+ * Skipping deployment of config PROJECT/CONFIGTYPE/CONFIGNAME
+ * any line containing error or failed is attributed to the config that is currently processed
+ * Processing environment ENVIRONMENT / Deployment failed for environment ENVIRONMENT end the current config,
+ * the failure of the environment is an error of the run and not of the last config
+ */
+func ParseMonacoOutput(output string) *MonacoDeploymentReport {
+	report := &MonacoDeploymentReport{Configs: []*MonacoConfigResult{}}
+
+	currentProject := ""
+	var currentConfig *MonacoConfigResult
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if match := monacoSkipLineRegex.FindStringSubmatch(line); match != nil {
+			config := newMonacoConfigResult(match[1], currentProject)
+			config.Action = MonacoActionSkipped
+			report.Configs = append(report.Configs, config)
+			currentConfig = nil
+			continue
+		}
+
+		if match := monacoConfigLineRegex.FindStringSubmatch(line); match != nil {
+			currentConfig = newMonacoConfigResult(match[1], currentProject)
+			report.Configs = append(report.Configs, currentConfig)
+			continue
+		}
+
+		if monacoEnvironmentLineRegex.MatchString(line) {
+			currentProject = ""
+			currentConfig = nil
+			if monacoErrorLineRegex.MatchString(line) {
+				report.Errors = append(report.Errors, line)
+			}
+			continue
+		}
+
+		if match := monacoProjectLineRegex.FindStringSubmatch(line); match != nil {
+			currentProject = strings.TrimSuffix(match[1], "...")
+			currentConfig = nil
+			continue
+		}
+
+		if match := monacoCreatedLineRegex.FindStringSubmatch(line); match != nil && currentConfig != nil {
+			currentConfig.Action = MonacoActionCreated
+			currentConfig.EntityID = match[2]
+			continue
+		}
+
+		if match := monacoUpdatedLineRegex.FindStringSubmatch(line); match != nil && currentConfig != nil {
+			currentConfig.Action = MonacoActionUpdated
+			currentConfig.EntityID = match[2]
+			continue
+		}
+
+		if monacoErrorLineRegex.MatchString(line) {
+			if currentConfig != nil {
+				currentConfig.Action = MonacoActionFailed
+				if currentConfig.Error != "" {
+					currentConfig.Error += "\n"
+				}
+				currentConfig.Error += line
+			} else {
+				report.Errors = append(report.Errors, line)
+			}
+		}
+	}
+
+	// configs that monaco processed without creating or updating an object were not touched
+	for _, config := range report.Configs {
+		if config.Action == "" {
+			config.Action = MonacoActionSkipped
+		}
+	}
+
+	return report
+}
+
+// Counts the configs in the report with the passed action
+func (report *MonacoDeploymentReport) CountByAction(action string) int {
+	count := 0
+	for _, config := range report.Configs {
+		if config.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+/**
+ * Creates a config result from a fully qualified monaco config id PROJECT/CONFIGTYPE/CONFIGNAME (v1) or PROJECT:CONFIGTYPE:CONFIGNAME (v2)
+ * Project ids can contain / for nested projects, config type and name are always the last two elements
+ */
+func newMonacoConfigResult(fullQualifiedId string, currentProject string) *MonacoConfigResult {
+	fullQualifiedId = strings.TrimSuffix(fullQualifiedId, "...")
+	// monaco v2 uses coordinates PROJECT:CONFIGTYPE:CONFIGNAME
+	fullQualifiedId = strings.Trim(fullQualifiedId, "'\"")
+	parts := strings.Split(strings.ReplaceAll(fullQualifiedId, ":", "/"), "/")
+
+	config := &MonacoConfigResult{Project: currentProject}
+	switch len(parts) {
+	case 1:
+		config.ConfigName = parts[0]
+	case 2:
+		config.ConfigType = parts[0]
+		config.ConfigName = parts[1]
+	default:
+		config.Project = strings.Join(parts[:len(parts)-2], "/")
+		config.ConfigType = parts[len(parts)-2]
+		config.ConfigName = parts[len(parts)-1]
+	}
+	return config
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"testing"
+)
+
+const testMonacoOutput = `2021-06-01 10:00:00 INFO  Executing projects in this order:
+2021-06-01 10:00:00 INFO  	1: monaco (2 configs)
+2021-06-01 10:00:00 INFO  Processing environment monaco...
+2021-06-01 10:00:00 INFO  	Processing project monaco...
+2021-06-01 10:00:00 DEBUG 		Processing config monaco/auto-tag/tagging...
+2021-06-01 10:00:01 DEBUG 			Created new object for dev (a1b2c3d4-1234)
+2021-06-01 10:00:01 DEBUG 		Processing config monaco/management-zone/zone...
+2021-06-01 10:00:02 DEBUG 			Updated existing object for sockshop-dev-carts (-123456789)
+2021-06-01 10:00:02 INFO  	Processing project infrastructure/shared...
+2021-06-01 10:00:02 DEBUG 		Skipping deployment of config infrastructure/shared/dashboard/overview
+2021-06-01 10:00:02 DEBUG 		Processing config infrastructure/shared/alerting-profile/default...
+2021-06-01 10:00:03 ERROR 			Failed to upsert alerting-profile default: 400 Bad Request
+2021-06-01 10:00:03 ERROR Deployment failed for environment monaco`
+
+// Tests that ParseMonacoOutput turns monaco's verbose output into a report
+func TestParseMonacoOutput(t *testing.T) {
+	report := ParseMonacoOutput(testMonacoOutput)
+
+	expected := []MonacoConfigResult{
+		{Project: "monaco", ConfigType: "auto-tag", ConfigName: "tagging", Action: MonacoActionCreated, EntityID: "a1b2c3d4-1234"},
+		{Project: "monaco", ConfigType: "management-zone", ConfigName: "zone", Action: MonacoActionUpdated, EntityID: "-123456789"},
+		{Project: "infrastructure/shared", ConfigType: "dashboard", ConfigName: "overview", Action: MonacoActionSkipped},
+		{Project: "infrastructure/shared", ConfigType: "alerting-profile", ConfigName: "default", Action: MonacoActionFailed},
+	}
+
+	if len(report.Configs) != len(expected) {
+		t.Fatalf("Expected %d configs, got %d: %v", len(expected), len(report.Configs), report.Configs)
+	}
+
+	for i, config := range report.Configs {
+		if config.Project != expected[i].Project || config.ConfigType != expected[i].ConfigType || config.ConfigName != expected[i].ConfigName ||
+			config.Action != expected[i].Action || config.EntityID != expected[i].EntityID {
+			t.Errorf("Config %d: expected %+v, got %+v", i, expected[i], *config)
+		}
+	}
+
+	if report.Configs[3].Error != "2021-06-01 10:00:03 ERROR 			Failed to upsert alerting-profile default: 400 Bad Request" {
+		t.Errorf("Expected only the error of the failed config, got %s", report.Configs[3].Error)
+	}
+	if len(report.Errors) != 1 || report.Errors[0] != "2021-06-01 10:00:03 ERROR Deployment failed for environment monaco" {
+		t.Errorf("Expected the failed environment as error of the run, got %v", report.Errors)
+	}
+
+	if report.CountByAction(MonacoActionFailed) != 1 {
+		t.Errorf("Expected 1 failed config, got %d", report.CountByAction(MonacoActionFailed))
+	}
+}
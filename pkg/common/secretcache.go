@@ -0,0 +1,144 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// how long the secret cache waits for the initial list of secrets before reading secrets with single GETs
+var SecretCacheSyncTimeout = 10 * time.Second
+
+// how long the secrets are read with single GETs after the secret cache couldn't be started before it is tried again
+var SecretCacheRetryInterval = time.Minute
+
+// Helm stores every release as secret of this type, they are large and never hold Dynatrace credentials, so they are not cached
+const SecretCacheFieldSelector = "type!=helm.sh/release.v1"
+
+/**
+ * SecretCache serves the secrets of a namespace from memory. An informer lists the secrets once and watches them,
+ * so changes to a secret are used by the next event without restarting the service
+ */
+type SecretCache struct {
+	Namespace string
+	lister    corev1listers.SecretLister
+	stopCh    chan struct{}
+}
+
+// the shared Kubernetes client and the cache of the secrets in the namespace of the pod
+var kubernetesClient = struct {
+	sync.Mutex
+	client      kubernetes.Interface
+	secretCache *SecretCache
+	// cacheStarting is set while the informer syncs, the lock is not held while waiting for it
+	cacheStarting bool
+	// cacheRetryAt is the time the cache is started again after the informer couldn't sync, e.g: without list and watch permissions
+	cacheRetryAt time.Time
+}{}
+
+/**
+ * Starts an informer for the secrets of the namespace, except the Helm release secrets, and waits until the secrets are listed.
+ * Returns an error if the secrets couldn't be listed within SecretCacheSyncTimeout
+ */
+func NewSecretCache(client kubernetes.Interface, secretNamespace string) (*SecretCache, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(secretNamespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = SecretCacheFieldSelector
+		}))
+	secretInformer := factory.Core().V1().Secrets()
+	secretCache := &SecretCache{Namespace: secretNamespace, lister: secretInformer.Lister(), stopCh: make(chan struct{})}
+	informer := secretInformer.Informer()
+	factory.Start(secretCache.stopCh)
+
+	timeoutCh := make(chan struct{})
+	timer := time.AfterFunc(SecretCacheSyncTimeout, func() { close(timeoutCh) })
+	defer timer.Stop()
+	if !cache.WaitForCacheSync(timeoutCh, informer.HasSynced) {
+		secretCache.Stop()
+		return nil, fmt.Errorf("could not list the secrets in %s within %v", secretNamespace, SecretCacheSyncTimeout)
+	}
+	return secretCache, nil
+}
+
+// Get returns the data of the secret, a missing secret returns a NotFound error like the Kubernetes API
+func (secretCache *SecretCache) Get(secretName string) (map[string]string, error) {
+	k8sSecret, err := secretCache.lister.Secrets(secretCache.Namespace).Get(secretName)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := map[string]string{}
+	for key, value := range k8sSecret.Data {
+		secret[key] = string(value)
+	}
+	return secret, nil
+}
+
+// Stop stops watching the secrets
+func (secretCache *SecretCache) Stop() {
+	close(secretCache.stopCh)
+}
+
+/**
+ * Replaces the shared Kubernetes client, e.g: with a fake clientset in tests. A running secret cache is stopped
+ * and started again with the new client on the next secret lookup
+ */
+func SetKubernetesClient(client kubernetes.Interface) {
+	kubernetesClient.Lock()
+	defer kubernetesClient.Unlock()
+
+	if kubernetesClient.secretCache != nil {
+		kubernetesClient.secretCache.Stop()
+	}
+	kubernetesClient.client = client
+	kubernetesClient.secretCache = nil
+	kubernetesClient.cacheStarting = false
+	kubernetesClient.cacheRetryAt = time.Time{}
+}
+
+/**
+ * Returns the cache of the secrets in the namespace of the pod, it is started on the first call.
+ * Returns nil while the cache is started by another call or if it couldn't be started, the secrets are read with single GETs then.
+ * A cache that couldn't be started is tried again after SecretCacheRetryInterval
+ */
+func getSecretCache() *SecretCache {
+	client, err := GetKubernetesClient()
+	if err != nil || client == nil {
+		return nil
+	}
+
+	kubernetesClient.Lock()
+	if kubernetesClient.secretCache != nil || kubernetesClient.cacheStarting || time.Now().Before(kubernetesClient.cacheRetryAt) {
+		defer kubernetesClient.Unlock()
+		return kubernetesClient.secretCache
+	}
+	kubernetesClient.cacheStarting = true
+	kubernetesClient.Unlock()
+
+	secretCache, err := NewSecretCache(client, namespace)
+
+	kubernetesClient.Lock()
+	defer kubernetesClient.Unlock()
+	if kubernetesClient.client != client {
+		// the client was replaced while the informer synced
+		if secretCache != nil {
+			secretCache.Stop()
+		}
+		return nil
+	}
+	kubernetesClient.cacheStarting = false
+	if err != nil {
+		log.Printf("Not caching secrets, reading them on every event for %v: %v\n", SecretCacheRetryInterval, err)
+		kubernetesClient.cacheRetryAt = time.Now().Add(SecretCacheRetryInterval)
+		return nil
+	}
+	kubernetesClient.secretCache = secretCache
+	return secretCache
+}
@@ -0,0 +1,168 @@
+package common
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestSecret(secretNamespace string, name string, data map[string]string) *corev1.Secret {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: secretNamespace, Name: name}, Data: map[string][]byte{}}
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	return secret
+}
+
+// Tests that the secrets of the pod namespace are served by the informer and changes are picked up without a restart
+func TestSecretCache(t *testing.T) {
+	runLocalTest := RunLocalTest
+	RunLocalTest = false
+	defer func() { RunLocalTest = runLocalTest }()
+
+	client := fake.NewSimpleClientset(
+		newTestSecret(namespace, "dynatrace", map[string]string{"DT_TENANT": "abc12345.live.dynatrace.com", "DT_API_TOKEN": "dt0c01.cached"}),
+		newTestSecret("other-ns", "dynatrace-prod", map[string]string{"DT_TENANT": "prod.live.dynatrace.com", "DT_API_TOKEN": "dt0c01.prod"}),
+	)
+	SetKubernetesClient(client)
+	defer SetKubernetesClient(nil)
+
+	dtCredentials, err := FindDTCredentials([]string{"dynatrace-missing", "dynatrace"}, []string{namespace}, &BaseKeptnEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dtCredentials.ApiToken != "dt0c01.cached" {
+		t.Errorf("Unexpected credentials %+v", dtCredentials)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "get" {
+			t.Errorf("Expected the secrets of %s to be served from the cache, got %v", namespace, action)
+		}
+		if listAction, ok := action.(k8stesting.ListAction); ok && listAction.GetListRestrictions().Fields.String() != SecretCacheFieldSelector {
+			t.Errorf("Expected the Helm release secrets to be excluded from the cache, got %v", listAction.GetListRestrictions().Fields)
+		}
+	}
+
+	_, err = client.CoreV1().Secrets(namespace).Update(newTestSecret(namespace, "dynatrace", map[string]string{"DT_TENANT": "abc12345.live.dynatrace.com", "DT_API_TOKEN": "dt0c01.rotated"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		secret, _ := readKubernetesSecret(namespace, "dynatrace")
+		if secret["DT_API_TOKEN"] == "dt0c01.rotated" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the rotated token, got %v", secret)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// secrets of other namespaces are not cached
+	secret, err := readKubernetesSecret("other-ns", "dynatrace-prod")
+	if err != nil || secret["DT_API_TOKEN"] != "dt0c01.prod" {
+		t.Errorf("Expected the secret of other-ns, got %v %v", secret, err)
+	}
+}
+
+// Tests that the reasons of failed lookups are reported for every namespace
+func TestFindDTCredentialsNamespaces(t *testing.T) {
+	runLocalTest := RunLocalTest
+	RunLocalTest = false
+	defer func() { RunLocalTest = runLocalTest }()
+
+	client := fake.NewSimpleClientset(newTestSecret("dynatrace", "dynatrace", map[string]string{"DT_TENANT": "abc12345.live.dynatrace.com"}))
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "restricted" {
+			return true, nil, k8serrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "dynatrace", nil)
+		}
+		return false, nil, nil
+	})
+	SetKubernetesClient(client)
+	defer SetKubernetesClient(nil)
+	os.Setenv(CredentialAllowedNamespacesEnv, "restricted,dynatrace")
+	defer os.Unsetenv(CredentialAllowedNamespacesEnv)
+
+	_, err := FindDTCredentials([]string{"dynatrace"}, []string{namespace, "restricted", "dynatrace"}, &BaseKeptnEvent{})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, expected := range []string{"secret " + namespace + "/dynatrace not found", "access to secret restricted/dynatrace is forbidden", "missing key DT_API_TOKEN (or DT_CLIENT_ID & DT_CLIENT_SECRET or DT_PLATFORM_TOKEN) in secret dynatrace/dynatrace"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected '%s' in %v", expected, err)
+		}
+	}
+}
+
+// Tests that lookups don't wait for a syncing secret cache and that a cache that couldn't be started is tried again after a while
+func TestSecretCacheRetry(t *testing.T) {
+	runLocalTest := RunLocalTest
+	RunLocalTest = false
+	defer func() { RunLocalTest = runLocalTest }()
+	syncTimeout, retryInterval := SecretCacheSyncTimeout, SecretCacheRetryInterval
+	SecretCacheSyncTimeout, SecretCacheRetryInterval = 200*time.Millisecond, 300*time.Millisecond
+	defer func() { SecretCacheSyncTimeout, SecretCacheRetryInterval = syncTimeout, retryInterval }()
+
+	var mutex sync.Mutex
+	listAllowed := false
+	listing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	client := fake.NewSimpleClientset(newTestSecret(namespace, "dynatrace", map[string]string{"DT_TENANT": "abc12345.live.dynatrace.com"}))
+	client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mutex.Lock()
+		allowed := listAllowed
+		mutex.Unlock()
+		if allowed {
+			return false, nil, nil
+		}
+		select {
+		case listing <- struct{}{}:
+		default:
+		}
+		<-release
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", nil)
+	})
+	SetKubernetesClient(client)
+	defer SetKubernetesClient(nil)
+
+	started := make(chan *SecretCache, 1)
+	go func() { started <- getSecretCache() }()
+	<-listing
+
+	// another lookup reads the secret directly instead of waiting for the sync
+	lookupStart := time.Now()
+	if secretCache := getSecretCache(); secretCache != nil || time.Since(lookupStart) > SecretCacheSyncTimeout/2 {
+		t.Errorf("Expected no cache without waiting for the sync, got %v after %v", secretCache, time.Since(lookupStart))
+	}
+	close(release)
+	if secretCache := <-started; secretCache != nil {
+		t.Fatal("Expected no cache without list permissions")
+	}
+
+	// the cache is not started again before the retry interval
+	mutex.Lock()
+	listAllowed = true
+	mutex.Unlock()
+	if secretCache := getSecretCache(); secretCache != nil {
+		t.Errorf("Expected no cache before the retry interval")
+	}
+	time.Sleep(SecretCacheRetryInterval)
+	secretCache := getSecretCache()
+	if secretCache == nil {
+		t.Fatal("Expected the cache to be started after the retry interval")
+	}
+	if secret, err := secretCache.Get("dynatrace"); err != nil || secret["DT_TENANT"] != "abc12345.live.dynatrace.com" {
+		t.Errorf("Expected the secret from the cache, got %v %v", secret, err)
+	}
+}
@@ -0,0 +1,179 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/**
+ * In RunLocal mode secrets are read from yaml files in this folder instead of Kubernetes, e.g: secrets/dynatrace.yaml
+ * DT_TENANT: abc12345.live.dynatrace.com
+ * DT_API_TOKEN: dt0c01.XXXX
+ */
+var LocalSecretsFolder = "secrets"
+
+const maskedSecretValue = "*****"
+
+// secret values smaller than that are not masked as they would mask random parts of the logs
+const minMaskedSecretLength = 4
+
+// keptnSecretCache caches the secrets read for a keptn event so every secret is only read once per event
+type keptnSecretCache struct {
+	mutex   sync.Mutex
+	secrets map[string]map[string]string
+}
+
+// secret values that were resolved so far, they are masked in the logs
+var maskedSecrets = struct {
+	sync.RWMutex
+	values map[string]bool
+}{values: map[string]bool{}}
+
+/**
+ * Returns the data of the Kubernetes secret in the namespace of the pod, in RunLocal mode the secret is read from LocalSecretsFolder.
+ * Secrets are cached per keptn event
+ */
+func GetKeptnSecret(keptnEvent *BaseKeptnEvent, secretName string) (map[string]string, error) {
+	if keptnEvent.secrets == nil {
+		keptnEvent.secrets = &keptnSecretCache{secrets: map[string]map[string]string{}}
+	}
+	cache := keptnEvent.secrets
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if secret, ok := cache.secrets[secretName]; ok {
+		return secret, nil
+	}
+
+	secret, err := readSecret(secretName)
+	if err != nil {
+		return nil, err
+	}
+	cache.secrets[secretName] = secret
+	return secret, nil
+}
+
+func readSecret(secretName string) (map[string]string, error) {
+	if RunLocal || RunLocalTest {
+		secret := map[string]string{}
+		secretFile := filepath.Join(LocalSecretsFolder, secretName+".yaml")
+		content, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read local secret %s: %v", secretFile, err)
+		}
+		err = yaml.Unmarshal(content, &secret)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse local secret %s: %v", secretFile, err)
+		}
+		return secret, nil
+	}
+
+	return readKubernetesSecret(namespace, secretName)
+}
+
+/**
+ * Returns the data of the Kubernetes secret in the namespace. Secrets of the namespace of the pod are served by the secret cache,
+ * secrets of other namespaces are read with a GET
+ */
+func readKubernetesSecret(secretNamespace string, secretName string) (map[string]string, error) {
+	var secret map[string]string
+	var err error
+	if secretCache := getSecretCache(); secretCache != nil && secretCache.Namespace == secretNamespace {
+		secret, err = secretCache.Get(secretName)
+	} else {
+		secret, err = getKubernetesSecret(secretNamespace, secretName)
+	}
+
+	if k8serrors.IsNotFound(err) {
+		return nil, fmt.Errorf("secret %s/%s not found", secretNamespace, secretName)
+	}
+	if k8serrors.IsForbidden(err) {
+		return nil, fmt.Errorf("access to secret %s/%s is forbidden, the service account needs a Role to get secrets in %s", secretNamespace, secretName, secretNamespace)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve secret %s/%s: %v", secretNamespace, secretName, err)
+	}
+	return secret, nil
+}
+
+func getKubernetesSecret(secretNamespace string, secretName string) (map[string]string, error) {
+	kubeAPI, err := GetKubernetesClient()
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize Kubernetes client: %v", err)
+	}
+	if kubeAPI == nil {
+		return nil, errors.New("no Kubernetes client in RunLocal mode")
+	}
+	k8sSecret, err := kubeAPI.CoreV1().Secrets(secretNamespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	secret := map[string]string{}
+	for key, value := range k8sSecret.Data {
+		secret[key] = string(value)
+	}
+	return secret, nil
+}
+
+// returns the value of the key of the secret and masks it in the logs
+func getKeptnSecretValue(keptnEvent *BaseKeptnEvent, secretName string, key string) (string, error) {
+	secret, err := GetKeptnSecret(keptnEvent, secretName)
+	if err != nil {
+		return "", err
+	}
+	value, ok := secret[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %s", secretName, key)
+	}
+	AddMaskedSecret(value)
+	return value, nil
+}
+
+// AddMaskedSecret masks the value in all logs written through MaskSecrets
+func AddMaskedSecret(value string) {
+	if len(value) < minMaskedSecretLength {
+		return
+	}
+	maskedSecrets.Lock()
+	defer maskedSecrets.Unlock()
+	maskedSecrets.values[value] = true
+}
+
+/**
+ * Replaces all secret values resolved so far with *****. Longer values are replaced first so that a secret that contains another one is masked completely
+ */
+func MaskSecrets(text string) string {
+	maskedSecrets.RLock()
+	values := make([]string, 0, len(maskedSecrets.values))
+	for value := range maskedSecrets.values {
+		values = append(values, value)
+	}
+	maskedSecrets.RUnlock()
+
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		text = strings.Replace(text, value, maskedSecretValue, -1)
+	}
+	return text
+}
+
+// MaskingWriter masks secret values before writing to the underlying writer, e.g: log.SetOutput(&MaskingWriter{Writer: os.Stderr})
+type MaskingWriter struct {
+	Writer io.Writer
+}
+
+func (writer *MaskingWriter) Write(p []byte) (int, error) {
+	_, err := writer.Writer.Write([]byte(MaskSecrets(string(p))))
+	return len(p), err
+}
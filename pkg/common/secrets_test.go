@@ -0,0 +1,101 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Tests $SECRET placeholders with the local secret store, the cache per event and masking of the resolved values
+func TestRenderKeptnPlaceholdersSecrets(t *testing.T) {
+	RunLocalTest = true
+	defer func() { RunLocalTest = false }()
+
+	secretsFolder, err := ioutil.TempDir("", "monaco-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(secretsFolder)
+	LocalSecretsFolder = secretsFolder
+	defer func() { LocalSecretsFolder = "secrets" }()
+
+	secretFile := filepath.Join(secretsFolder, "dynatrace-tenant.yaml")
+	err = ioutil.WriteFile(secretFile, []byte("name: dynatrace-prod\ntls.crt: certificate\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keptnEvent := &BaseKeptnEvent{Project: "sockshop"}
+	result, err := RenderKeptnPlaceholders("$SECRET.dynatrace-tenant.name-$PROJECT", keptnEvent, PlaceholderEscapeNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "dynatrace-prod-sockshop" {
+		t.Errorf("Expected dynatrace-prod-sockshop, got %s", result)
+	}
+
+	// the secret is cached for the event
+	os.Remove(secretFile)
+	result, err = RenderKeptnPlaceholders(`{{ secret "dynatrace-tenant" "tls.crt" }}`, keptnEvent, PlaceholderEscapeNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "certificate" {
+		t.Errorf("Expected the cached secret, got %s", result)
+	}
+	_, err = RenderKeptnPlaceholders("$SECRET.dynatrace-tenant.name", &BaseKeptnEvent{}, PlaceholderEscapeNone)
+	if err == nil {
+		t.Errorf("Expected an error as the secret is only cached for the first event")
+	}
+
+	for _, input := range []string{"$SECRET.dynatrace-tenant.token", "$SECRET.dynatrace-tenant", `{{ secret "dynatrace-tenant" "token" }}`} {
+		_, err = RenderKeptnPlaceholders(input, keptnEvent, PlaceholderEscapeNone)
+		if err == nil {
+			t.Errorf("Expected an error for %s", input)
+		}
+	}
+
+	var output bytes.Buffer
+	writer := &MaskingWriter{Writer: &output}
+	writer.Write([]byte("Using dynatrace-prod with certificate"))
+	if output.String() != "Using ***** with *****" {
+		t.Errorf("Expected resolved secrets to be masked, got %s", output.String())
+	}
+}
+
+// Tests $SECRET placeholders of secrets and keys with dots in their names
+func TestRenderKeptnPlaceholdersDottedSecrets(t *testing.T) {
+	RunLocalTest = true
+	defer func() { RunLocalTest = false }()
+
+	secretsFolder, err := ioutil.TempDir("", "monaco-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(secretsFolder)
+	LocalSecretsFolder = secretsFolder
+	defer func() { LocalSecretsFolder = "secrets" }()
+
+	secrets := map[string]string{
+		"dynatrace.production.yaml": "DT_TENANT: abc12345.live.dynatrace.com\n",
+		"dynatrace.yaml":            "tls.crt: certificate\n",
+	}
+	for name, content := range secrets {
+		if err := ioutil.WriteFile(filepath.Join(secretsFolder, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	placeholders := map[string]string{
+		"https://$SECRET.dynatrace.production.DT_TENANT/api": "https://abc12345.live.dynatrace.com/api",
+		"$SECRET.dynatrace.tls.crt":                          "certificate",
+	}
+	for placeholder, expected := range placeholders {
+		result, err := RenderKeptnPlaceholders(placeholder, &BaseKeptnEvent{}, PlaceholderEscapeNone)
+		if err != nil || result != expected {
+			t.Errorf("Expected %s for %s, got %s %v", expected, placeholder, result, err)
+		}
+	}
+}
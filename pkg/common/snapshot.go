@@ -0,0 +1,321 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Keptn resource folder the snapshots are stored in, one file per keptn context and tenant
+const MonacoSnapshotFolder = "dynatrace/monaco-snapshots"
+
+// DefaultMonacoSnapshotRetention is the number of snapshots kept per tenant if snapshotRetention is not set in monaco.conf.yaml
+const DefaultMonacoSnapshotRetention = 5
+
+// config types whose payload holds credentials, e.g: the webhook URLs, integration keys and passwords of notifications
+var monacoCredentialConfigTypes = map[string]bool{"notification": true}
+
+// config fields that hold credentials, e.g: password, apiKey or integrationKey
+var monacoCredentialFieldRegex = regexp.MustCompile(`(?i)(password|secret|token|api-?key|integration-?key|routing-?key|authorization|credential)`)
+
+// MonacoSnapshotIndex lists the keptn contexts with a snapshot of a tenant, oldest first
+type MonacoSnapshotIndex struct {
+	Contexts []string `json:"contexts"`
+}
+
+// MonacoSnapshot is the state of every config of a monaco run in Dynatrace before the run
+type MonacoSnapshot struct {
+	// Tenant is the Dynatrace environment URL the snapshot was taken from
+	Tenant  string                  `json:"tenant"`
+	Configs []*MonacoSnapshotConfig `json:"configs"`
+}
+
+// MonacoSnapshotConfig is a single config of the snapshot
+type MonacoSnapshotConfig struct {
+	Project    string `json:"project"`
+	ConfigType string `json:"configType"`
+	ConfigName string `json:"configName"`
+	ApiPath    string `json:"apiPath"`
+	// Name is the name of the config in Dynatrace
+	Name     string `json:"name"`
+	EntityID string `json:"entityId,omitempty"`
+	// Payload is the config before the run, empty if the config didn't exist
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// PayloadOmitted is set if the payload holds credentials and was not stored in the Keptn repo, a rollback skips the config
+	PayloadOmitted bool `json:"payloadOmitted,omitempty"`
+}
+
+// returns the Keptn resource of the snapshot for the keptn context and tenant, e.g: dynatrace/monaco-snapshots/CONTEXT/dynatrace.json
+func GetMonacoSnapshotResource(keptnEvent *BaseKeptnEvent, tenantName string) string {
+	return MonacoSnapshotFolder + "/" + keptnEvent.Context + "/" + GetMonacoTenantResourceName(tenantName) + ".json"
+}
+
+// returns the Keptn resource of the snapshot index of the tenant, e.g: dynatrace/monaco-snapshots/dynatrace.json
+func GetMonacoSnapshotIndexResource(tenantName string) string {
+	return MonacoSnapshotFolder + "/" + GetMonacoTenantResourceName(tenantName) + ".json"
+}
+
+/**
+ * Reads the current state of every config of the monaco (v1) projects from Dynatrace.
+ * Configs that don't exist yet are part of the snapshot without payload so that a restore deletes them
+ */
+func SnapshotMonacoProjects(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, additionalEnv map[string]string, httpClient *http.Client) (*MonacoSnapshot, error) {
+	if FileExists(GetMonacoManifestPath(keptnEvent)) {
+		return nil, fmt.Errorf("Snapshots are not supported for monaco v2 projects (%s)", MonacoManifestFilename)
+	}
+
+	configs, err := LoadMonacoProjects(GetMonacoProjectsFolder(keptnEvent), SplitMonacoProjects(projects))
+	if err != nil {
+		return nil, err
+	}
+
+	env := MonacoEnvironmentAsMap(GetMonacoEnvironment(dtCredentials, keptnEvent, additionalEnv))
+	client := NewDynatraceClient(dtCredentials, httpClient)
+
+	snapshot := &MonacoSnapshot{Tenant: dtCredentials.Tenant, Configs: []*MonacoSnapshotConfig{}}
+	existingConfigs := map[string][]DynatraceConfigObject{}
+	known := map[string]DynatraceConfigObject{}
+
+	for _, config := range configs {
+		_, name, id, err := lookupMonacoConfig(client, config, env, existingConfigs, known)
+		if err != nil {
+			return nil, fmt.Errorf("Error taking snapshot of %s: %v", config.FullQualifiedId(), err)
+		}
+
+		apiPath := MonacoConfigApis[config.ConfigType]
+		snapshotConfig := &MonacoSnapshotConfig{Project: config.Project, ConfigType: config.ConfigType, ConfigName: config.ConfigId, ApiPath: apiPath, Name: name, EntityID: id}
+		snapshot.Configs = append(snapshot.Configs, snapshotConfig)
+
+		if id == "" {
+			known[config.FullQualifiedId()] = DynatraceConfigObject{ID: config.FullQualifiedId(), Name: name}
+			continue
+		}
+
+		payload, err := client.GetConfig(apiPath, id)
+		if err != nil {
+			return nil, fmt.Errorf("Error taking snapshot of %s: %v", config.FullQualifiedId(), err)
+		}
+		snapshotConfig.Payload = payload
+		known[config.FullQualifiedId()] = DynatraceConfigObject{ID: id, Name: name}
+	}
+
+	return snapshot, nil
+}
+
+/**
+ * Restores the snapshot: configs that existed before are updated with their old payload, configs that didn't exist are deleted.
+ * Configs are restored in reverse order so that configs are deleted before the configs they reference
+ */
+func RestoreMonacoSnapshot(dtCredentials *DTCredentials, snapshot *MonacoSnapshot, httpClient *http.Client) (*MonacoDeploymentReport, error) {
+	report := &MonacoDeploymentReport{Configs: []*MonacoConfigResult{}}
+
+	if strings.TrimSuffix(snapshot.Tenant, "/") != strings.TrimSuffix(dtCredentials.Tenant, "/") {
+		return report, fmt.Errorf("Snapshot was taken from %s and can't be restored to %s", snapshot.Tenant, dtCredentials.Tenant)
+	}
+
+	client := NewDynatraceClient(dtCredentials, httpClient)
+	existingConfigs := map[string][]DynatraceConfigObject{}
+	failedCount := 0
+
+	for i := len(snapshot.Configs) - 1; i >= 0; i-- {
+		config := snapshot.Configs[i]
+		result := &MonacoConfigResult{Project: config.Project, ConfigType: config.ConfigType, ConfigName: config.ConfigName, Action: MonacoActionSkipped, EntityID: config.EntityID}
+		report.Configs = append(report.Configs, result)
+
+		err := restoreMonacoSnapshotConfig(client, config, existingConfigs, result)
+		if err != nil {
+			result.Action = MonacoActionFailed
+			result.Error = err.Error()
+			failedCount++
+			log.Printf("Failed to restore %s/%s/%s: %v", config.Project, config.ConfigType, config.ConfigName, err)
+		}
+	}
+
+	if failedCount > 0 {
+		return report, fmt.Errorf("%d of %d configs could not be restored", failedCount, len(snapshot.Configs))
+	}
+	return report, nil
+}
+
+func restoreMonacoSnapshotConfig(client *DynatraceClient, config *MonacoSnapshotConfig, existingConfigs map[string][]DynatraceConfigObject, result *MonacoConfigResult) error {
+	if config.PayloadOmitted {
+		log.Printf("Not restoring %s/%s/%s, its payload holds credentials and was not stored", config.Project, config.ConfigType, config.ConfigName)
+		return nil
+	}
+
+	if len(config.Payload) > 0 {
+		payload, err := removeMonacoSnapshotMetadata(config.Payload)
+		if err != nil {
+			return err
+		}
+		err = client.UpdateConfig(config.ApiPath, config.EntityID, payload)
+		if err != nil {
+			return err
+		}
+		result.Action = MonacoActionUpdated
+		return nil
+	}
+
+	// the config didn't exist before the run, delete it if the run created it
+	if _, ok := existingConfigs[config.ApiPath]; !ok {
+		configs, err := client.ListConfigs(config.ApiPath)
+		if err != nil {
+			return err
+		}
+		existingConfigs[config.ApiPath] = configs
+	}
+	for _, existing := range existingConfigs[config.ApiPath] {
+		if existing.Name == config.Name {
+			result.EntityID = existing.ID
+			result.Action = MonacoActionDeleted
+			return client.DeleteConfig(config.ApiPath, existing.ID)
+		}
+	}
+	return nil
+}
+
+// Dynatrace rejects updates that contain the metadata it returns with every config
+func removeMonacoSnapshotMetadata(payload json.RawMessage) ([]byte, error) {
+	config := map[string]json.RawMessage{}
+	err := json.Unmarshal(payload, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing snapshot: %v", err)
+	}
+	delete(config, "metadata")
+	return json.Marshal(config)
+}
+
+/**
+ * Stores the snapshot as Keptn resource so that it survives restarts of the service. Payloads that hold credentials are not stored.
+ * Only the latest retention snapshots of the tenant are kept on the level of the keptn event, older snapshots are deleted. 0 keeps all snapshots
+ */
+func UploadMonacoSnapshot(snapshot *MonacoSnapshot, keptnEvent *BaseKeptnEvent, tenantName string, retention int) error {
+	content, err := json.MarshalIndent(withoutMonacoCredentials(snapshot), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	index := getMonacoSnapshotIndex(keptnEvent, tenantName)
+	contexts := []string{}
+	for _, context := range index.Contexts {
+		if context != keptnEvent.Context {
+			contexts = append(contexts, context)
+		}
+	}
+	contexts = append(contexts, keptnEvent.Context)
+
+	expired := []string{}
+	if retention > 0 && len(contexts) > retention {
+		expired = contexts[:len(contexts)-retention]
+		contexts = contexts[len(contexts)-retention:]
+	}
+	index.Contexts = contexts
+	indexContent, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = UploadKeptnResources(map[string]string{
+		GetMonacoSnapshotResource(keptnEvent, tenantName): string(content),
+		GetMonacoSnapshotIndexResource(tenantName):        string(indexContent),
+	}, keptnEvent)
+	if err != nil {
+		return err
+	}
+
+	for _, context := range expired {
+		expiredEvent := *keptnEvent
+		expiredEvent.Context = context
+		err = DeleteKeptnResource(keptnEvent, GetMonacoSnapshotResource(&expiredEvent, tenantName))
+		if err != nil {
+			log.Printf("Error deleting the snapshot of %s for %s: %v", tenantName, context, err)
+		}
+	}
+	return nil
+}
+
+/**
+ * Returns a copy of the snapshot that can be committed to the Keptn repo: the payloads of config types that hold credentials
+ * and of configs with credential fields are omitted. Masking them instead would restore the masked values
+ */
+func withoutMonacoCredentials(snapshot *MonacoSnapshot) *MonacoSnapshot {
+	stored := &MonacoSnapshot{Tenant: snapshot.Tenant, Configs: []*MonacoSnapshotConfig{}}
+	for _, config := range snapshot.Configs {
+		storedConfig := *config
+		if len(config.Payload) > 0 && (monacoCredentialConfigTypes[config.ConfigType] || hasMonacoCredentialField(config.Payload)) {
+			storedConfig.Payload = nil
+			storedConfig.PayloadOmitted = true
+		}
+		stored.Configs = append(stored.Configs, &storedConfig)
+	}
+	return stored
+}
+
+// returns whether the payload has a credential field with a value, also in nested objects and lists
+func hasMonacoCredentialField(payload json.RawMessage) bool {
+	var config interface{}
+	if json.Unmarshal(payload, &config) != nil {
+		// a payload we can't check is not stored
+		return true
+	}
+
+	var hasCredential func(value interface{}) bool
+	hasCredential = func(value interface{}) bool {
+		switch typedValue := value.(type) {
+		case map[string]interface{}:
+			for key, item := range typedValue {
+				if text, ok := item.(string); ok && text != "" && monacoCredentialFieldRegex.MatchString(key) {
+					return true
+				}
+				if hasCredential(item) {
+					return true
+				}
+			}
+		case []interface{}:
+			for _, item := range typedValue {
+				if hasCredential(item) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return hasCredential(config)
+}
+
+// returns the snapshot index of the tenant on the level of the keptn event, an empty index if there is none
+func getMonacoSnapshotIndex(keptnEvent *BaseKeptnEvent, tenantName string) *MonacoSnapshotIndex {
+	index := &MonacoSnapshotIndex{}
+	content, level, err := GetKeptnResourceWithLevel(keptnEvent, GetMonacoSnapshotIndexResource(tenantName))
+	// an index inherited from another level lists the snapshots of that level
+	if err != nil || content == "" || (level != KeptnResourceLevelLocal && level != GetKeptnEventLevel(keptnEvent)) {
+		return index
+	}
+
+	err = json.Unmarshal([]byte(content), index)
+	if err != nil {
+		log.Printf("Ignoring invalid snapshot index %s: %v", GetMonacoSnapshotIndexResource(tenantName), err)
+		return &MonacoSnapshotIndex{}
+	}
+	return index
+}
+
+/**
+ * Loads the snapshot of the keptn context and tenant, returns nil if there is no snapshot
+ */
+func GetMonacoSnapshot(keptnEvent *BaseKeptnEvent, tenantName string) (*MonacoSnapshot, error) {
+	content, err := GetKeptnResource(keptnEvent, GetMonacoSnapshotResource(keptnEvent, tenantName))
+	if err != nil || content == "" {
+		return nil, nil
+	}
+
+	snapshot := &MonacoSnapshot{}
+	err = json.Unmarshal([]byte(content), snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing snapshot %s: %v", GetMonacoSnapshotResource(keptnEvent, tenantName), err)
+	}
+	return snapshot, nil
+}
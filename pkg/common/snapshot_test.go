@@ -0,0 +1,140 @@
+package common
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Tests that restoring a snapshot reverts updated configs and deletes created configs
+func TestSnapshotAndRestoreMonacoProjects(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "snapshot-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"monaco/management-zone/zone.yaml": "config:\n  - zone: \"zone.json\"\nzone:\n  - name: \"{{ .Env.KEPTN_PROJECT }}-{{ .Env.KEPTN_STAGE }}\"\n",
+		"monaco/management-zone/zone.json": `{"name": "{{ .name }}", "rules": []}`,
+		"monaco/auto-tag/tagging.yaml":     "config:\n  - tagging: \"tagging.json\"\ntagging:\n  - name: \"{{ .Env.KEPTN_STAGE }}\"\n",
+		"monaco/auto-tag/tagging.json":     `{"name": "{{ .name }}", "rules": [{"key": "stage"}]}`,
+	})
+
+	api := newFakeDynatraceConfigAPI()
+	api.add("/api/config/v1/autoTags", "existing-tag", `{"metadata": {"clusterVersion": "1.0"}, "id": "existing-tag", "name": "dev", "rules": [{"key": "environment"}]}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dtCredentials := &DTCredentials{Tenant: server.URL, ApiToken: "test-token"}
+	deployer := &NativeDeployer{HTTPClient: server.Client()}
+
+	snapshot, err := deployer.Snapshot(dtCredentials, keptnEvent, "monaco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Configs) != 2 {
+		t.Fatalf("Expected 2 configs in snapshot, got %d", len(snapshot.Configs))
+	}
+
+	_, _, err = deployer.Deploy(dtCredentials, keptnEvent, "monaco", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(api.configs["/api/config/v1/managementZones"]) != 1 {
+		t.Fatalf("Expected the management zone to be created")
+	}
+
+	report, err := deployer.Restore(dtCredentials, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.CountByAction(MonacoActionUpdated) != 1 || report.CountByAction(MonacoActionDeleted) != 1 {
+		t.Errorf("Expected one restored and one deleted config, got %+v", report.Configs)
+	}
+	if len(api.configs["/api/config/v1/managementZones"]) != 0 {
+		t.Errorf("Expected the created management zone to be deleted")
+	}
+	restoredTag := string(api.configs["/api/config/v1/autoTags"]["existing-tag"])
+	if !strings.Contains(restoredTag, `"key":"environment"`) || strings.Contains(restoredTag, "metadata") {
+		t.Errorf("Expected the auto-tag to be restored without metadata, got %s", restoredTag)
+	}
+
+	_, err = deployer.Restore(&DTCredentials{Tenant: "https://other.live.dynatrace.com", ApiToken: "test-token"}, snapshot)
+	if err == nil {
+		t.Errorf("Expected an error restoring a snapshot to another tenant")
+	}
+}
+
+// Tests that only the latest snapshots of a tenant are kept
+func TestUploadMonacoSnapshotRetention(t *testing.T) {
+	RunLocal = true
+	defer func() { RunLocal = false }()
+	defer os.RemoveAll(MonacoSnapshotFolder)
+
+	snapshot := &MonacoSnapshot{Tenant: "https://abc12345.live.dynatrace.com", Configs: []*MonacoSnapshotConfig{}}
+	for _, context := range []string{"context-1", "context-2", "context-3", "context-2"} {
+		keptnEvent := &BaseKeptnEvent{Context: context, Project: "sockshop", Stage: "dev"}
+		err := UploadMonacoSnapshot(snapshot, keptnEvent, "dynatrace", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index := getMonacoSnapshotIndex(&BaseKeptnEvent{Project: "sockshop", Stage: "dev"}, "dynatrace")
+	if strings.Join(index.Contexts, ",") != "context-3,context-2" {
+		t.Errorf("Expected the latest two snapshots in the index, got %v", index.Contexts)
+	}
+	for context, expected := range map[string]bool{"context-1": false, "context-2": true, "context-3": true} {
+		if FileExists(GetMonacoSnapshotResource(&BaseKeptnEvent{Context: context}, "dynatrace")) != expected {
+			t.Errorf("Expected snapshot of %s to exist: %v", context, expected)
+		}
+	}
+}
+
+// Tests that payloads with credentials are not stored in the Keptn repo and are skipped by a rollback
+func TestUploadMonacoSnapshotCredentials(t *testing.T) {
+	RunLocal = true
+	defer func() { RunLocal = false }()
+	defer os.RemoveAll(MonacoSnapshotFolder)
+
+	snapshot := &MonacoSnapshot{Tenant: "https://abc12345.live.dynatrace.com", Configs: []*MonacoSnapshotConfig{
+		{Project: "monaco", ConfigType: "auto-tag", ConfigName: "tagging", ApiPath: MonacoConfigApis["auto-tag"], Name: "dev", EntityID: "tag-1", Payload: []byte(`{"name": "dev", "rules": []}`)},
+		{Project: "monaco", ConfigType: "notification", ConfigName: "slack", ApiPath: MonacoConfigApis["notification"], Name: "slack", EntityID: "notification-1", Payload: []byte(`{"name": "slack", "url": "https://hooks.slack.com/services/T000/B000/XXXX"}`)},
+		{Project: "monaco", ConfigType: "dashboard", ConfigName: "overview", ApiPath: MonacoConfigApis["dashboard"], Name: "overview", EntityID: "dashboard-1", Payload: []byte(`{"tiles": [{"config": {"apiKey": "s3cr3t"}}]}`)},
+	}}
+	keptnEvent := &BaseKeptnEvent{Context: "credentials-test", Project: "sockshop", Stage: "dev"}
+	err := UploadMonacoSnapshot(snapshot, keptnEvent, "dynatrace", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := ioutil.ReadFile(GetMonacoSnapshotResource(keptnEvent, "dynatrace"))
+	if strings.Contains(string(content), "hooks.slack.com") || strings.Contains(string(content), "s3cr3t") {
+		t.Errorf("Expected no credentials in the stored snapshot, got %s", content)
+	}
+	if len(snapshot.Configs[1].Payload) == 0 {
+		t.Errorf("Expected the snapshot of the run to keep the payloads for a rollback on failure")
+	}
+
+	stored, err := GetMonacoSnapshot(keptnEvent, "dynatrace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Configs[0].Payload) == 0 || !stored.Configs[1].PayloadOmitted || !stored.Configs[2].PayloadOmitted {
+		t.Errorf("Expected only the payload of the auto-tag, got %+v", stored.Configs)
+	}
+
+	api := newFakeDynatraceConfigAPI()
+	api.add("/api/config/v1/notifications", "notification-1", `{"name": "slack", "url": "https://hooks.slack.com/services/T000/B000/YYYY"}`)
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	stored.Tenant = server.URL
+	_, err = RestoreMonacoSnapshot(&DTCredentials{Tenant: server.URL, ApiToken: "test-token"}, stored, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(api.configs["/api/config/v1/notifications"]["notification-1"]), "YYYY") {
+		t.Errorf("Expected the notification without stored payload to stay untouched")
+	}
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// monacoTokenScopes are the API token scopes monaco needs to read and write a config type
+type monacoTokenScopes struct {
+	Read  string
+	Write string
+}
+
+// scopes of the config types of the Configuration API
+var defaultMonacoTokenScopes = monacoTokenScopes{Read: "ReadConfig", Write: "WriteConfig"}
+
+/**
+ * Config types that use other APIs than the Configuration API and need other scopes
+ */
+var monacoConfigTypeTokenScopes = map[string]monacoTokenScopes{
+	"synthetic-location": {Read: "ExternalSyntheticIntegration", Write: "ExternalSyntheticIntegration"},
+	"synthetic-monitor":  {Read: "ExternalSyntheticIntegration", Write: "ExternalSyntheticIntegration"},
+	"slo":                {Read: "slo.read", Write: "slo.write"},
+	"credential-vault":   {Read: "credentialVault.read", Write: "credentialVault.write"},
+}
+
+/**
+ * Returns the scopes the API token needs for the config types, mapped to the config types that need them.
+ * Read only runs (dry run, plan, drift, download) only need the read scopes
+ */
+func RequiredTokenScopes(configTypes []string, write bool) map[string][]string {
+	required := map[string][]string{}
+	for _, configType := range configTypes {
+		scopes, ok := monacoConfigTypeTokenScopes[configType]
+		if !ok {
+			scopes = defaultMonacoTokenScopes
+		}
+
+		required[scopes.Read] = appendUnique(required[scopes.Read], configType)
+		if write {
+			required[scopes.Write] = appendUnique(required[scopes.Write], configType)
+		}
+	}
+	return required
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+/**
+ * Returns the config types of the monaco projects, i.e: the folders with yaml files inside the project folders that are named like
+ * a config type, e.g: sockshop/auto-tag or nested projects like sockshop/infra/auto-tag. Other folders with yaml files are logged and ignored.
+ * projects is the comma separated list passed to monaco, all projects are used if it is empty
+ */
+func GetMonacoProjectConfigTypes(projectsFolder string, projects string) ([]string, error) {
+	projectFolders := []string{}
+	for _, project := range strings.Split(projects, ",") {
+		if strings.TrimSpace(project) != "" {
+			projectFolders = append(projectFolders, filepath.Join(projectsFolder, strings.TrimSpace(project)))
+		}
+	}
+	if len(projectFolders) == 0 {
+		projectFolders = append(projectFolders, projectsFolder)
+	}
+
+	found := map[string]bool{}
+	ignored := map[string]bool{}
+	for _, projectFolder := range projectFolders {
+		err := filepath.Walk(projectFolder, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			extension := strings.ToLower(filepath.Ext(path))
+			if info.IsDir() || (extension != ".yaml" && extension != ".yml") || filepath.Dir(path) == projectFolder {
+				return nil
+			}
+			configType := filepath.Base(filepath.Dir(path))
+			if isMonacoConfigType(configType) {
+				found[configType] = true
+			} else if !ignored[filepath.Dir(path)] {
+				ignored[filepath.Dir(path)] = true
+				log.Printf("Ignoring %s when validating the token scopes as %s is no known config type\n", filepath.Dir(path), configType)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Error reading monaco project %s: %v", projectFolder, err)
+		}
+	}
+
+	configTypes := []string{}
+	for configType := range found {
+		configTypes = append(configTypes, configType)
+	}
+	sort.Strings(configTypes)
+	return configTypes, nil
+}
+
+// returns true for the config types of the Configuration API and the config types with their own API, e.g: slo
+func isMonacoConfigType(configType string) bool {
+	_, ok := MonacoConfigApis[configType]
+	if !ok {
+		_, ok = monacoConfigTypeTokenScopes[configType]
+	}
+	return ok
+}
+
+/**
+ * Checks that the tenant is reachable and that the API token is valid and has the required scopes before monaco runs.
+ * If the credentials contain an OAuth client it is checked that it can get an access token.
+ * The errors tell the user what to fix, e.g: the scopes that have to be added to the token
+ */
+func ValidateDTCredentials(dtCredentials *DTCredentials, requiredScopes map[string][]string, httpClient *http.Client) error {
+	// the OAuth client is only used for the platform configs, it has to be able to get a token
+	if dtCredentials.ClientID != "" {
+		_, err := GetOAuthTokenSource(dtCredentials, httpClient).Token()
+		if err != nil {
+			return fmt.Errorf("%v, check DT_CLIENT_ID, DT_CLIENT_SECRET and DT_TOKEN_ENDPOINT", err)
+		}
+	}
+	// the scopes can only be looked up for API tokens
+	if dtCredentials.ApiToken == "" {
+		return nil
+	}
+
+	client := NewDynatraceClient(dtCredentials, httpClient)
+	tokenInfo, err := client.LookupToken()
+	if err != nil {
+		apiErr, ok := err.(*DynatraceAPIError)
+		if !ok {
+			return fmt.Errorf("Dynatrace tenant %s is not reachable, check DT_TENANT: %v", dtCredentials.Tenant, err)
+		}
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized:
+			return fmt.Errorf("The API token for %s is invalid, check DT_API_TOKEN", dtCredentials.Tenant)
+		case http.StatusNotFound:
+			return fmt.Errorf("%s is not a Dynatrace tenant, check DT_TENANT (e.g: https://abc12345.live.dynatrace.com or https://managed.example.com/e/<environment-id>)", dtCredentials.Tenant)
+		}
+		return fmt.Errorf("Error validating the API token for %s: %v", dtCredentials.Tenant, err)
+	}
+
+	if !tokenInfo.Enabled {
+		return fmt.Errorf("The API token %s for %s is disabled", tokenInfo.Name, dtCredentials.Tenant)
+	}
+	if tokenInfo.ExpirationDate != "" {
+		expirationDate, err := time.Parse(time.RFC3339, tokenInfo.ExpirationDate)
+		if err == nil && expirationDate.Before(time.Now()) {
+			return fmt.Errorf("The API token %s for %s expired on %s", tokenInfo.Name, dtCredentials.Tenant, tokenInfo.ExpirationDate)
+		}
+	}
+
+	granted := map[string]bool{}
+	for _, scope := range tokenInfo.Scopes {
+		granted[scope] = true
+	}
+	missing := []string{}
+	for scope, configTypes := range requiredScopes {
+		if !granted[scope] {
+			sort.Strings(configTypes)
+			missing = append(missing, fmt.Sprintf("%s (%s)", scope, strings.Join(configTypes, ", ")))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("The API token %s for %s is missing the scopes: %s. Add them to the token in Dynatrace",
+			tokenInfo.Name, dtCredentials.Tenant, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+/**
+ * Validates the credentials for the config types of the monaco projects prepared in the temp folder of the keptn context
+ */
+func ValidateMonacoCredentials(dtCredentials *DTCredentials, keptnEvent *BaseKeptnEvent, projects string, write bool, httpClient *http.Client) error {
+	configTypes, err := GetMonacoProjectConfigTypes(GetMonacoProjectsFolder(keptnEvent), projects)
+	if err != nil {
+		return err
+	}
+	return ValidateDTCredentials(dtCredentials, RequiredTokenScopes(configTypes, write), httpClient)
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeTokenLookupAPI answers the token lookup API for the tokens it knows and with 401 for all others
+func fakeTokenLookupAPI(tokens map[string]*DynatraceTokenInfo) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v2/apiTokens/lookup" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		request := map[string]string{}
+		json.NewDecoder(r.Body).Decode(&request)
+		tokenInfo, ok := tokens[request["token"]]
+		if !ok || r.Header.Get("Authorization") != "Api-Token "+request["token"] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(tokenInfo)
+	}))
+}
+
+func TestValidateDTCredentials(t *testing.T) {
+	server := fakeTokenLookupAPI(map[string]*DynatraceTokenInfo{
+		"dt0c01.config":   {Name: "monaco", Enabled: true, Scopes: []string{"ReadConfig", "WriteConfig"}},
+		"dt0c01.readonly": {Name: "readonly", Enabled: true, Scopes: []string{"ReadConfig"}},
+		"dt0c01.disabled": {Name: "disabled", Enabled: false, Scopes: []string{"ReadConfig", "WriteConfig"}},
+		"dt0c01.expired":  {Name: "expired", Enabled: true, ExpirationDate: "2020-01-01T00:00:00Z", Scopes: []string{"ReadConfig", "WriteConfig"}},
+	})
+	defer server.Close()
+
+	configTypes := []string{"auto-tag", "dashboard", "slo"}
+	tests := []struct {
+		token    string
+		write    bool
+		expected string
+	}{
+		{"dt0c01.config", false, "missing the scopes: slo.read (slo)"},
+		{"dt0c01.config", true, "missing the scopes: slo.read (slo), slo.write (slo)"},
+		{"dt0c01.readonly", true, "missing the scopes: WriteConfig (auto-tag, dashboard), slo.read (slo), slo.write (slo)"},
+		{"dt0c01.disabled", false, "is disabled"},
+		{"dt0c01.expired", false, "expired on 2020-01-01T00:00:00Z"},
+		{"dt0c01.unknown", false, "check DT_API_TOKEN"},
+	}
+	for _, test := range tests {
+		err := ValidateDTCredentials(&DTCredentials{Tenant: server.URL, ApiToken: test.token}, RequiredTokenScopes(configTypes, test.write), server.Client())
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected an error containing '%s' for %s, got %v", test.expected, test.token, err)
+		}
+	}
+
+	err := ValidateDTCredentials(&DTCredentials{Tenant: server.URL, ApiToken: "dt0c01.config"}, RequiredTokenScopes([]string{"auto-tag", "dashboard"}, true), server.Client())
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	err = ValidateDTCredentials(&DTCredentials{Tenant: server.URL + "/wrong", ApiToken: "dt0c01.config"}, nil, server.Client())
+	if err == nil || !strings.Contains(err.Error(), "check DT_TENANT") {
+		t.Errorf("Expected an error for a wrong tenant URL, got %v", err)
+	}
+
+	url := server.URL
+	server.Close()
+	err = ValidateDTCredentials(&DTCredentials{Tenant: url, ApiToken: "dt0c01.config"}, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "is not reachable") {
+		t.Errorf("Expected an error for an unreachable tenant, got %v", err)
+	}
+}
+
+func TestGetMonacoProjectConfigTypes(t *testing.T) {
+	keptnEvent := &BaseKeptnEvent{Context: "validate-test", Project: "sockshop", Stage: "dev"}
+	defer os.RemoveAll("tmp")
+
+	writeTestMonacoProject(t, keptnEvent, map[string]string{
+		"infrastructure/management-zone/zones.yaml": "config: []",
+		"infrastructure/README.md":                  "",
+		"sockshop/auto-tag/tagging.yaml":            "config: []",
+		"sockshop/slo/slo.yml":                      "config: []",
+		"sockshop/dashboard/dashboard.json":         "{}",
+		"sockshop/apps/dashboard/overview.yaml":     "config: []",
+		"sockshop/apps/templates/shared.yaml":       "config: []",
+	})
+
+	configTypes, err := GetMonacoProjectConfigTypes(GetMonacoProjectsFolder(keptnEvent), "sockshop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(configTypes, []string{"auto-tag", "dashboard", "slo"}) {
+		t.Errorf("Unexpected config types %v", configTypes)
+	}
+
+	configTypes, _ = GetMonacoProjectConfigTypes(GetMonacoProjectsFolder(keptnEvent), "")
+	if !reflect.DeepEqual(configTypes, []string{"auto-tag", "dashboard", "management-zone", "slo"}) {
+		t.Errorf("Unexpected config types of all projects %v", configTypes)
+	}
+}